@@ -0,0 +1,142 @@
+package itlssp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// BezelStorage selects whether the bezel colour survives a device reset
+type BezelStorage byte
+
+const (
+	BezelVolatile   BezelStorage = 0x00
+	BezelPersistent BezelStorage = 0x01
+)
+
+// Colour is a RGB bezel colour
+type Colour struct {
+	R byte
+	G byte
+	B byte
+}
+
+var (
+	ColourOff   = Colour{0x00, 0x00, 0x00}
+	ColourRed   = Colour{0xFF, 0x00, 0x00}
+	ColourGreen = Colour{0x00, 0xFF, 0x00}
+	ColourBlue  = Colour{0x00, 0x00, 0xFF}
+)
+
+func (this Colour) String() string {
+	return fmt.Sprintf("#%02X%02X%02X", this.R, this.G, this.B)
+}
+
+// ParseColour parses "#RRGGBB" or "RRGGBB" colour
+func ParseColour(s string) (Colour, error) {
+	buf, err := hex.DecodeString(strings.TrimPrefix(s, "#"))
+	if err != nil || len(buf) != 3 {
+		return Colour{}, errors.Errorf("Invalid colour %q", s)
+	}
+	return Colour{buf[0], buf[1], buf[2]}, nil
+}
+
+// MarshalText encodes the colour as "#RRGGBB"
+func (this Colour) MarshalText() ([]byte, error) {
+	return []byte(this.String()), nil
+}
+
+// UnmarshalText decodes "#RRGGBB" colour, so the scheme can be read from a config
+func (this *Colour) UnmarshalText(text []byte) error {
+	c, err := ParseColour(string(text))
+	if err != nil {
+		return err
+	}
+	*this = c
+	return nil
+}
+
+// ConfigureBezel sets the bezel colour
+func (this *validator) ConfigureBezel(c Colour, storage BezelStorage) error {
+	buf := []byte{byte(SspCmdConfigureBezel), c.R, c.G, c.B, byte(storage)}
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// BezelScheme is the bezel colour of each device state, nil colour keeps
+// the bezel unchanged in the state
+type BezelScheme struct {
+	Enabled  *Colour
+	Disabled *Colour
+	Jammed   *Colour
+}
+
+type bezelState byte
+
+const (
+	bezelUnknown bezelState = iota
+	bezelEnabled
+	bezelDisabled
+	bezelJammed
+)
+
+// Bezel is the device API of the bezel tracker, the validator or a wrapper of it
+type Bezel interface {
+	ConfigureBezel(c Colour, storage BezelStorage) error
+	Poll() ([]Event, error)
+}
+
+// BezelTracker changes the bezel colour on device state transitions.
+// Colours are not stored to avoid wearing the device memory.
+type BezelTracker struct {
+	Scheme BezelScheme
+	dev    Bezel
+	state  bezelState
+}
+
+// NewBezelTracker returns the tracker setting the bezel colours of the device
+func NewBezelTracker(dev Bezel, scheme BezelScheme) *BezelTracker {
+	return &BezelTracker{
+		Scheme: scheme,
+		dev:    dev,
+	}
+}
+
+// Update takes events of the last poll and sets the colour of the new state
+func (this *BezelTracker) Update(events []Event) error {
+	state := bezelEnabled
+	for _, ev := range events {
+		switch ev.Code {
+		case SspEventSafeJam, SspEventUnsafeJam, SspEventJammed:
+			state = bezelJammed
+		case SspEventDisabled:
+			if state != bezelJammed {
+				state = bezelDisabled
+			}
+		case SspEventSlaveReset:
+			this.state = bezelUnknown
+		}
+	}
+	if state == this.state {
+		return nil
+	}
+
+	var c *Colour
+	switch state {
+	case bezelEnabled:
+		c = this.Scheme.Enabled
+	case bezelDisabled:
+		c = this.Scheme.Disabled
+	case bezelJammed:
+		c = this.Scheme.Jammed
+	}
+	if c != nil {
+		if err := this.dev.ConfigureBezel(*c, BezelVolatile); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	this.state = state
+	return nil
+}
@@ -0,0 +1,69 @@
+package itlssp
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseColour(t *testing.T) {
+	var table = []struct {
+		src string
+		exp Colour
+	}{
+		{"#00FF00", ColourGreen},
+		{"ff0000", ColourRed},
+		{"#000000", ColourOff},
+	}
+
+	for _, v := range table {
+		c, err := ParseColour(v.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != v.exp {
+			t.Errorf("ParseColour failed, expected %s, got %s", v.exp, c)
+		}
+	}
+	if _, err := ParseColour("#00FF"); err == nil {
+		t.Error("ParseColour failed, expected error")
+	}
+}
+
+func TestBezelSchemeJSON(t *testing.T) {
+	var scheme BezelScheme
+	if err := json.Unmarshal([]byte(`{"Enabled":"#00FF00","Jammed":"#FF0000"}`), &scheme); err != nil {
+		t.Fatal(err)
+	}
+	if scheme.Enabled == nil || *scheme.Enabled != ColourGreen || scheme.Disabled != nil || *scheme.Jammed != ColourRed {
+		t.Errorf("BezelScheme unmarshal failed, got %+v", scheme)
+	}
+}
+
+func TestBezelTracker(t *testing.T) {
+	u := &fakeUnit{}
+	off, green, red := ColourOff, ColourGreen, ColourRed
+	b := NewBezelTracker(&validator{generic{unit: u}}, BezelScheme{Enabled: &green, Disabled: &off, Jammed: &red})
+
+	var table = [][]Event{
+		{{Code: SspEventDisabled}},
+		{{Code: SspEventDisabled}},
+		{},
+		{{Code: SspEventRead, Channel: 1}},
+		{{Code: SspEventUnsafeJam}},
+		{{Code: SspEventUnsafeJam}, {Code: SspEventDisabled}},
+	}
+	for _, v := range table {
+		if err := b.Update(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exp := [][]byte{
+		{0x54, 0x00, 0x00, 0x00, 0x00},
+		{0x54, 0x00, 0xFF, 0x00, 0x00},
+		{0x54, 0xFF, 0x00, 0x00, 0x00},
+	}
+	if !reflect.DeepEqual(u.sent, exp) {
+		t.Errorf("BezelTracker failed, expected %X, got %X", exp, u.sent)
+	}
+}
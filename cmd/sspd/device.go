@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charoit/itlssp"
+	"github.com/charoit/itlssp/internal/bus"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	recentEvents   = 20
+	recoverTimeout = 30 * time.Second
+)
+
+var errNoPayout = errors.New("device has no payout")
+
+// station is the device API of the daemon
+type station interface {
+	bus.Station
+	Enable() error
+	Disable() error
+	GetCounters() (*itlssp.Counters, error)
+	SetInhibits(mask uint16) error
+	GetAllLevels() ([]itlssp.Denomination, error)
+	SetDenominationRoute(route itlssp.Route, value uint32, currency string) error
+	GetDenominationRoute(value uint32, currency string) (itlssp.Route, error)
+	EnablePayout() error
+	PayoutAmount(amount uint32, currency string, opt itlssp.PayoutOption) (*itlssp.PayoutResult, error)
+	FloatAmount(minPayout uint16, amount uint32, currency string, opt itlssp.PayoutOption) (*itlssp.PayoutResult, error)
+	EmptyAll() error
+	SmartEmpty() error
+	RecoverPayouts(ctx context.Context, j *itlssp.Journal) (*itlssp.PayoutRecovery, error)
+}
+
+// Recent is a polled event of the device
+type Recent struct {
+	Time    time.Time
+	Event   string
+	Channel byte            `json:",omitempty"`
+	Amounts []itlssp.Amount `json:",omitempty"`
+}
+
+// State is what the daemon knows of the device from polling
+type State struct {
+	Connected bool
+	Enabled   bool
+	State     string
+	Inhibits  *uint16 `json:",omitempty"` // nil until set through the daemon
+	Events    []Recent
+	Error     string `json:",omitempty"`
+}
+
+// Summary is the device in the device list
+type Summary struct {
+	ID        string
+	Port      string
+	Addr      byte
+	Type      string
+	Currency  string
+	Serial    uint32
+	Connected bool
+	State     string
+}
+
+// device owns one device: it polls it all the time, so the device stays
+// enabled and the key negotiated, and runs requests between polls
+type device struct {
+	id      string
+	found   *itlssp.SSPDevice
+	dev     station
+	poller  *bus.Poller
+	journal *itlssp.Journal // nil journals nothing
+
+	mu       sync.Mutex
+	tracker  *itlssp.Tracker
+	info     *itlssp.Info
+	enabled  bool
+	inhibits *uint16
+	events   []Recent
+	lastErr  error
+}
+
+func newDevice(found *itlssp.SSPDevice, dev station, lock sync.Locker) *device {
+	this := &device{id: strconv.FormatUint(uint64(found.Serial), 10), found: found, dev: dev,
+		tracker: itlssp.NewTracker()}
+	this.poller = bus.NewPoller(found, dev, lock, this)
+	return this
+}
+
+// payout reports whether the device stores notes or coins for payout
+func (this *device) payout() bool {
+	switch this.found.Unit.Type {
+	case itlssp.SMARTPayout, itlssp.SMARTHopper, itlssp.NV11:
+		return true
+	}
+	return false
+}
+
+// Connected keeps the identity read at connect and recovers the journal
+func (this *device) Connected(info *itlssp.Info, err error) {
+	this.mu.Lock()
+	if err != nil {
+		this.lastErr = err
+		this.mu.Unlock()
+		return
+	}
+	this.info, this.lastErr = info, nil
+	this.mu.Unlock()
+	if this.journal != nil {
+		this.recover()
+	}
+}
+
+// recover reconciles the journal with the counters of the device and
+// settles payouts interrupted by a restart of the daemon or the device
+func (this *device) recover() {
+	serial := this.found.Serial
+	var res *itlssp.PayoutRecovery
+	err := this.poller.Do(func() error {
+		counters, err := this.dev.GetCounters()
+		if err != nil {
+			return err
+		}
+		rec, err := this.journal.Reconcile(serial, counters)
+		if err != nil {
+			return err
+		}
+		if rec.Missing != 0 {
+			log.Warn().Str("id", this.id).Int("missing", rec.Missing).Msg("Journal differs from the device counters")
+		}
+		if len(rec.Pending) == 0 || !this.payout() {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), recoverTimeout)
+		defer cancel()
+		res, err = this.dev.RecoverPayouts(ctx, this.journal)
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Str("id", this.id).Msg("Journal recovery failed")
+	}
+	if res == nil {
+		return
+	}
+	for _, e := range res.Unresolved {
+		log.Warn().Str("id", this.id).Str("entry", e.String()).Msg("Payout outcome unknown, count by hand")
+	}
+	this.mu.Lock()
+	this.apply(res.Events, time.Now())
+	this.mu.Unlock()
+}
+
+// Polled keeps the recent events and journals them
+func (this *device) Polled(events []itlssp.Event, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if err != nil {
+		this.lastErr = err
+		if !this.poller.Connected() {
+			this.tracker.Reset()
+		}
+		return
+	}
+	this.lastErr = nil
+	this.apply(events, time.Now())
+	if this.journal != nil {
+		if err = this.journal.RecordEvents(this.found.Serial, this.info.Setup.Channels, events); err != nil {
+			this.lastErr = err
+			log.Error().Err(err).Str("id", this.id).Msg("Journal failed")
+		}
+	}
+}
+
+// apply updates the state and the recent events, the caller holds the lock
+func (this *device) apply(events []itlssp.Event, now time.Time) {
+	this.tracker.Update(events)
+	this.enabled = true
+	for _, e := range events {
+		if e.Code == itlssp.SspEventDisabled {
+			this.enabled = false
+			continue // repeated by every poll while disabled
+		}
+		this.events = append(this.events, Recent{Time: now, Event: e.Code.String(), Channel: e.Channel, Amounts: e.Amounts})
+	}
+	if n := len(this.events); n > recentEvents {
+		this.events = this.events[n-recentEvents:]
+	}
+}
+
+// Summary returns the device in the device list
+func (this *device) Summary() *Summary {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return &Summary{
+		ID:        this.id,
+		Port:      this.found.Port.Name,
+		Addr:      this.found.Port.Addr,
+		Type:      this.found.Unit.Type.String(),
+		Currency:  this.found.Unit.Currency,
+		Serial:    this.found.Serial,
+		Connected: this.poller.Connected(),
+		State:     this.stateName(),
+	}
+}
+
+// State returns the polled state
+func (this *device) State() *State {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	s := &State{
+		Connected: this.poller.Connected(),
+		Enabled:   this.enabled,
+		State:     this.stateName(),
+		Inhibits:  this.inhibits,
+		Events:    append([]Recent(nil), this.events...),
+	}
+	if this.lastErr != nil {
+		s.Error = this.lastErr.Error()
+	}
+	return s
+}
+
+func (this *device) stateName() string {
+	if !this.poller.Connected() {
+		return "Offline"
+	}
+	return this.tracker.State().String()
+}
+
+// Info returns the identity read at connect
+func (this *device) Info() (*itlssp.Info, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if !this.poller.Connected() {
+		return nil, bus.ErrOffline
+	}
+	return this.info, nil
+}
+
+func (this *device) Counters() (c *itlssp.Counters, err error) {
+	err = this.do(func() error {
+		c, err = this.dev.GetCounters()
+		return err
+	})
+	return c, err
+}
+
+func (this *device) Levels() (levels []itlssp.Denomination, err error) {
+	if !this.payout() {
+		return nil, errNoPayout
+	}
+	err = this.do(func() error {
+		levels, err = this.dev.GetAllLevels()
+		return err
+	})
+	return levels, err
+}
+
+func (this *device) Enable() error {
+	return this.do(this.dev.Enable)
+}
+
+func (this *device) Disable() error {
+	return this.do(this.dev.Disable)
+}
+
+// SetInhibits enables the channels of the mask
+func (this *device) SetInhibits(mask uint16) error {
+	err := this.do(func() error {
+		return this.dev.SetInhibits(mask)
+	})
+	if err == nil {
+		this.mu.Lock()
+		this.inhibits = &mask
+		this.mu.Unlock()
+	}
+	return err
+}
+
+// DenominationRoute is the route of one channel value
+type DenominationRoute struct {
+	Value    uint32
+	Currency string
+	Route    string
+}
+
+// Routes reads the route of every channel
+func (this *device) Routes() (routes []DenominationRoute, err error) {
+	if !this.payout() {
+		return nil, errNoPayout
+	}
+	info, err := this.Info()
+	if err != nil {
+		return nil, err
+	}
+	err = this.do(func() error {
+		for _, ch := range info.Setup.Channels {
+			r, err := this.dev.GetDenominationRoute(uint32(ch.Value), string(ch.Currency))
+			if err != nil {
+				return err
+			}
+			routes = append(routes, DenominationRoute{uint32(ch.Value), string(ch.Currency), r.String()})
+		}
+		return nil
+	})
+	return routes, err
+}
+
+func (this *device) SetRoute(route itlssp.Route, value uint32, currency string) error {
+	if !this.payout() {
+		return errNoPayout
+	}
+	return this.do(func() error {
+		return this.dev.SetDenominationRoute(route, value, currency)
+	})
+}
+
+// Payout starts the payout, the poll loop reports its progress
+func (this *device) Payout(amount uint32, currency string, opt itlssp.PayoutOption, k keyed) (res *itlssp.PayoutResult, err error) {
+	if !this.payout() {
+		return nil, errNoPayout
+	}
+	if err = checkCurrency(currency); err != nil {
+		return nil, err
+	}
+	err = this.do(func() error {
+		if err := this.dev.EnablePayout(); err != nil {
+			return err
+		}
+		pending, err := this.begin(itlssp.EntryPayout, amount, currency, opt, k)
+		if err != nil {
+			return err
+		}
+		res, err = this.dev.PayoutAmount(amount, currency, opt)
+		return this.declined(pending, res, err)
+	})
+	return res, err
+}
+
+// Float pays out down to the amount, keeping minPayout the smallest payout
+func (this *device) Float(minPayout uint16, amount uint32, currency string, opt itlssp.PayoutOption, k keyed) (res *itlssp.PayoutResult, err error) {
+	if !this.payout() {
+		return nil, errNoPayout
+	}
+	if err = checkCurrency(currency); err != nil {
+		return nil, err
+	}
+	err = this.do(func() error {
+		if err := this.dev.EnablePayout(); err != nil {
+			return err
+		}
+		pending, err := this.begin(itlssp.EntryFloat, amount, currency, opt, k)
+		if err != nil {
+			return err
+		}
+		res, err = this.dev.FloatAmount(minPayout, amount, currency, opt)
+		return this.declined(pending, res, err)
+	})
+	return res, err
+}
+
+// begin journals the real payout or float with the key of the request
+// before the command is sent, the poll loop settles it
+func (this *device) begin(kind itlssp.EntryKind, amount uint32, currency string, opt itlssp.PayoutOption, k keyed) (*itlssp.JournalEntry, error) {
+	if this.journal == nil || opt != itlssp.PayoutReal {
+		return nil, nil
+	}
+	e := &itlssp.JournalEntry{Serial: this.found.Serial, Kind: kind, Status: itlssp.EntryPending, Requested: amount,
+		Currency: currency, Key: k.key, Note: k.request}
+	if err := this.journal.Append(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// declined settles with nothing paid the journaled operation the device
+// declined or refused. The outcome of a command without a reply, such as
+// a timeout or a lost reply, is left pending to the recovery at connect.
+func (this *device) declined(pending *itlssp.JournalEntry, res *itlssp.PayoutResult, err error) error {
+	if pending == nil || (err == nil && res.Ok) || (err != nil && !itlssp.Refused(err)) {
+		return err
+	}
+	if serr := this.journal.Settle(pending, 0); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// checkCurrency rejects currencies the payout commands cannot send
+func checkCurrency(currency string) error {
+	if len(currency) != 3 {
+		return badRequest(fmt.Sprintf("invalid currency %q", currency))
+	}
+	return nil
+}
+
+// Empty moves stored notes to the cashbox, smart empty counts them
+func (this *device) Empty(smart bool) error {
+	if !this.payout() {
+		return errNoPayout
+	}
+	if smart {
+		return this.do(this.dev.SmartEmpty)
+	}
+	return this.do(this.dev.EmptyAll)
+}
+
+// do runs the action on the connected device between polls
+func (this *device) do(action func() error) error {
+	return this.poller.Do(action)
+}
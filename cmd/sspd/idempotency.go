@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/charoit/itlssp"
+)
+
+var (
+	errKeyReused    = errors.New("idempotency key was used for another request")
+	errKeyInProcess = errors.New("request with the idempotency key is in progress")
+)
+
+// response is the stored response of a mutating request
+type response struct {
+	request string // method, path and body of the first request
+	done    bool
+	status  int
+	body    []byte
+	expires time.Time
+}
+
+// keyed is the client request of the idempotency key, payouts and floats
+// journal it with the operation
+type keyed struct {
+	key     string
+	request string
+}
+
+// JournalReplay is the response to a key found only in the journal, the
+// daemon restarted after the first request
+type JournalReplay struct {
+	Journal []itlssp.JournalEntry
+}
+
+// idempotency keeps responses by Idempotency-Key, a retried request gets the
+// stored response and the device does not pay out twice. Responses are kept
+// in memory, keys of payouts and floats also in the journal, so a retry
+// after a restart gets the journaled outcome.
+type idempotency struct {
+	ttl     time.Duration
+	journal *itlssp.Journal // nil keeps keys in memory only
+	mu      sync.Mutex
+	entries map[string]*response
+}
+
+func newIdempotency(ttl time.Duration, journal *itlssp.Journal) *idempotency {
+	return &idempotency{ttl: ttl, journal: journal, entries: make(map[string]*response)}
+}
+
+// do runs handle once for the key and stores its response. Responses of
+// requests that sent nothing to the device are not stored, the client can
+// correct the request or wait for the device and retry it with the key.
+// Unknown outcomes (502) are stored. replayed reports the response is the
+// stored one.
+func (this *idempotency) do(key, request string, handle func() (int, []byte)) (status int, body []byte, replayed bool, err error) {
+	now := time.Now()
+	this.mu.Lock()
+	for k, r := range this.entries {
+		if r.done && now.After(r.expires) {
+			delete(this.entries, k)
+		}
+	}
+	if r, ok := this.entries[key]; ok {
+		defer this.mu.Unlock()
+		switch {
+		case r.request != request:
+			return 0, nil, false, errKeyReused
+		case !r.done:
+			return 0, nil, false, errKeyInProcess
+		}
+		return r.status, r.body, true, nil
+	}
+	if r, err := this.journaled(key, request); r != nil || err != nil {
+		defer this.mu.Unlock()
+		if err != nil {
+			return 0, nil, false, err
+		}
+		r.expires = now.Add(this.ttl)
+		this.entries[key] = r
+		return r.status, r.body, true, nil
+	}
+	r := &response{request: request}
+	this.entries[key] = r
+	this.mu.Unlock()
+
+	status, body = handle()
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if unsent(status) {
+		delete(this.entries, key)
+	} else {
+		r.done, r.status, r.body, r.expires = true, status, body, time.Now().Add(this.ttl)
+	}
+	return status, body, false, nil
+}
+
+// unsent reports whether the response status means no command reached the
+// device: invalid request (400), no such device or payout (404) and device
+// offline (503)
+func unsent(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// journaled returns the response of the key from the journal, nil if the
+// journal has no operation of the key
+func (this *idempotency) journaled(key, request string) (*response, error) {
+	if this.journal == nil {
+		return nil, nil
+	}
+	entries := this.journal.Keyed(key)
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	if entries[0].Note != request {
+		return nil, errKeyReused
+	}
+	body, _ := json.Marshal(&JournalReplay{Journal: entries})
+	return &response{request: request, done: true, status: http.StatusOK, body: body}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIdempotency(t *testing.T) {
+	keys := newIdempotency(time.Hour, nil)
+	runs := 0
+	handle := func(status int) func() (int, []byte) {
+		return func() (int, []byte) {
+			runs++
+			return status, []byte("done")
+		}
+	}
+	var table = []struct {
+		key      string
+		request  string
+		status   int
+		replayed bool
+		err      error
+		runs     int
+	}{
+		{"a", "POST /payout 1000", http.StatusOK, false, nil, 1},
+		{"a", "POST /payout 1000", http.StatusOK, true, nil, 1},
+		{"a", "POST /payout 2000", 0, false, errKeyReused, 1},
+		{"b", "POST /payout {", http.StatusBadRequest, false, nil, 2},
+		{"b", "POST /payout 2000", http.StatusOK, false, nil, 3},
+		{"c", "POST /empty", http.StatusBadGateway, false, nil, 4},
+		{"c", "POST /empty", http.StatusBadGateway, true, nil, 4},
+		{"d", "POST /payout 500", http.StatusServiceUnavailable, false, nil, 5},
+		{"d", "POST /payout 500", http.StatusOK, false, nil, 6},
+		{"e", "POST /float 500", http.StatusNotFound, false, nil, 7},
+		{"e", "POST /float 500", http.StatusNotFound, false, nil, 8},
+	}
+
+	for i, v := range table {
+		status := http.StatusOK
+		if v.status != 0 {
+			status = v.status
+		}
+		got, body, replayed, err := keys.do(v.key, v.request, handle(status))
+		if err != v.err || replayed != v.replayed || runs != v.runs || (err == nil && (got != v.status || string(body) != "done")) {
+			t.Errorf("%d: do failed, expected %d replayed %v %v runs %d, got %d %q replayed %v %v runs %d",
+				i, v.status, v.replayed, v.err, v.runs, got, body, replayed, err, runs)
+		}
+	}
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	keys := newIdempotency(time.Hour, nil)
+	started, release := make(chan struct{}), make(chan struct{})
+	go keys.do("a", "POST /payout", func() (int, []byte) {
+		close(started)
+		<-release
+		return http.StatusOK, nil
+	})
+	<-started
+	if _, _, _, err := keys.do("a", "POST /payout", nil); err != errKeyInProcess {
+		t.Errorf("do failed, expected %v, got %v", errKeyInProcess, err)
+	}
+	close(release)
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	keys := newIdempotency(time.Millisecond, nil)
+	keys.do("a", "POST /enable", func() (int, []byte) { return http.StatusOK, nil })
+	time.Sleep(5 * time.Millisecond)
+	_, _, replayed, err := keys.do("a", "POST /disable", func() (int, []byte) { return http.StatusOK, nil })
+	if replayed || err != nil || len(keys.entries) != 1 {
+		t.Errorf("do failed, expected a new run and 1 entry after expiry, got replayed %v %v, %d entries", replayed, err, len(keys.entries))
+	}
+}
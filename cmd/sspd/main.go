@@ -0,0 +1,130 @@
+// Command sspd owns the serial ports of the devices and serves them over
+// HTTP, so applications that cannot share a port, like containers, use the
+// devices through one daemon that arbitrates access.
+//
+//	sspd -port /dev/ttyUSB0 -addr 0,16 -listen :8080
+//
+// Devices are polled all the time and listed under /devices by serial
+// number. POST requests change the device and need the Idempotency-Key
+// header: a request retried with the same key gets the first response
+// and is not run again. Payouts and floats are journaled with their key,
+// a retry after a restart gets the journaled outcome. The journal is
+// reconciled and interrupted payouts are recovered when a device connects.
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/charoit/itlssp"
+	"github.com/charoit/itlssp/internal/bus"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	ports := flag.String("port", "", "comma separated serial ports, all available ports if empty")
+	addrs := flag.String("addr", "0,16", "comma separated SSP addresses to probe")
+	baud := flag.Int("baud", 9600, "baud rate")
+	interval := flag.Duration("interval", 200*time.Millisecond, "poll interval")
+	key := flag.String("key", "", "eSSP fixed key in hex, plain SSP if empty")
+	protocol := flag.Uint("protocol", 7, "host protocol version")
+	listen := flag.String("listen", ":8080", "HTTP listen address")
+	keep := flag.Duration("keep", 24*time.Hour, "how long responses are kept for idempotency keys")
+	journal := flag.String("journal", "sspd.journal", "journal of credits, payouts and their idempotency keys, none if empty")
+	flag.Parse()
+
+	cfg := &itlssp.DiscoverConfig{Bauds: []int{*baud}}
+	if *ports != "" {
+		cfg.Ports = strings.Split(*ports, ",")
+	}
+	for _, s := range strings.Split(*addrs, ",") {
+		a, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+		if err != nil {
+			log.Fatal().Msgf("Invalid address %q", s)
+		}
+		cfg.Addresses = append(cfg.Addresses, byte(a))
+	}
+	var fixed uint64
+	if *key != "" {
+		var err error
+		if fixed, err = strconv.ParseUint(*key, 16, 64); err != nil {
+			log.Fatal().Msgf("Invalid key %q", *key)
+		}
+	}
+
+	var j *itlssp.Journal
+	if *journal != "" {
+		var err error
+		if j, err = itlssp.OpenJournal(*journal); err != nil {
+			log.Fatal().Err(err).Msg("Journal failed")
+		}
+		defer j.Close()
+	}
+
+	log.Info().Msg("Discovering devices")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	results := itlssp.Discover(ctx, cfg)
+	cancel()
+	srv := &server{keys: newIdempotency(*keep, j)}
+	for _, res := range results {
+		if len(res.Devices) == 0 {
+			log.Warn().Err(res.Err).Str("port", res.Port).Msg("No device")
+			continue
+		}
+		b, err := bus.Open(res.Port, *baud)
+		if err != nil {
+			log.Error().Err(err).Str("port", res.Port).Msg("Open failed")
+			continue
+		}
+		defer b.Close()
+		for _, found := range res.Devices {
+			d := newDevice(found, itlssp.NewPayout(nil), b)
+			d.poller.Config = itlssp.PortConfig(b.Register(found.Port.Addr), *baud)
+			d.poller.Protocol, d.poller.Key = byte(*protocol), fixed
+			d.journal = j
+			srv.devices = append(srv.devices, d)
+			log.Info().Str("id", d.id).Str("port", res.Port).Uint8("addr", found.Port.Addr).
+				Str("type", found.Unit.Type.String()).Msg("Device")
+		}
+	}
+	if len(srv.devices) == 0 {
+		log.Fatal().Err(itlssp.ErrNoDeviceFound).Msg("Discovery failed")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, d := range srv.devices {
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			d.poller.Run(ctx, *interval)
+		}(d)
+	}
+
+	hs := &http.Server{Addr: *listen, Handler: srv}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		shutdown, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		hs.Shutdown(shutdown)
+	}()
+	log.Info().Str("listen", *listen).Msg("Serving")
+	if err := hs.ListenAndServe(); err != http.ErrServerClosed {
+		log.Error().Err(err).Msg("Serve failed")
+	}
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/charoit/itlssp"
+	"github.com/charoit/itlssp/internal/bus"
+)
+
+const maxBody = 1 << 16
+
+// server is the REST API of the devices:
+//
+//	GET  /devices                   device list
+//	GET  /devices/{id}              identity and channels
+//	GET  /devices/{id}/state        polled state and recent events
+//	GET  /devices/{id}/levels       payout levels
+//	GET  /devices/{id}/counters     note counters
+//	GET  /devices/{id}/routes       route of every channel
+//	POST /devices/{id}/enable
+//	POST /devices/{id}/disable
+//	POST /devices/{id}/inhibits     {"Mask":5}
+//	POST /devices/{id}/routes       {"Value":500,"Currency":"EUR","Route":"Cashbox"}
+//	POST /devices/{id}/payout       {"Amount":1500,"Currency":"EUR","Test":false}
+//	POST /devices/{id}/float        {"Amount":5000,"Currency":"EUR","MinPayout":500}
+//	POST /devices/{id}/empty        {"Smart":true}
+//
+// POST requests need the Idempotency-Key header.
+type server struct {
+	devices []*device
+	keys    *idempotency
+}
+
+// apiError is the error response
+type apiError struct {
+	Error string
+}
+
+// PayoutRequest is the body of payout and float
+type PayoutRequest struct {
+	Amount    uint32
+	Currency  string
+	MinPayout uint16
+	Test      bool
+}
+
+// RouteRequest is the body of the route change
+type RouteRequest struct {
+	Value    uint32
+	Currency string
+	Route    string
+}
+
+func (this *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "devices" || len(parts) > 3 {
+		reply(w, http.StatusNotFound, apiError{"not found"})
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			reply(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+			return
+		}
+		list := make([]*Summary, 0, len(this.devices))
+		for _, d := range this.devices {
+			list = append(list, d.Summary())
+		}
+		reply(w, http.StatusOK, list)
+		return
+	}
+	d := this.device(parts[1])
+	if d == nil {
+		reply(w, http.StatusNotFound, apiError{fmt.Sprintf("no device %s", parts[1])})
+		return
+	}
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		this.get(w, d, action)
+	case http.MethodPost:
+		this.post(w, r, d, action)
+	default:
+		reply(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+	}
+}
+
+func (this *server) device(id string) *device {
+	for _, d := range this.devices {
+		if d.id == id {
+			return d
+		}
+	}
+	return nil
+}
+
+func (this *server) get(w http.ResponseWriter, d *device, action string) {
+	var v interface{}
+	var err error
+	switch action {
+	case "":
+		v, err = d.Info()
+	case "state":
+		v = d.State()
+	case "levels":
+		v, err = d.Levels()
+	case "counters":
+		v, err = d.Counters()
+	case "routes":
+		v, err = d.Routes()
+	default:
+		reply(w, http.StatusNotFound, apiError{"not found"})
+		return
+	}
+	if err != nil {
+		reply(w, errorStatus(err), apiError{err.Error()})
+		return
+	}
+	reply(w, http.StatusOK, v)
+}
+
+// post runs the action once for the idempotency key
+func (this *server) post(w http.ResponseWriter, r *http.Request, d *device, action string) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		reply(w, http.StatusBadRequest, apiError{"Idempotency-Key header is required"})
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+	if err != nil {
+		reply(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+
+	request := r.Method + " " + r.URL.Path + " " + string(body)
+	status, data, replayed, err := this.keys.do(key, request, func() (int, []byte) {
+		status, v := this.mutate(d, action, body, keyed{key, request})
+		data, _ := json.Marshal(v)
+		return status, data
+	})
+	switch err {
+	case errKeyReused:
+		reply(w, http.StatusUnprocessableEntity, apiError{err.Error()})
+		return
+	case errKeyInProcess:
+		reply(w, http.StatusConflict, apiError{err.Error()})
+		return
+	}
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// mutate runs the action on the device, returns the status and the response
+func (this *server) mutate(d *device, action string, body []byte, k keyed) (int, interface{}) {
+	var err error
+	var res interface{}
+	switch action {
+	case "enable":
+		err = d.Enable()
+	case "disable":
+		err = d.Disable()
+	case "inhibits":
+		var req struct{ Mask *uint16 }
+		if err = decode(body, &req); err == nil && req.Mask == nil {
+			err = badRequest("Mask is required")
+		}
+		if err == nil {
+			err = d.SetInhibits(*req.Mask)
+		}
+	case "routes":
+		var req RouteRequest
+		if err = decode(body, &req); err == nil {
+			var route itlssp.Route
+			if route, err = parseRoute(req.Route); err == nil {
+				err = d.SetRoute(route, req.Value, this.currency(d, req.Currency))
+			}
+		}
+	case "payout", "float":
+		var req PayoutRequest
+		if err = decode(body, &req); err == nil && req.Amount == 0 {
+			err = badRequest("Amount is required")
+		}
+		if err != nil {
+			break
+		}
+		opt := itlssp.PayoutReal
+		if req.Test {
+			opt = itlssp.PayoutTest
+		}
+		var result *itlssp.PayoutResult
+		if action == "payout" {
+			result, err = d.Payout(req.Amount, this.currency(d, req.Currency), opt, k)
+		} else {
+			result, err = d.Float(req.MinPayout, req.Amount, this.currency(d, req.Currency), opt, k)
+		}
+		res = result
+	case "empty":
+		var req struct{ Smart bool }
+		if err = decode(body, &req); err == nil {
+			err = d.Empty(req.Smart)
+		}
+	default:
+		return http.StatusNotFound, apiError{"not found"}
+	}
+	if err != nil {
+		return errorStatus(err), apiError{err.Error()}
+	}
+	if res == nil {
+		res = d.State()
+	}
+	return http.StatusOK, res
+}
+
+// currency defaults to the currency of the device
+func (this *server) currency(d *device, currency string) string {
+	if currency == "" {
+		return d.found.Unit.Currency
+	}
+	return currency
+}
+
+func parseRoute(s string) (itlssp.Route, error) {
+	for _, r := range []itlssp.Route{itlssp.RoutePayout, itlssp.RouteCashbox} {
+		if strings.EqualFold(s, r.String()) {
+			return r, nil
+		}
+	}
+	return 0, badRequest(fmt.Sprintf("invalid route %q", s))
+}
+
+// badRequest is an invalid request body
+type badRequest string
+
+func (e badRequest) Error() string {
+	return string(e)
+}
+
+// decode reads the JSON body, an empty body is an empty object
+func decode(body []byte, v interface{}) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return badRequest(err.Error())
+	}
+	return nil
+}
+
+func errorStatus(err error) int {
+	var bad badRequest
+	switch {
+	case errors.As(err, &bad):
+		return http.StatusBadRequest
+	case err == errNoPayout:
+		return http.StatusNotFound
+	case err == bus.ErrOffline:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
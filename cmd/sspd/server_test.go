@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charoit/itlssp"
+	"github.com/charoit/itlssp/simulator"
+)
+
+// testServer serves a simulated SMART Payout with the serial number 42,
+// journaled in j unless nil
+func testServer(t *testing.T, j *itlssp.Journal) (*httptest.Server, *simulator.Simulator) {
+	sim := simulator.New(itlssp.SMARTPayout, "EUR", 500, 1000, 2000)
+	sim.Serial = 42
+	sim.SetLevel(1, 4, true)
+	sim.SetLevel(2, 2, true)
+	sim.Listen("sim-sspd")
+	t.Cleanup(func() { itlssp.UnregisterPort("sim-sspd") })
+
+	found := &itlssp.SSPDevice{
+		Port:   &itlssp.SSPConnection{Name: "sim-sspd"},
+		Unit:   &itlssp.Unit{Type: itlssp.SMARTPayout, Currency: "EUR", Channels: 3},
+		Serial: 42,
+	}
+	d := newDevice(found, itlssp.NewPayout(nil), &sync.Mutex{})
+	d.poller.Config = itlssp.PortConfig("sim-sspd", 9600)
+	d.poller.Protocol, d.poller.Key = 7, itlssp.DefaultFixedKey
+	d.journal = j
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.poller.Run(ctx, 20*time.Millisecond)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	for !d.Summary().Connected {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ts := httptest.NewServer(&server{devices: []*device{d}, keys: newIdempotency(time.Hour, j)})
+	t.Cleanup(ts.Close)
+	return ts, sim
+}
+
+func request(t *testing.T, ts *httptest.Server, method, path, key, body string) (int, string, *http.Response) {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(data), res
+}
+
+func TestServer(t *testing.T) {
+	ts, _ := testServer(t, nil)
+	var table = []struct {
+		method string
+		path   string
+		key    string
+		body   string
+		status int
+		reply  string
+	}{
+		{"GET", "/devices", "", "", 200, `"ID":"42"`},
+		{"GET", "/devices/42", "", "", 200, `"SerialNumber"`},
+		{"GET", "/devices/7", "", "", 404, `no device 7`},
+		{"GET", "/devices/42/levels", "", "", 200, `"Count":4`},
+		{"GET", "/devices/42/counters", "", "", 200, `"Stacked"`},
+		{"GET", "/devices/42/routes", "", "", 200, `"Route":"Payout"`},
+		{"GET", "/devices/42/nothing", "", "", 404, `not found`},
+		{"DELETE", "/devices/42", "", "", 405, `not allowed`},
+		{"POST", "/devices/42/enable", "", "", 400, `Idempotency-Key`},
+		{"POST", "/devices/42/enable", "k1", "", 200, `"Connected":true`},
+		{"POST", "/devices/42/inhibits", "k2", `{"Mask":5}`, 200, `"Inhibits":5`},
+		{"POST", "/devices/42/inhibits", "k3", `{}`, 400, `Mask is required`},
+		{"POST", "/devices/42/routes", "k4", `{"Value":2000,"Route":"cashbox"}`, 200, `"State"`},
+		{"GET", "/devices/42/routes", "", "", 200, `{"Value":2000,"Currency":"EUR","Route":"Cashbox"}`},
+		{"POST", "/devices/42/routes", "k5", `{"Value":2000,"Route":"bin"}`, 400, `invalid route`},
+		{"POST", "/devices/42/payout", "k6", `{"Amount":1500,"Test":true}`, 200, `"Ok":true`},
+		{"POST", "/devices/42/payout", "k7", `{"Amount":1500`, 400, `unexpected end`},
+		{"POST", "/devices/42/payout", "k10", `{"Amount":1500,"Currency":"EURO"}`, 400, `invalid currency`},
+		{"POST", "/devices/42/float", "k8", `{"Amount":3000,"MinPayout":500}`, 200, `"Ok":true`},
+		{"POST", "/devices/42/disable", "k9", "", 200, `"State"`},
+	}
+
+	for i, v := range table {
+		status, reply, _ := request(t, ts, v.method, v.path, v.key, v.body)
+		if status != v.status || !strings.Contains(reply, v.reply) {
+			t.Errorf("%d: %s %s failed, expected %d %s, got %d %s", i, v.method, v.path, v.status, v.reply, status, reply)
+		}
+	}
+}
+
+// payouts counts the payout commands the simulator received
+func payouts(sim *simulator.Simulator) int {
+	n := 0
+	for _, c := range sim.Commands() {
+		if len(c.Data) > 0 && itlssp.SspCommand(c.Data[0]) == itlssp.SspCmdPayoutAmount {
+			n++
+		}
+	}
+	return n
+}
+
+func TestServerIdempotency(t *testing.T) {
+	ts, sim := testServer(t, nil)
+	payouts := func() int { return payouts(sim) }
+
+	if status, reply, _ := request(t, ts, "POST", "/devices/42/enable", "enable-1", ""); status != 200 {
+		t.Fatalf("enable failed, expected 200, got %d %s", status, reply)
+	}
+	status, first, _ := request(t, ts, "POST", "/devices/42/payout", "pay-1", `{"Amount":1000}`)
+	if status != 200 || payouts() != 1 {
+		t.Fatalf("payout failed, expected 200 and 1 payout command, got %d %s, %d commands", status, first, payouts())
+	}
+	status, again, res := request(t, ts, "POST", "/devices/42/payout", "pay-1", `{"Amount":1000}`)
+	if status != 200 || again != first || res.Header.Get("Idempotent-Replayed") != "true" || payouts() != 1 {
+		t.Fatalf("retry failed, expected the replayed %s and 1 payout command, got %d %s, %d commands", first, status, again, payouts())
+	}
+	if status, reply, _ := request(t, ts, "POST", "/devices/42/payout", "pay-1", `{"Amount":2000}`); status != 422 {
+		t.Fatalf("other request failed, expected 422, got %d %s", status, reply)
+	}
+
+	// the payout ends in the poll loop
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, reply, _ := request(t, ts, "GET", "/devices/42/state", "", "")
+		var s State
+		json.Unmarshal([]byte(reply), &s)
+		if len(s.Events) > 0 && s.Events[len(s.Events)-1].Event == itlssp.SspEventDispensed.String() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state failed, expected the dispensed event, got %s", reply)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestServerRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sspd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	j, err := itlssp.OpenJournal(filepath.Join(dir, "sspd.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	// a payout of the previous run that never ended
+	lost := &itlssp.JournalEntry{Serial: 42, Kind: itlssp.EntryPayout, Status: itlssp.EntryPending, Requested: 500,
+		Currency: "EUR", Key: "lost", Note: "POST /devices/42/payout {\"Amount\":500}"}
+	if err = j.Append(lost); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, sim := testServer(t, j)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(j.Pending(42)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("recovery failed, expected no pending payouts, got %v", j.Pending(42))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if status, reply, _ := request(t, ts, "POST", "/devices/42/enable", "enable-1", ""); status != 200 {
+		t.Fatalf("enable failed, expected 200, got %d %s", status, reply)
+	}
+	if status, reply, _ := request(t, ts, "POST", "/devices/42/payout", "pay-1", `{"Amount":1000}`); status != 200 {
+		t.Fatalf("payout failed, expected 200, got %d %s", status, reply)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for len(j.Keyed("pay-1")) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("payout failed, expected the settlement, got %v", j.Keyed("pay-1"))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// the restarted daemon has only the journal
+	restarted := httptest.NewServer(&server{devices: ts.Config.Handler.(*server).devices, keys: newIdempotency(time.Hour, j)})
+	defer restarted.Close()
+	var table = []struct {
+		key    string
+		body   string
+		status int
+		reply  string
+	}{
+		{"pay-1", `{"Amount":1000}`, 200, `"Status":"Done"`},
+		{"pay-1", `{"Amount":2000}`, 422, `another request`},
+		{"lost", `{"Amount":500}`, 200, `"Status":"Unresolved"`},
+	}
+
+	for i, v := range table {
+		status, reply, res := request(t, restarted, "POST", "/devices/42/payout", v.key, v.body)
+		if status != v.status || !strings.Contains(reply, v.reply) || (status == 200 && res.Header.Get("Idempotent-Replayed") != "true") {
+			t.Errorf("%d: retry failed, expected %d %s, got %d %s", i, v.status, v.reply, status, reply)
+		}
+	}
+	if n := payouts(sim); n != 1 {
+		t.Errorf("retry failed, expected %d payout commands, got %d", 1, n)
+	}
+}
+
+func TestDeclined(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sspd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	j, err := itlssp.OpenJournal(filepath.Join(dir, "sspd.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	d := &device{found: &itlssp.SSPDevice{Serial: 42}, journal: j}
+
+	var table = []struct {
+		res     *itlssp.PayoutResult
+		err     error
+		pending bool
+	}{
+		{&itlssp.PayoutResult{Ok: true}, nil, true},
+		{&itlssp.PayoutResult{Status: itlssp.PayoutNotEnoughValue}, nil, false},
+		{nil, &itlssp.ResponseError{Code: itlssp.SspResponseParamOutOfRange}, false},
+		{nil, &itlssp.ResponseError{Code: itlssp.SspResponseFail}, false},
+		{nil, itlssp.ErrReplyLost, true},
+		{nil, errors.New("read timeout"), true},
+	}
+
+	for i, v := range table {
+		pending, err := d.begin(itlssp.EntryPayout, 1000, "EUR", itlssp.PayoutReal, keyed{fmt.Sprint(i), "request"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = d.declined(pending, v.res, v.err); err != v.err {
+			t.Errorf("%d: declined failed, expected %v, got %v", i, v.err, err)
+		}
+		entries := j.Keyed(fmt.Sprint(i))
+		if open := len(entries) == 1; open != v.pending {
+			t.Errorf("%d: declined failed, expected pending %t, got %v", i, v.pending, entries)
+		}
+		if !v.pending && (entries[1].Ref != entries[0].ID || entries[1].Amount != 0) {
+			t.Errorf("%d: declined failed, expected nothing paid, got %s", i, &entries[1])
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Command sspdash is a full-screen terminal dashboard of every discovered
+// device: identity, enable state, channel inhibits, payout levels, recent
+// events and error counts. It needs nothing but a terminal, so it works
+// over SSH.
+//
+//	sspdash -port /dev/ttyUSB0,/dev/ttyUSB1 -interval 300ms
+//
+// Up and Down select the device, e enables it, d disables it, x empties
+// the payout to the cashbox, 1-9 toggle channel inhibits and q quits.
+// Devices sharing a port are polled in turn over one connection.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charoit/itlssp"
+	"github.com/charoit/itlssp/internal/bus"
+	"github.com/charoit/itlssp/internal/term"
+	"github.com/rs/zerolog"
+)
+
+func main() {
+	ports := flag.String("port", "", "comma separated serial ports, all available ports if empty")
+	addrs := flag.String("addr", "0,16", "comma separated SSP addresses to probe")
+	baud := flag.Int("baud", 9600, "baud rate")
+	interval := flag.Duration("interval", 500*time.Millisecond, "poll interval")
+	key := flag.String("key", "", "eSSP fixed key in hex, plain SSP if empty")
+	protocol := flag.Uint("protocol", 7, "host protocol version")
+	flag.Parse()
+
+	cfg := &itlssp.DiscoverConfig{Bauds: []int{*baud}}
+	if *ports != "" {
+		cfg.Ports = strings.Split(*ports, ",")
+	}
+	for _, s := range strings.Split(*addrs, ",") {
+		a, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+		if err != nil {
+			fatal(fmt.Errorf("invalid address %q", s))
+		}
+		cfg.Addresses = append(cfg.Addresses, byte(a))
+	}
+	var fixed uint64
+	if *key != "" {
+		var err error
+		if fixed, err = strconv.ParseUint(*key, 16, 64); err != nil {
+			fatal(fmt.Errorf("invalid key %q", *key))
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Discovering devices...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	results := itlssp.Discover(ctx, cfg)
+	cancel()
+	var mons []*monitor
+	for _, res := range results {
+		if len(res.Devices) == 0 {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", res.Port, res.Err)
+			continue
+		}
+		b, err := bus.Open(res.Port, *baud)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", res.Port, err)
+			continue
+		}
+		defer b.Close()
+		for _, d := range res.Devices {
+			m := newMonitor(d, itlssp.NewPayout(nil), b)
+			m.poller.Config = itlssp.PortConfig(b.Register(d.Port.Addr), *baud)
+			m.poller.Protocol, m.poller.Key = byte(*protocol), fixed
+			mons = append(mons, m)
+		}
+	}
+	if len(mons) == 0 {
+		fatal(itlssp.ErrNoDeviceFound)
+	}
+
+	// the dashboard shows the errors, log lines on stderr would overwrite
+	// the screen on every poll
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		term.Restore(int(os.Stdin.Fd()), state)
+	}()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	for _, m := range mons {
+		go m.poller.Run(ctx, *interval)
+	}
+	run(os.Stdout, bufio.NewReader(os.Stdin), mons)
+}
+
+// run redraws the dashboard and handles keys until q or Ctrl-C
+func run(w io.Writer, in *bufio.Reader, mons []*monitor) {
+	keys := make(chan byte)
+	go readKeys(in, keys)
+
+	d := &dashboard{mons: mons}
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		cols, rows, err := term.Size(int(os.Stdin.Fd()))
+		if err != nil {
+			cols, rows = 80, 24
+		}
+		io.WriteString(w, d.render(cols, rows))
+		select {
+		case <-tick.C:
+		case k, ok := <-keys:
+			if !ok || k == 'q' || k == 0x03 {
+				return
+			}
+			d.key(k)
+		}
+	}
+}
+
+// readKeys sends the keys of the terminal until it is closed. Arrow keys
+// ESC [ A and ESC [ B arrive at once and are sent as A and B, a bare Esc
+// is sent as is.
+func readKeys(in *bufio.Reader, keys chan<- byte) {
+	defer close(keys)
+	for {
+		k, err := in.ReadByte()
+		if err != nil {
+			return
+		}
+		if b, _ := in.Peek(in.Buffered()); k == 0x1B && len(b) >= 2 && b[0] == '[' {
+			in.ReadByte()
+			k, _ = in.ReadByte()
+		}
+		keys <- k
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "sspdash:", err)
+	os.Exit(1)
+}
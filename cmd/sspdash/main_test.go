@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadKeys(t *testing.T) {
+	var table = []struct {
+		in   string
+		keys string
+	}{
+		{"q", "q"},
+		{"\x1b[Aq", "Aq"},
+		{"\x1b[B\x1b[A", "BA"},
+		{"\x1b", "\x1b"},
+		{"\x1bq", "\x1bq"},
+	}
+
+	for i, v := range table {
+		keys := make(chan byte, len(v.in))
+		readKeys(bufio.NewReader(strings.NewReader(v.in)), keys)
+		var got []byte
+		for k := range keys {
+			got = append(got, k)
+		}
+		if string(got) != v.keys {
+			t.Errorf("%d: readKeys failed, expected %q, got %q", i, v.keys, got)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/charoit/itlssp"
+	"github.com/charoit/itlssp/internal/bus"
+)
+
+const (
+	recentEvents = 6
+	levelsEvery  = 10 // polls between payout level reads
+)
+
+// station is the device API of the dashboard
+type station interface {
+	bus.Station
+	Enable() error
+	Disable() error
+	EmptyAll() error
+	GetAllLevels() ([]itlssp.Denomination, error)
+	SendCommand(data []byte) ([]byte, error)
+}
+
+// Errors are error counts of the device since the dashboard started
+type Errors struct {
+	Comm     int
+	Rejected int
+	Jams     int
+	Fraud    int
+	Payout   int
+}
+
+func (this *Errors) String() string {
+	return fmt.Sprintf("comm %d  rejected %d  jams %d  fraud %d  payout %d",
+		this.Comm, this.Rejected, this.Jams, this.Fraud, this.Payout)
+}
+
+// monitor polls one device and keeps what the dashboard shows
+type monitor struct {
+	found  *itlssp.SSPDevice
+	dev    station
+	poller *bus.Poller
+
+	mu       sync.Mutex
+	tracker  *itlssp.Tracker
+	info     *itlssp.Info
+	enabled  bool
+	state    string
+	inhibits uint16
+	known    bool // inhibits were set by the dashboard
+	levels   []itlssp.Denomination
+	events   []string
+	errors   Errors
+	polls    int
+	lastErr  error
+}
+
+func newMonitor(found *itlssp.SSPDevice, dev station, lock sync.Locker) *monitor {
+	this := &monitor{found: found, dev: dev, tracker: itlssp.NewTracker(), state: "Connecting"}
+	this.poller = bus.NewPoller(found, dev, lock, this)
+	return this
+}
+
+// payout reports whether the device stores notes or coins for payout
+func (this *monitor) payout() bool {
+	switch this.found.Unit.Type {
+	case itlssp.SMARTPayout, itlssp.SMARTHopper, itlssp.NV11:
+		return true
+	}
+	return false
+}
+
+// Connected keeps the identity read at connect
+func (this *monitor) Connected(info *itlssp.Info, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if err != nil {
+		this.errors.Comm++
+		this.lastErr = err
+		this.state = "Offline"
+		return
+	}
+	this.info, this.lastErr = info, nil
+	this.state = "Idle"
+}
+
+// Polled applies the events and, from time to time, reads payout levels
+func (this *monitor) Polled(events []itlssp.Event, err error) {
+	this.mu.Lock()
+	this.polls++
+	readLevels := err == nil && this.payout() && this.polls%levelsEvery == 1
+	this.mu.Unlock()
+	var levels []itlssp.Denomination
+	var levelsErr error
+	if readLevels {
+		levelsErr = this.poller.Do(func() (err error) {
+			levels, err = this.dev.GetAllLevels()
+			return err
+		})
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if err == nil || len(events) > 0 {
+		this.apply(events, time.Now())
+	}
+	if levels != nil {
+		this.levels = levels
+	}
+	if err == nil {
+		err = levelsErr
+	}
+	if err != nil {
+		this.errors.Comm++
+		this.lastErr = err
+		if !this.poller.Connected() {
+			this.state = "Offline"
+			this.tracker.Reset()
+		}
+		return
+	}
+	this.lastErr = nil
+}
+
+// apply updates the state, the recent events and the error counts,
+// the caller holds the lock
+func (this *monitor) apply(events []itlssp.Event, now time.Time) {
+	this.tracker.Update(events)
+	this.state = this.tracker.State().String()
+	this.enabled = true
+	for i := range events {
+		e := &events[i]
+		if e.Code == itlssp.SspEventDisabled {
+			this.enabled = false
+			continue // repeated by every poll while disabled
+		}
+		switch e.Code {
+		case itlssp.SspEventRejected:
+			this.errors.Rejected++
+		case itlssp.SspEventSafeJam, itlssp.SspEventUnsafeJam, itlssp.SspEventJammed, itlssp.SspEventCoinMechJammed:
+			this.errors.Jams++
+		case itlssp.SspEventFraudAttempt:
+			this.errors.Fraud++
+		case itlssp.SspEventIncompletePayout, itlssp.SspEventIncompleteFloat, itlssp.SspEventErrorDuringPayout,
+			itlssp.SspEventTimeout:
+			this.errors.Payout++
+		}
+		this.events = append(this.events, now.Format("15:04:05 ")+eventText(e))
+	}
+	if n := len(this.events); n > recentEvents {
+		this.events = this.events[n-recentEvents:]
+	}
+}
+
+// eventText is the event line of the dashboard
+func eventText(e *itlssp.Event) string {
+	s := e.Code.String()
+	if e.Channel > 0 {
+		s += fmt.Sprintf(" channel %d", e.Channel)
+	}
+	for _, a := range e.Amounts {
+		s += " " + money(a.Value, a.Currency)
+	}
+	return s
+}
+
+// Enable enables the device
+func (this *monitor) Enable() error {
+	return this.do(this.dev.Enable)
+}
+
+// Disable disables the device
+func (this *monitor) Disable() error {
+	return this.do(this.dev.Disable)
+}
+
+// Empty moves stored notes of the payout to the cashbox
+func (this *monitor) Empty() error {
+	if !this.payout() {
+		return fmt.Errorf("%s has no payout", this.found.Unit.Type)
+	}
+	return this.do(this.dev.EmptyAll)
+}
+
+// Toggle enables or inhibits the channel, channels start enabled
+// as the dashboard cannot read inhibits back
+func (this *monitor) Toggle(channel int) error {
+	this.mu.Lock()
+	n := int(this.found.Unit.Channels)
+	if channel < 1 || channel > n {
+		this.mu.Unlock()
+		return fmt.Errorf("no channel %d", channel)
+	}
+	mask := this.inhibits
+	if !this.known {
+		mask = uint16(1<<uint(n) - 1)
+	}
+	mask ^= 1 << uint(channel-1)
+	this.mu.Unlock()
+
+	err := this.do(func() error {
+		_, err := this.dev.SendCommand([]byte{byte(itlssp.SspCmdSetInhibits), byte(mask), byte(mask >> 8)})
+		return err
+	})
+	if err == nil {
+		this.mu.Lock()
+		this.inhibits, this.known = mask, true
+		this.mu.Unlock()
+	}
+	return err
+}
+
+// do runs the action on the connected device
+func (this *monitor) do(action func() error) error {
+	return this.poller.Do(action)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charoit/itlssp"
+	"github.com/charoit/itlssp/simulator"
+)
+
+func TestApply(t *testing.T) {
+	var table = []struct {
+		events  []itlssp.Event
+		state   string
+		enabled bool
+		recent  int
+		errors  Errors
+	}{
+		{nil, "Idle", true, 0, Errors{}},
+		{[]itlssp.Event{{Code: itlssp.SspEventDisabled}}, "Disabled", false, 0, Errors{}},
+		{[]itlssp.Event{{Code: itlssp.SspEventRead, Channel: 2}}, "Escrow", true, 1, Errors{}},
+		{[]itlssp.Event{{Code: itlssp.SspEventCredit, Channel: 2}, {Code: itlssp.SspEventStacking}}, "Stacking", true, 2, Errors{}},
+		{[]itlssp.Event{{Code: itlssp.SspEventRejected}, {Code: itlssp.SspEventDisabled}}, "Disabled", false, 1,
+			Errors{Rejected: 1}},
+		{[]itlssp.Event{{Code: itlssp.SspEventUnsafeJam}, {Code: itlssp.SspEventFraudAttempt}}, "Fraud", true, 2,
+			Errors{Jams: 1, Fraud: 1}},
+		{[]itlssp.Event{{Code: itlssp.SspEventIncompletePayout}}, "Idle", true, 1, Errors{Payout: 1}},
+	}
+
+	for i, v := range table {
+		m := newMonitor(nil, nil, nil)
+		m.apply(v.events, time.Now())
+		if m.state != v.state || m.enabled != v.enabled || len(m.events) != v.recent || m.errors != v.errors {
+			t.Errorf("%d: apply failed, expected %s enabled %v events %d errors %s, got %s enabled %v events %d errors %s",
+				i, v.state, v.enabled, v.recent, &v.errors, m.state, m.enabled, len(m.events), &m.errors)
+		}
+	}
+}
+
+func TestApplyRecent(t *testing.T) {
+	m := newMonitor(nil, nil, nil)
+	for i := 0; i < 2*recentEvents; i++ {
+		m.apply([]itlssp.Event{{Code: itlssp.SspEventCredit, Channel: byte(i)}}, time.Now())
+	}
+	if len(m.events) != recentEvents {
+		t.Fatalf("apply failed, expected %d recent events, got %d", recentEvents, len(m.events))
+	}
+}
+
+func TestPolledLevelsError(t *testing.T) {
+	// the poller is not connected, so reading the levels fails
+	m := newMonitor(&itlssp.SSPDevice{Unit: &itlssp.Unit{Type: itlssp.SMARTPayout}}, nil, &sync.Mutex{})
+	m.Polled([]itlssp.Event{{Code: itlssp.SspEventCredit, Channel: 2}}, nil)
+	if len(m.events) != 1 || m.errors.Comm != 1 || m.lastErr == nil {
+		t.Errorf("Polled failed, expected 1 event and 1 comm error, got %d events and %d comm errors",
+			len(m.events), m.errors.Comm)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	sim := simulator.New(itlssp.SMARTPayout, "EUR", 500, 1000, 2000)
+	sim.SetLevel(2, 3, true)
+	sim.Listen("sim-dash")
+	defer itlssp.UnregisterPort("sim-dash")
+
+	found := &itlssp.SSPDevice{
+		Port: &itlssp.SSPConnection{Name: "sim-dash"},
+		Unit: &itlssp.Unit{Type: itlssp.SMARTPayout, Currency: "EUR", Channels: 3},
+	}
+	m := newMonitor(found, itlssp.NewPayout(nil), &sync.Mutex{})
+	m.poller.Config = itlssp.PortConfig("sim-dash", 9600)
+	m.poller.Protocol, m.poller.Key = 7, itlssp.DefaultFixedKey
+	m.poller.Connect()
+	if !m.poller.Connected() || m.info == nil || len(m.info.Setup.Channels) != 3 {
+		t.Fatalf("Connect failed, expected 3 channels, got %v", m.lastErr)
+	}
+
+	m.poller.Poll()
+	if m.enabled || m.state != "Disabled" || len(m.levels) != 3 || m.levels[1].Count != 3 {
+		t.Fatalf("Poll failed, expected Disabled with 3 notes of channel 2, got %s enabled %v levels %v", m.state, m.enabled, m.levels)
+	}
+
+	if err := m.Toggle(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Toggle(4); err == nil {
+		t.Fatal("Toggle failed, expected error of channel 4 of 3, got nil")
+	}
+	if err := m.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	sim.InsertNote(1)
+	for i := 0; i < 5; i++ {
+		m.poller.Poll()
+	}
+	if !m.enabled || m.inhibits != 0x0005 || len(m.events) == 0 {
+		t.Fatalf("Poll failed, expected enabled with inhibits 0005 and events, got enabled %v inhibits %04X events %v", m.enabled, m.inhibits, m.events)
+	}
+	if err := m.Empty(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const keysHelp = "Up/Down select  e enable  d disable  x empty  1-9 inhibit  q quit"
+
+// dashboard is the screen of all devices, one is selected for the keys
+type dashboard struct {
+	mons []*monitor
+	sel  int
+
+	mu     sync.Mutex
+	status string
+}
+
+// key runs the action of the key on the selected device, actions run in
+// the background and report to the status line
+func (this *dashboard) key(k byte) {
+	m := this.mons[this.sel]
+	var name string
+	var action func() error
+	switch {
+	case k == 'A' || k == 'k':
+		this.sel = (this.sel + len(this.mons) - 1) % len(this.mons)
+		return
+	case k == 'B' || k == 'j' || k == '\t':
+		this.sel = (this.sel + 1) % len(this.mons)
+		return
+	case k == 'e':
+		name, action = "Enable", m.Enable
+	case k == 'd':
+		name, action = "Disable", m.Disable
+	case k == 'x':
+		name, action = "Empty", m.Empty
+	case k >= '1' && k <= '9':
+		ch := int(k - '0')
+		name, action = fmt.Sprintf("Toggle channel %d", ch), func() error { return m.Toggle(ch) }
+	default:
+		return
+	}
+	this.setStatus(fmt.Sprintf("%s %s...", name, m.title()))
+	go func() {
+		if err := action(); err != nil {
+			this.setStatus(fmt.Sprintf("%s %s: %v", name, m.title(), err))
+			return
+		}
+		this.setStatus(fmt.Sprintf("%s %s: done", name, m.title()))
+	}()
+}
+
+func (this *dashboard) setStatus(s string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.status = s
+}
+
+// render returns the escape sequences drawing the screen of the size,
+// devices below the screen scroll up to keep the selected one visible
+func (this *dashboard) render(cols, rows int) string {
+	this.mu.Lock()
+	status := this.status
+	this.mu.Unlock()
+
+	head := []string{fmt.Sprintf("sspdash  %d devices  %s", len(this.mons), keysHelp), ""}
+	var body []string
+	start := 0
+	for i, m := range this.mons {
+		if i == this.sel {
+			start = len(body)
+		}
+		body = append(body, m.lines(i == this.sel)...)
+		body = append(body, "")
+	}
+	room := rows - len(head) - 1
+	if start+blockSize(this.mons[this.sel]) <= room {
+		start = 0
+	}
+	if start < len(body) {
+		body = body[start:]
+	}
+	if len(body) > room {
+		body = body[:room]
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for _, l := range append(head, body...) {
+		b.WriteString(clip(l, cols))
+		b.WriteString("\x1b[K\r\n")
+	}
+	b.WriteString("\x1b[J")
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[7m%s\x1b[K\x1b[0m", rows, clip(status, cols))
+	return b.String()
+}
+
+// blockSize is the number of screen lines of the device
+func blockSize(m *monitor) int {
+	return len(m.lines(false)) + 1
+}
+
+// lines returns the block of the device, the selected one is marked
+func (this *monitor) lines(selected bool) []string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	mark := " "
+	if selected {
+		mark = ">"
+	}
+	res := []string{fmt.Sprintf("%s %s", mark, this.title())}
+	if this.info != nil {
+		res = append(res, fmt.Sprintf("  serial %d  firmware %s  dataset %s  protocol %d",
+			this.info.SerialNumber, this.info.Firmware, this.info.Dataset, this.info.Protocol))
+	}
+	enabled := "disabled"
+	if this.enabled {
+		enabled = "enabled"
+	}
+	res = append(res, fmt.Sprintf("  state    %s, %s", this.state, enabled))
+	if this.lastErr != nil {
+		res = append(res, fmt.Sprintf("  error    %v", this.lastErr))
+	}
+	if this.info != nil && this.info.Setup != nil {
+		var chans []string
+		for i, ch := range this.info.Setup.Channels {
+			on := "?"
+			if this.known {
+				on = "-"
+				if this.inhibits&(1<<uint(i)) != 0 {
+					on = "+"
+				}
+			}
+			chans = append(chans, fmt.Sprintf("%d:%s%s", ch.Channel, money(uint32(ch.Value), string(ch.Currency)), on))
+		}
+		res = append(res, "  channels "+strings.Join(chans, "  "))
+	}
+	if this.payout() {
+		var levels []string
+		for _, d := range this.levels {
+			levels = append(levels, fmt.Sprintf("%s x%d", money(d.Value, d.Currency), d.Count))
+		}
+		res = append(res, "  levels   "+strings.Join(levels, "  "))
+	}
+	res = append(res, "  errors   "+this.errors.String())
+	for i, e := range this.events {
+		label := "  events   "
+		if i > 0 {
+			label = "           "
+		}
+		res = append(res, label+e)
+	}
+	if selected {
+		res[0] = "\x1b[1m" + res[0] + "\x1b[0m"
+	}
+	return res
+}
+
+// title names the device by type, port and address
+func (this *monitor) title() string {
+	return fmt.Sprintf("%s  %s addr %d", this.found.Unit.Type, this.found.Port.Name, this.found.Port.Addr)
+}
+
+// money formats the value in minor units
+func money(value uint32, currency string) string {
+	return fmt.Sprintf("%d.%02d %s", value/100, value%100, currency)
+}
+
+// clip cuts the line to the screen width, escape sequences take no room
+func clip(s string, cols int) string {
+	var b strings.Builder
+	n, esc := 0, false
+	for _, r := range s {
+		switch {
+		case r == 0x1B:
+			esc = true
+		case esc:
+			esc = !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z')
+		case n >= cols:
+			continue
+		default:
+			n++
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charoit/itlssp"
+)
+
+func TestClip(t *testing.T) {
+	var table = []struct {
+		in   string
+		cols int
+		out  string
+	}{
+		{"abcdef", 3, "abc"},
+		{"abc", 10, "abc"},
+		{"\x1b[1mabcdef\x1b[0m", 4, "\x1b[1mabcd\x1b[0m"},
+		{"", 5, ""},
+	}
+
+	for i, v := range table {
+		if out := clip(v.in, v.cols); out != v.out {
+			t.Errorf("%d: clip failed, expected %q, got %q", i, v.out, out)
+		}
+	}
+}
+
+func TestMoney(t *testing.T) {
+	if s := money(1050, "EUR"); s != "10.50 EUR" {
+		t.Fatalf("money failed, expected %q, got %q", "10.50 EUR", s)
+	}
+}
+
+func TestLines(t *testing.T) {
+	m := newMonitor(&itlssp.SSPDevice{
+		Port: &itlssp.SSPConnection{Name: "/dev/ttyUSB0", Addr: 16},
+		Unit: &itlssp.Unit{Type: itlssp.SMARTPayout, Channels: 2},
+	}, nil, nil)
+	m.info = &itlssp.Info{SerialNumber: 42, Firmware: "0430", Protocol: 7, Setup: &itlssp.SetupData{
+		Channels: []itlssp.Channel{{Channel: 1, Value: 500, Currency: []byte("EUR")}, {Channel: 2, Value: 1000, Currency: []byte("EUR")}},
+	}}
+	m.levels = []itlssp.Denomination{{Count: 3, Value: 1000, Currency: "EUR"}}
+	m.inhibits, m.known = 0x0002, true
+	m.apply([]itlssp.Event{{Code: itlssp.SspEventCredit, Channel: 2}}, time.Now())
+
+	text := strings.Join(m.lines(true), "\n")
+	for _, s := range []string{"> SMART Payout  /dev/ttyUSB0 addr 16", "serial 42", "state    Stacking, enabled",
+		"1:5.00 EUR-  2:10.00 EUR+", "10.00 EUR x3", "channel 2", "rejected 0"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("lines failed, expected %q, got\n%s", s, text)
+		}
+	}
+
+	d := &dashboard{mons: []*monitor{m, m, m}, sel: 2}
+	screen := d.render(80, 12)
+	if !strings.Contains(screen, "> SMART Payout") {
+		t.Fatalf("render failed, expected the selected device, got\n%s", screen)
+	}
+}
@@ -0,0 +1,202 @@
+// Command sspdump decodes raw SSP captures offline. It reads hex text
+// (logs, serial sniffers) or binary dumps (logic analysers), reassembles
+// and un-stuffs frames, checks CRC, decrypts eSSP with the given key and
+// prints every packet with command names and decoded poll events.
+//
+//	sspdump -key 67452301674523010000000000000000 capture.txt
+//	sspdump -format bin -trace capture.jsonl capture.bin
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/charoit/itlssp"
+)
+
+func main() {
+	format := flag.String("format", "auto", "capture format: hex, bin or auto")
+	key := flag.String("key", "", "eSSP key in hex: 8 bytes fixed and 8 bytes negotiated key, little endian")
+	trace := flag.String("trace", "", "also write the records as a trace, .bin for the binary format, JSON Lines otherwise")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: sspdump [flags] [capture], stdin without capture")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	in := os.Stdin
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	raw, err := ioutil.ReadAll(in)
+	if err != nil {
+		fatal(err)
+	}
+	data := raw
+	if *format == "hex" || (*format == "auto" && isText(raw)) {
+		if data, err = parseHex(string(raw)); err != nil {
+			fatal(err)
+		}
+	}
+
+	dec := itlssp.NewDecoder()
+	var enc *itlssp.Encryption
+	if *key != "" {
+		k, err := hex.DecodeString(*key)
+		if err != nil || len(k) != 16 {
+			fatal(fmt.Errorf("key must be 16 bytes in hex"))
+		}
+		dec.SetKey(k)
+		enc, _ = itlssp.NewEncryption(k)
+	}
+
+	var out itlssp.TraceWriter
+	if *trace != "" {
+		f, err := os.Create(*trace)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		if strings.HasSuffix(*trace, ".bin") {
+			out = itlssp.NewBinaryTraceWriter(f)
+		} else {
+			out = itlssp.NewJSONTraceWriter(f)
+		}
+	}
+
+	if err = dump(os.Stdout, bytes.NewReader(data), dec, enc, out); err != nil {
+		fatal(err)
+	}
+}
+
+// dump prints the frames of the capture
+func dump(w io.Writer, r io.Reader, dec *itlssp.Decoder, enc *itlssp.Encryption, out itlssp.TraceWriter) error {
+	var guess directionGuess
+	for i := 1; ; i++ {
+		frame, err := itlssp.ReadFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		dir := guess.next(frame)
+		rec, err := dec.Decode(dir, frame)
+		fmt.Fprintf(w, "#%-4d %s %02X/%d %s\n", i, rec.Direction, rec.Addr, rec.SeqBit(), rec.Name)
+		fmt.Fprintf(w, "      frame %X\n", rec.Frame)
+		if err != nil {
+			fmt.Fprintf(w, "      error %v\n", err)
+		}
+		if rec.Encrypted && enc != nil && err == nil {
+			_, count, _ := enc.Unseal(frame[3 : len(frame)-2])
+			fmt.Fprintf(w, "      eSSP  count %d, length %d\n", count, len(rec.Data))
+		}
+		if len(rec.Data) > 0 && (!rec.Encrypted || enc != nil) {
+			fmt.Fprintf(w, "      data  %X\n", rec.Data)
+		}
+		if dir == itlssp.DeviceToHost && strings.Contains(rec.Name, ": ") {
+			events, _ := itlssp.DecodeEvents(rec.Data[1:])
+			for k := range events {
+				fmt.Fprintf(w, "      event %s\n", &events[k])
+			}
+		}
+		if out != nil {
+			if err = out.WriteRecord(rec); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// directionGuess tells commands from replies of a capture without
+// direction: plain replies start with a response code and a reply
+// repeats SEQ/ADDR of the command before it
+type directionGuess struct {
+	lastID  byte
+	pending bool
+}
+
+func (this *directionGuess) next(frame []byte) itlssp.Direction {
+	if len(frame) < 4 {
+		return itlssp.HostToDevice
+	}
+	id, code := frame[1], frame[3]
+	reply := code >= 0xF0 || (code == itlssp.STEX && this.pending && id == this.lastID)
+	if reply {
+		this.pending = false
+		return itlssp.DeviceToHost
+	}
+	this.lastID = id
+	this.pending = true
+	return itlssp.HostToDevice
+}
+
+// parseHex returns the frame bytes of the text. Hex after a read: or
+// write: field of a log line is taken as is, otherwise a run of hex tokens
+// must start with STX or continue the run at the end of the line before. Other words such as log prefixes, timestamps and PIDs
+// are skipped, even if they look like hex.
+func parseHex(text string) ([]byte, error) {
+	var res []byte
+	run := false
+	for _, line := range strings.Split(text, "\n") {
+		toks := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == '\r' || r == ',' || r == ';'
+		})
+		logged := false
+		for i, tok := range toks {
+			if field := strings.ToLower(strings.Trim(tok, `"'`)); strings.HasSuffix(field, "read:") ||
+				strings.HasSuffix(field, "write:") {
+				toks, run, logged = toks[i+1:], true, true
+				break
+			}
+		}
+		for _, tok := range toks {
+			b, ok := hexToken(tok)
+			if run = ok && (run || b[0] == itlssp.STX); run {
+				res = append(res, b...)
+			}
+		}
+		run = run && !logged
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no frame data in the capture")
+	}
+	return res, nil
+}
+
+// hexToken decodes the token of hex bytes, with 0x prefix, quotes or braces
+func hexToken(tok string) ([]byte, bool) {
+	tok = strings.Trim(tok, `"'{}[]`)
+	tok = strings.TrimPrefix(strings.TrimPrefix(tok, "0x"), "0X")
+	if tok == "" || len(tok)%2 != 0 {
+		return nil, false
+	}
+	b, err := hex.DecodeString(tok)
+	return b, err == nil
+}
+
+// isText reports whether the capture is printable text
+func isText(data []byte) bool {
+	for _, b := range data {
+		if (b < 0x20 || b > 0x7E) && b != '\n' && b != '\r' && b != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "sspdump:", err)
+	os.Exit(1)
+}
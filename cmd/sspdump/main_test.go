@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/charoit/itlssp"
+)
+
+func TestParseHex(t *testing.T) {
+	var table = []struct {
+		text string
+		exp  string
+	}{
+		{"7F 80 01 11 65 82", "7F8001116582"},
+		{"12:00:01 read: 7F8001F02380\n", "7F8001F02380"},
+		{"0x7F, 0x80, 0x01", "7F8001"},
+		{"7F 80 01\n11 65 82\n", "7F8001116582"},
+		{"2020/01/02 pid 4242 dead be add 12:00:01 read: 7F8001F02380\n", "7F8001F02380"},
+		{`{"level":"debug","pid":"add","message":"read: 7F8001F02380"}`, "7F8001F02380"},
+		{"12:00:01 write: 7F80011165\n82 beef\n12:00:02 cafe 7F8001F0\n", "7F800111657F8001F0"},
+		{"dead be 7F 80 01 zz 11 65\n", "7F8001"},
+	}
+
+	for _, v := range table {
+		data, err := parseHex(v.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%X", data) != v.exp {
+			t.Errorf("parseHex failed, expected %s, got %X", v.exp, data)
+		}
+	}
+	if _, err := parseHex("12:00:01 dead beef add"); err == nil {
+		t.Error("parseHex failed, expected error of text without frames")
+	}
+}
+
+func TestDump(t *testing.T) {
+	key := make([]byte, 16)
+	enc, _ := itlssp.NewEncryption(key)
+	var capture []byte
+	capture = append(capture, itlssp.EncodeFrame(0x80, []byte{byte(itlssp.SspCmdSync)})...)
+	capture = append(capture, itlssp.EncodeFrame(0x80, []byte{0xF0})...)
+	capture = append(capture, itlssp.EncodeFrame(0x00, enc.Encrypt([]byte{byte(itlssp.SspCmdPoll)}))...)
+	capture = append(capture, itlssp.EncodeFrame(0x00, enc.Encrypt([]byte{0xF0, byte(itlssp.SspEventCredit), 0x01}))...)
+	capture = append(capture, 0x7F, 0x80, 0x01, 0x07, 0x00, 0x00) // bad CRC
+
+	dec := itlssp.NewDecoder()
+	dec.SetKey(key)
+	var out bytes.Buffer
+	if err := dump(&out, bytes.NewReader(capture), dec, enc, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"H>D 00/1 SYNC COMMAND", "D>H 00/1 Success", "H>D 00/0 POLL COMMAND",
+		"D>H 00/0 Success: CREDIT NOTE(1)", "INVALID FRAME"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("dump failed, expected %q, got\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Command sspproxy sits between a host application and a device. It opens
+// the device serial port, serves a pseudo-terminal for the host and forwards
+// frames both ways, recording every frame in the trace format. Device replies
+// can be dropped, corrupted or delayed to stress the host software.
+//
+//	sspproxy -port /dev/ttyUSB0 -link /tmp/ttyUSB0 -drop 0.05 -delay 20ms
+//
+// Bytes outside of SSP frames are not forwarded.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"io"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/charoit/itlssp"
+	"github.com/charoit/itlssp/internal/pty"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/tarm/serial"
+)
+
+// Faults are injected into device replies, Drop and Corrupt are probabilities
+type Faults struct {
+	Drop    float64
+	Corrupt float64
+	Delay   time.Duration
+}
+
+func main() {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	port := flag.String("port", "", "device serial port")
+	baud := flag.Int("baud", 9600, "device baud rate")
+	link := flag.String("link", "", "symlink to the host pseudo-terminal, e.g. /tmp/ttyUSB0")
+	trace := flag.String("trace", "", "trace file, .bin for the binary format, JSON Lines otherwise")
+	key := flag.String("key", "", "eSSP key in hex to record decrypted payloads")
+	var faults Faults
+	flag.Float64Var(&faults.Drop, "drop", 0, "probability of dropping a device reply")
+	flag.Float64Var(&faults.Corrupt, "corrupt", 0, "probability of corrupting the CRC of a device reply")
+	flag.DurationVar(&faults.Delay, "delay", 0, "delay of device replies")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed of the fault injection")
+	flag.Parse()
+	if *port == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	out := itlssp.NewJSONTraceWriter(os.Stdout)
+	if *trace != "" {
+		f, err := os.Create(*trace)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Create trace")
+		}
+		defer f.Close()
+		if strings.HasSuffix(*trace, ".bin") {
+			out = itlssp.NewBinaryTraceWriter(f)
+		} else {
+			out = itlssp.NewJSONTraceWriter(f)
+		}
+	}
+	rec := itlssp.NewRecorder(out)
+	if *key != "" {
+		k, err := hex.DecodeString(*key)
+		if err == nil {
+			err = rec.SetKey(k)
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid key")
+		}
+	}
+
+	dev, err := serial.OpenPort(itlssp.PortConfig(*port, *baud))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Open device port")
+	}
+	defer dev.Close()
+	master, slave, err := pty.Open()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Open pseudo-terminal")
+	}
+	defer master.Close()
+	defer slave.Close()
+	host := slave.Name()
+	if *link != "" {
+		os.Remove(*link)
+		if err = os.Symlink(host, *link); err != nil {
+			log.Fatal().Err(err).Msg("Link pseudo-terminal")
+		}
+		defer os.Remove(*link)
+		host = *link
+	}
+
+	rnd := rand.New(rand.NewSource(*seed))
+	var mu sync.Mutex
+	chance := func(p float64) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return p > 0 && rnd.Float64() < p
+	}
+	go func() {
+		err := forward(master, dev, itlssp.HostToDevice, rec, Faults{}, chance)
+		log.Error().Err(err).Msg("Host side closed")
+	}()
+	go func() {
+		err := forward(dev, master, itlssp.DeviceToHost, rec, faults, chance)
+		log.Error().Err(err).Msg("Device side closed")
+	}()
+	log.Info().Str("device", *port).Str("host", host).Int64("seed", *seed).Msg("Proxy ready")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	if err = rec.Err(); err != nil {
+		log.Error().Err(err).Msg("Trace failed")
+	}
+}
+
+// forward copies frames from src to dst, records them and applies the faults
+func forward(src io.Reader, dst io.Writer, dir itlssp.Direction, rec *itlssp.Recorder, faults Faults,
+	chance func(p float64) bool) error {
+	for {
+		frame, err := itlssp.ReadFrame(src)
+		if err == io.EOF {
+			continue // read timeout
+		}
+		if err != nil {
+			return err
+		}
+		rec.Record(dir, frame)
+		if chance(faults.Drop) {
+			log.Warn().Str("dir", dir.String()).Hex("frame", frame).Msg("Dropped")
+			continue
+		}
+		if chance(faults.Corrupt) {
+			frame = append([]byte(nil), frame...)
+			frame[len(frame)-1] ^= 0xFF
+			log.Warn().Str("dir", dir.String()).Hex("frame", frame).Msg("Corrupted CRC")
+		}
+		if faults.Delay > 0 {
+			time.Sleep(faults.Delay)
+		}
+		if _, err = dst.Write(itlssp.StuffFrame(frame)); err != nil {
+			return err
+		}
+	}
+}
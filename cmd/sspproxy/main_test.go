@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/charoit/itlssp"
+)
+
+// traceBuffer keeps records of the test
+type traceBuffer struct {
+	records []*itlssp.Record
+}
+
+func (this *traceBuffer) WriteRecord(rec *itlssp.Record) error {
+	this.records = append(this.records, rec)
+	return nil
+}
+
+// closedReader ends with a closed port instead of a read timeout
+type closedReader struct {
+	r io.Reader
+}
+
+func (this *closedReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	if err == io.EOF {
+		err = io.ErrClosedPipe
+	}
+	return n, err
+}
+
+func TestForward(t *testing.T) {
+	frames := append(itlssp.EncodeFrame(0x80, []byte{0xF0, 0x7F}), itlssp.EncodeFrame(0x00, []byte{0xF0})...)
+	var table = []struct {
+		faults Faults
+		check  func(out []byte) bool
+	}{
+		{Faults{}, func(out []byte) bool { return bytes.Equal(out, frames) }},
+		{Faults{Drop: 1}, func(out []byte) bool { return len(out) == 0 }},
+		{Faults{Corrupt: 1}, func(out []byte) bool {
+			frame, err := itlssp.ReadFrame(bytes.NewReader(out))
+			if err != nil {
+				return false
+			}
+			_, _, err = itlssp.DecodeFrame(frame)
+			return len(out) == len(frames) && err != nil
+		}},
+	}
+	always := func(p float64) bool { return p > 0 }
+
+	for i, v := range table {
+		trace := &traceBuffer{}
+		var out bytes.Buffer
+		src := &closedReader{bytes.NewReader(frames)}
+		err := forward(src, &out, itlssp.DeviceToHost, itlssp.NewRecorder(trace), v.faults, always)
+		if err != io.ErrClosedPipe {
+			t.Errorf("%d: forward failed, expected %v, got %v", i, io.ErrClosedPipe, err)
+		}
+		if !v.check(out.Bytes()) {
+			t.Errorf("%d: forward failed, got %X", i, out.Bytes())
+		}
+		if len(trace.records) != 2 {
+			t.Errorf("%d: forward failed, expected 2 recorded frames, got %d", i, len(trace.records))
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Command sspreplay replays recorded SSP traces (binary or JSON Lines).
+//
+//	sspreplay events trace.jsonl
+//
+// decodes the device replies of the trace into the typed event stream.
+//
+//	sspreplay host -link /tmp/ttyUSB0 trace.jsonl
+//
+// serves the device side of the trace on a pseudo-terminal and checks
+// the host application sends the recorded commands.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/charoit/itlssp"
+	"github.com/charoit/itlssp/internal/pty"
+	"github.com/charoit/itlssp/simulator"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "events":
+		events(os.Args[2:])
+	case "host":
+		host(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: sspreplay events <trace>")
+	fmt.Fprintln(os.Stderr, "       sspreplay host [-link path] [-fixed key] [-timeout d] <trace>")
+	os.Exit(2)
+}
+
+// openTrace opens the trace file named by the only argument
+func openTrace(fs *flag.FlagSet) (itlssp.TraceReader, *os.File) {
+	if fs.NArg() != 1 {
+		usage()
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Open trace")
+	}
+	r, err := itlssp.OpenTrace(f)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Read trace")
+	}
+	return r, f
+}
+
+// events prints the events of the device replies
+func events(args []string) {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	fs.Parse(args)
+	r, f := openTrace(fs)
+	defer f.Close()
+
+	err := itlssp.ReplayEvents(r, func(rec *itlssp.Record, events []itlssp.Event) error {
+		for i := range events {
+			fmt.Printf("%12s %02X %s\n", rec.Time, rec.Addr, &events[i])
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Replay events")
+	}
+}
+
+// host serves the trace on a pseudo-terminal until the host sent all
+// recorded commands, the timeout expired or the command is interrupted
+func host(args []string) {
+	fs := flag.NewFlagSet("host", flag.ExitOnError)
+	link := fs.String("link", "", "symlink to the pseudo-terminal, e.g. /tmp/ttyUSB0")
+	fixed := fs.String("fixed", "", "eSSP fixed key of the device in hex, default key if empty")
+	timeout := fs.Duration("timeout", 0, "stop waiting for the host after the duration, zero waits forever")
+	fs.Parse(args)
+	r, f := openTrace(fs)
+	replay, err := simulator.NewReplay(r)
+	f.Close()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Load trace")
+	}
+	if *fixed != "" {
+		key, err := strconv.ParseUint(*fixed, 16, 64)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid fixed key")
+		}
+		replay.SetFixedKey(key)
+	}
+
+	master, slave, err := pty.Open()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Open pseudo-terminal")
+	}
+	port := slave.Name()
+	if *link != "" {
+		os.Remove(*link)
+		if err = os.Symlink(port, *link); err != nil {
+			log.Fatal().Err(err).Msg("Link pseudo-terminal")
+		}
+		port = *link
+	}
+	go replay.Serve(master)
+	log.Info().Str("port", port).Msg("Replaying trace")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	var expired <-chan time.Time
+	if *timeout > 0 {
+		expired = time.After(*timeout)
+	}
+wait:
+	for !replay.Done() {
+		select {
+		case <-ticker.C:
+		case <-sig:
+			break wait
+		case <-expired:
+			break wait
+		}
+	}
+	time.Sleep(100 * time.Millisecond) // let the last reply go out
+	master.Close()
+	slave.Close()
+	if *link != "" {
+		os.Remove(*link)
+	}
+
+	if err = replay.Err(); err != nil {
+		for _, m := range replay.Mismatches() {
+			fmt.Println(m.String())
+		}
+		log.Error().Err(err).Send()
+		os.Exit(1)
+	}
+	log.Info().Int("commands", len(replay.Received())).Msg("Host matches the trace")
+}
@@ -0,0 +1,107 @@
+package itlssp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Counters are the note counters of the device
+type Counters struct {
+	Stacked     uint32
+	Stored      uint32
+	Dispensed   uint32
+	Transferred uint32
+	Rejected    uint32
+}
+
+func (this *Counters) String() string {
+	return fmt.Sprintf(`{"Stacked":%d,"Stored":%d,"Dispensed":%d,"Transferred":%d,"Rejected":%d}`,
+		this.Stacked, this.Stored, this.Dispensed, this.Transferred, this.Rejected)
+}
+
+// Sub returns counters changed since prev. A counter less than in prev
+// was reset in between, its whole value is counted.
+func (this *Counters) Sub(prev *Counters) Counters {
+	sub := func(cur, old uint32) uint32 {
+		if cur < old {
+			return cur
+		}
+		return cur - old
+	}
+	return Counters{
+		Stacked:     sub(this.Stacked, prev.Stacked),
+		Stored:      sub(this.Stored, prev.Stored),
+		Dispensed:   sub(this.Dispensed, prev.Dispensed),
+		Transferred: sub(this.Transferred, prev.Transferred),
+		Rejected:    sub(this.Rejected, prev.Rejected),
+	}
+}
+
+// CounterSnapshot is the counters read at the time
+type CounterSnapshot struct {
+	Time     time.Time
+	Counters Counters
+}
+
+func (this *CounterSnapshot) String() string {
+	return fmt.Sprintf(`{"Time":"%s","Counters":%s}`, this.Time.Format(time.RFC3339), &this.Counters)
+}
+
+// CounterDelta is the change of counters between two snapshots
+type CounterDelta struct {
+	From     time.Time
+	To       time.Time
+	Counters Counters
+}
+
+func (this *CounterDelta) String() string {
+	return fmt.Sprintf(`{"From":"%s","To":"%s","Counters":%s}`,
+		this.From.Format(time.RFC3339), this.To.Format(time.RFC3339), &this.Counters)
+}
+
+// Delta returns the change of counters since the prev snapshot
+func (this *CounterSnapshot) Delta(prev *CounterSnapshot) *CounterDelta {
+	return &CounterDelta{
+		From:     prev.Time,
+		To:       this.Time,
+		Counters: this.Counters.Sub(&prev.Counters),
+	}
+}
+
+// GetCounters returns the note counters of the device
+func (this *generic) GetCounters() (*Counters, error) {
+	buf := []byte{byte(SspCmdGetCounter)}
+	res, err := this.unit.SendCommand(buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(res) < 2 || res[1] < 5 || len(res) < 2+int(res[1])*4 {
+		return nil, errors.Errorf("Invalid counters data: %X", res)
+	}
+	return &Counters{
+		Stacked:     binary.LittleEndian.Uint32(res[2:6]),
+		Stored:      binary.LittleEndian.Uint32(res[6:10]),
+		Dispensed:   binary.LittleEndian.Uint32(res[10:14]),
+		Transferred: binary.LittleEndian.Uint32(res[14:18]),
+		Rejected:    binary.LittleEndian.Uint32(res[18:22]),
+	}, nil
+}
+
+// ResetCounters clears the note counters of the device
+func (this *generic) ResetCounters() error {
+	buf := []byte{byte(SspCmdResetCounter)}
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// Snapshot reads the counters with the current time
+func (this *generic) Snapshot() (*CounterSnapshot, error) {
+	c, err := this.GetCounters()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &CounterSnapshot{Time: time.Now(), Counters: *c}, nil
+}
@@ -0,0 +1,42 @@
+package itlssp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetCounters(t *testing.T) {
+	reply := []byte{0xF0, 0x05}
+	for _, v := range []uint32{100, 20, 15, 3, 7} {
+		reply = append(reply, uint32Bytes(v)...)
+	}
+	u := &fakeUnit{reply: [][]byte{reply, {0xF2}}}
+	g := &generic{unit: u}
+	c, err := g.GetCounters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &Counters{Stacked: 100, Stored: 20, Dispensed: 15, Transferred: 3, Rejected: 7}
+	if !reflect.DeepEqual(c, exp) {
+		t.Errorf("GetCounters failed, expected %s, got %s", exp, c)
+	}
+	if _, err = g.GetCounters(); err == nil {
+		t.Error("GetCounters failed, expected error on unknown command")
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	t0 := time.Date(2020, 11, 20, 8, 0, 0, 0, time.UTC)
+	prev := &CounterSnapshot{Time: t0, Counters: Counters{Stacked: 100, Stored: 20, Dispensed: 15, Transferred: 3, Rejected: 7}}
+	cur := &CounterSnapshot{Time: t0.Add(8 * time.Hour), Counters: Counters{Stacked: 150, Stored: 25, Dispensed: 15, Transferred: 1, Rejected: 9}}
+	d := cur.Delta(prev)
+	exp := &CounterDelta{
+		From:     prev.Time,
+		To:       cur.Time,
+		Counters: Counters{Stacked: 50, Stored: 5, Dispensed: 0, Transferred: 1, Rejected: 2},
+	}
+	if !reflect.DeepEqual(d, exp) {
+		t.Errorf("Delta failed, expected %s, got %s", exp, d)
+	}
+}
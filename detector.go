@@ -1,7 +1,7 @@
 package itlssp
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"time"
@@ -37,13 +37,25 @@ func (u UnitType) String() string {
 	}
 }
 
+// Default SSP addresses of devices
+const (
+	AddrValidator byte = 0x00
+	AddrHopper    byte = 0x10
+)
+
+var (
+	DefaultAddresses = []byte{AddrValidator, AddrHopper}
+	DefaultBauds     = []int{9600}
+)
+
 type SSPConnection struct {
 	Name string
 	Addr byte
+	Baud int
 }
 
 func (p *SSPConnection) String() string {
-	return fmt.Sprintf(`{"Name":"%s","Addr":%d}`, p.Name, p.Addr)
+	return fmt.Sprintf(`{"Name":"%s","Addr":%d,"Baud":%d}`, p.Name, p.Addr, p.Baud)
 }
 
 func AvailablePorts() (ports []*SSPConnection) {
@@ -56,6 +68,18 @@ func AvailablePorts() (ports []*SSPConnection) {
 	return ports
 }
 
+// PortConfig returns SSP serial port configuration
+func PortConfig(name string, baud int) *serial.Config {
+	return &serial.Config{
+		Name:        name,
+		Baud:        baud,
+		ReadTimeout: time.Microsecond * 500,
+		Size:        8,
+		Parity:      0,
+		StopBits:    2,
+	}
+}
+
 type Unit struct {
 	Type     UnitType
 	Version  string
@@ -64,65 +88,161 @@ type Unit struct {
 }
 
 type SSPDevice struct {
-	Port *SSPConnection
-	Unit *Unit
+	Port   *SSPConnection
+	Unit   *Unit
+	Serial uint32
 }
 
+// DiscoverConfig selects ports, addresses and baud rates to probe,
+// empty fields are replaced with available ports and defaults
+type DiscoverConfig struct {
+	Ports     []string
+	Addresses []byte
+	Bauds     []int
+}
+
+// PortResult is the result of probing the port, Err is the reason
+// no device was found
+type PortResult struct {
+	Port    string
+	Devices []*SSPDevice
+	Err     error
+}
+
+// SearchSSPDevices probes all available ports with default settings
 func SearchSSPDevices() (devices []*SSPDevice) {
-	for _, port := range AvailablePorts() {
-		if dvc, err := detect(port); err == nil {
-			devices = append(devices, dvc)
-		}
+	for _, res := range Discover(context.Background(), nil) {
+		devices = append(devices, res.Devices...)
 	}
 	return devices
 }
 
-func detect(port *SSPConnection) (device *SSPDevice, err error) {
-	cfg := &serial.Config{
-		Name:        port.Name,
-		Baud:        9600,
-		ReadTimeout: time.Microsecond * 500,
-		Size:        8,
-		Parity:      0,
-		StopBits:    2,
+// Discover probes ports concurrently until all ports are done or ctx is done,
+// ports not finished in time report the ctx error
+func Discover(ctx context.Context, cfg *DiscoverConfig) []*PortResult {
+	var c DiscoverConfig
+	if cfg != nil {
+		c = *cfg
 	}
-	var com *serial.Port
-	if com, err = serial.OpenPort(cfg); err != nil {
-		return nil, errors.WithStack(err)
+	if len(c.Ports) == 0 {
+		for _, p := range AvailablePorts() {
+			c.Ports = append(c.Ports, p.Name)
+		}
+	}
+	if len(c.Addresses) == 0 {
+		c.Addresses = DefaultAddresses
+	}
+	if len(c.Bauds) == 0 {
+		c.Bauds = DefaultBauds
 	}
-	defer com.Close()
 
-	if _, err = com.Write([]byte{xSTX, 0x80, 0x01, 0x05, 0x1D, 0x82}); err != nil {
-		return nil, errors.WithStack(err)
+	type indexed struct {
+		idx int
+		res *PortResult
+	}
+	ch := make(chan indexed, len(c.Ports))
+	for i, name := range c.Ports {
+		go func(i int, name string) {
+			ch <- indexed{i, probePort(ctx, name, c.Addresses, c.Bauds)}
+		}(i, name)
 	}
 
-	var buf []byte
-	if buf, err = readPort(com); err != nil {
-		return nil, errors.WithStack(err)
+	results := make([]*PortResult, len(c.Ports))
+	for n := 0; n < len(c.Ports); n++ {
+		select {
+		case v := <-ch:
+			results[v.idx] = v.res
+		case <-ctx.Done():
+			n = len(c.Ports)
+		}
+	}
+	for i, res := range results {
+		if res == nil {
+			results[i] = &PortResult{Port: c.Ports[i], Err: errors.WithStack(ctx.Err())}
+		}
 	}
+	return results
+}
 
-	var zero byte = 4
-	if len(buf) < 35 || buf[zero-1] != 0xF0 {
-		return nil, ErrNoDeviceFound
+// probePort tries every baud rate and address of the port, stops on the
+// first baud rate any device answered at
+func probePort(ctx context.Context, name string, addrs []byte, bauds []int) *PortResult {
+	res := &PortResult{Port: name}
+	for _, baud := range bauds {
+		if res.Err = ctx.Err(); res.Err != nil {
+			break
+		}
+		cfg := PortConfig(name, baud)
+		com, err := openPort(cfg)
+		if err != nil {
+			res.Err = errors.WithStack(err)
+			break
+		}
+		for _, addr := range addrs {
+			if res.Err = ctx.Err(); res.Err != nil {
+				break
+			}
+			var dvc *SSPDevice
+			if dvc, err = probe(com, cfg, addr); err != nil {
+				res.Err = errors.WithStack(err)
+				continue
+			}
+			res.Devices = append(res.Devices, dvc)
+		}
+		com.Close()
+		if len(res.Devices) > 0 {
+			res.Err = nil
+			break
+		}
 	}
+	if len(res.Devices) == 0 && res.Err == nil {
+		res.Err = ErrNoDeviceFound
+	}
+	return res
+}
 
-	device = &SSPDevice{
-		Port: port,
+// probe synchronizes with the device at the address and reads its setup
+func probe(com io.ReadWriteCloser, cfg *serial.Config, addr byte) (*SSPDevice, error) {
+	g := &generic{unit: &device{seq: 0x80, addr: addr, conf: cfg, port: com}}
+	if err := g.Sync(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	setup, err := g.SetupRequest()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sn, err := g.GetSerialNumber()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &SSPDevice{
+		Port: &SSPConnection{Name: cfg.Name, Addr: addr, Baud: cfg.Baud},
 		Unit: &Unit{
-			Type:     UnitType(buf[zero]),
-			Version:  string(buf[zero+1 : zero+5]),
-			Currency: string(buf[zero+5 : zero+8]),
-			Channels: buf[zero+11],
+			Type:     setup.Type,
+			Version:  setup.Firmware,
+			Currency: setup.Currency,
+			Channels: byte(len(setup.Channels)),
 		},
-	}
-	return device, nil
+		Serial: sn,
+	}, nil
 }
 
+// readPort reads the reply frame, without a whole frame it returns all
+// bytes read until the port timed out
 func readPort(r io.Reader) ([]byte, error) {
+	var s frameScanner
 	var line []byte
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line = append(line, scanner.Bytes()...)
+	for {
+		b, err := readByte(r)
+		if err == io.EOF {
+			return line, nil
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		line = append(line, b)
+		if frame := s.feed(b); frame != nil {
+			return frame, nil
+		}
 	}
-	return line, errors.WithStack(scanner.Err())
 }
@@ -2,8 +2,11 @@ package itlssp
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestRead(t *testing.T) {
@@ -37,3 +40,26 @@ func TestRead(t *testing.T) {
 		}
 	}
 }
+
+func TestDiscoverPortError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res := Discover(ctx, &DiscoverConfig{Ports: []string{"/dev/nonexistent-ssp-0", "/dev/nonexistent-ssp-1"}})
+	if len(res) != 2 {
+		t.Fatalf("Discover failed, expected 2 results, got %d", len(res))
+	}
+	for i, v := range res {
+		if v.Port != fmt.Sprintf("/dev/nonexistent-ssp-%d", i) || v.Err == nil || len(v.Devices) != 0 {
+			t.Errorf("Discover failed, expected open error, got %+v", v)
+		}
+	}
+}
+
+func TestDiscoverCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res := Discover(ctx, &DiscoverConfig{Ports: []string{"/dev/nonexistent-ssp-0"}})
+	if len(res) != 1 || res[0].Err == nil {
+		t.Errorf("Discover failed, expected context error, got %+v", res)
+	}
+}
@@ -1,11 +1,33 @@
 package itlssp
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	xSTX  = 0x7F
+	xSTEX = 0x7E // encrypted data marker
 )
 
+// STX starts every frame, STEX starts encrypted eSSP data
 const (
-	xSTX = 0x7F
+	STX  byte = xSTX
+	STEX byte = xSTEX
+)
+
+// DefaultFixedKey is the factory eSSP fixed key of devices
+const DefaultFixedKey uint64 = 0x0123456701234567
+
+var (
+	ErrEncryptedPacket = errors.New("Invalid encrypted packet")
+	ErrEncryptionCount = errors.New("Invalid encrypted packet count")
 )
 
 type Channel struct {
@@ -17,10 +39,15 @@ type Channel struct {
 }
 
 func (this *Channel) String() string {
-	return fmt.Sprintf(`{"Value":%d,"Level":%d,"Channel":%d,"Recycling":%v,"Currency":%s}`,
+	return fmt.Sprintf(`{"Value":%d,"Level":%d,"Channel":%d,"Recycling":%v,"Currency":"%s"}`,
 		this.Value, this.Level, this.Channel, this.Recycling, string(this.Currency))
 }
 
+// MarshalJSON encodes the channel the same way as String
+func (this Channel) MarshalJSON() ([]byte, error) {
+	return []byte(this.String()), nil
+}
+
 type SSPResponse int
 
 const (
@@ -93,11 +120,22 @@ const (
 	SspCmdPayoutLastNote        SspCommand = 0x42
 	SspCmdStackLastNote         SspCommand = 0x43
 	SspCmdSetValueReportingType SspCommand = 0x45
+	SspCmdSetBarcodeConfig      SspCommand = 0x23
+	SspCmdGetBarcodeConfig      SspCommand = 0x24
+	SspCmdGetBarcodeInhibit     SspCommand = 0x25
+	SspCmdSetBarcodeInhibit     SspCommand = 0x26
+	SspCmdGetBarcodeData        SspCommand = 0x27
+	SspCmdConfigureBezel        SspCommand = 0x54
 	// payout devices
+	SspCmdGetAllLevels         SspCommand = 0x22
+	SspCmdPayoutAmount         SspCommand = 0x33
 	SspCmdHaltPayout           SspCommand = 0x38
 	SspCmdSetDenominationRoute SspCommand = 0x3B
 	SspCmdGetDenominationRoute SspCommand = 0x3C
+	SspCmdFloatAmount          SspCommand = 0x3D
 	SspCmdEmptyAll             SspCommand = 0x3F
+	SspCmdFloatByDenomination  SspCommand = 0x44
+	SspCmdPayoutByDenomination SspCommand = 0x46
 	SspCmdSmartEmpty           SspCommand = 0x52
 	SspCmdEnablePayout         SspCommand = 0x5C
 	SspCmdDisablePayout        SspCommand = 0x5B
@@ -153,14 +191,36 @@ func (code SspCommand) String() string {
 		return "LAST REJECT CODE"
 	case SspCmdHold:
 		return "HOLD"
+	case SspCmdSetBarcodeConfig:
+		return "SET BARCODE READER CONFIGURATION"
+	case SspCmdGetBarcodeConfig:
+		return "GET BARCODE READER CONFIGURATION"
+	case SspCmdGetBarcodeInhibit:
+		return "GET BARCODE INHIBIT"
+	case SspCmdSetBarcodeInhibit:
+		return "SET BARCODE INHIBIT"
+	case SspCmdGetBarcodeData:
+		return "GET BARCODE DATA"
+	case SspCmdConfigureBezel:
+		return "CONFIGURE BEZEL"
 	case SspCmdEnablePayout:
 		return "ENABLE PAYOUT COMMAND"
 	case SspCmdDisablePayout:
 		return "DISABLE PAYOUT COMMAND"
 	case SspCmdSetValueReportingType:
 		return "SET VALUE REPORTING TYPE COMMAND"
+	case SspCmdGetAllLevels:
+		return "GET ALL LEVELS"
+	case SspCmdPayoutAmount:
+		return "PAYOUT AMOUNT"
 	case SspCmdHaltPayout:
 		return "HALT PAYOUT"
+	case SspCmdFloatAmount:
+		return "FLOAT AMOUNT"
+	case SspCmdPayoutByDenomination:
+		return "PAYOUT BY DENOMINATION"
+	case SspCmdFloatByDenomination:
+		return "FLOAT BY DENOMINATION"
 	case SspCmdSetDenominationRoute:
 		return "SET DENOMINATION ROUTE"
 	case SspCmdGetDenominationRoute:
@@ -241,3 +301,127 @@ func (code SspCommand) String() string {
 		return "Byte command name unsupported"
 	}
 }
+
+// Encryption is the eSSP AES-128 session, Count is the number of packets
+// encrypted and decrypted since the key negotiation. Host and device count
+// every packet, so a reply carries the count of its command plus one.
+type Encryption struct {
+	Count uint32
+	block cipher.Block
+}
+
+func NewEncryption(key []byte) (*Encryption, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Encryption{block: block}, nil
+}
+
+// Encrypt packs data into eSSP encrypted data: STEX and AES blocks of
+// eLENGTH, eCOUNT, data, random packing and eCRC, and counts the packet
+func (this *Encryption) Encrypt(data []byte) []byte {
+	size := 1 + 4 + len(data) + 2
+	if size%aes.BlockSize != 0 {
+		size += aes.BlockSize - size%aes.BlockSize
+	}
+	buf := make([]byte, size)
+	buf[0] = byte(len(data))
+	binary.LittleEndian.PutUint32(buf[1:5], this.Count)
+	copy(buf[5:], data)
+	rand.Read(buf[5+len(data) : size-2])
+	copy(buf[size-2:], crc16Bytes(buf[:size-2]))
+
+	res := make([]byte, 1+size)
+	res[0] = xSTEX
+	for i := 0; i < size; i += aes.BlockSize {
+		this.block.Encrypt(res[1+i:], buf[i:i+aes.BlockSize])
+	}
+	this.Count++
+	return res
+}
+
+// Decrypt unpacks eSSP encrypted data, checks its count and counts the packet
+func (this *Encryption) Decrypt(data []byte) ([]byte, error) {
+	buf, count, err := this.Unseal(data)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if count != this.Count {
+		return nil, errors.Wrapf(ErrEncryptionCount, "expected %d, got %d", this.Count, count)
+	}
+	this.Count++
+	return buf, nil
+}
+
+// Unseal unpacks eSSP encrypted data and returns it with its count
+// without checking the count, used to decode recorded traffic
+func (this *Encryption) Unseal(data []byte) ([]byte, uint32, error) {
+	if len(data) < 1+aes.BlockSize || data[0] != xSTEX || (len(data)-1)%aes.BlockSize != 0 {
+		return nil, 0, errors.WithStack(ErrEncryptedPacket)
+	}
+	size := len(data) - 1
+	buf := make([]byte, size)
+	for i := 0; i < size; i += aes.BlockSize {
+		this.block.Decrypt(buf[i:], data[1+i:1+i+aes.BlockSize])
+	}
+	crc := crc16Bytes(buf[:size-2])
+	if buf[size-2] != crc[0] || buf[size-1] != crc[1] || int(buf[0]) > size-7 {
+		return nil, 0, errors.WithStack(ErrEncryptedPacket)
+	}
+	return buf[5 : 5+int(buf[0])], binary.LittleEndian.Uint32(buf[1:5]), nil
+}
+
+// PlainCommand reports whether the command is never encrypted
+func PlainCommand(data []byte) bool {
+	switch SspCommand(data[0]) {
+	case SspCmdSync, SspCmdSetGenerator, SspCmdSetModulus, SspCmdRequestKeyExchange:
+		return true
+	}
+	return false
+}
+
+// negotiateKeys runs the eSSP Diffie-Hellman key exchange and sets the
+// encryption key: fixed key in the lower and negotiated key in the upper half
+func negotiateKeys(u unit, fixed uint64) error {
+	gen, err := rand.Prime(rand.Reader, 63)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	mod, err := rand.Prime(rand.Reader, 63)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if gen.Cmp(mod) < 0 {
+		gen, mod = mod, gen
+	}
+	secret, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	inter := new(big.Int).Exp(gen, secret, mod)
+
+	if _, err = u.SendCommand(append([]byte{byte(SspCmdSetGenerator)}, uint64Bytes(gen.Uint64())...)); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err = u.SendCommand(append([]byte{byte(SspCmdSetModulus)}, uint64Bytes(mod.Uint64())...)); err != nil {
+		return errors.WithStack(err)
+	}
+	res, err := u.SendCommand(append([]byte{byte(SspCmdRequestKeyExchange)}, uint64Bytes(inter.Uint64())...))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(res) < 9 {
+		return errors.Errorf("Invalid key exchange data: %X", res)
+	}
+	slave := new(big.Int).SetUint64(binary.LittleEndian.Uint64(res[1:9]))
+	key := new(big.Int).Exp(slave, secret, mod)
+	return u.SetEncryption(append(uint64Bytes(fixed), uint64Bytes(key.Uint64())...))
+}
+
+// uint64Bytes return eight bytes little endian value
+func uint64Bytes(v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	return buf
+}
@@ -0,0 +1,129 @@
+package itlssp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+var testKey = []byte{0x67, 0x45, 0x23, 0x01, 0x67, 0x45, 0x23, 0x01, 1, 2, 3, 4, 5, 6, 7, 8}
+
+func TestEncryption(t *testing.T) {
+	host, _ := NewEncryption(testKey)
+	slave, _ := NewEncryption(testKey)
+	var table = [][]byte{
+		{0x07},
+		{0x33, 0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R', 0x58},
+		bytes.Repeat([]byte{0x7F}, 40),
+	}
+
+	for _, v := range table {
+		enc := host.Encrypt(v)
+		if enc[0] != xSTEX || (len(enc)-1)%16 != 0 {
+			t.Fatalf("Encrypt failed, got %X", enc)
+		}
+		dec, err := slave.Decrypt(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(dec, v) {
+			t.Errorf("Decrypt failed, expected %X, got %X", v, dec)
+		}
+		if host.Count != slave.Count {
+			t.Errorf("Decrypt failed, expected count %d, got %d", host.Count, slave.Count)
+		}
+	}
+
+	enc := host.Encrypt([]byte{0x07})
+	if _, err := slave.Decrypt(enc[:len(enc)-1]); err == nil {
+		t.Error("Decrypt failed, expected packet error")
+	}
+	slave.Count++
+	if _, err := slave.Decrypt(enc); err == nil {
+		t.Error("Decrypt failed, expected count error")
+	}
+}
+
+func TestEncryptionCount(t *testing.T) {
+	// reference packets of testKey with zero packing
+	var table = []struct {
+		packet string
+		count  uint32
+		data   []byte
+	}{
+		{"7E3430C6C749745FB717896397C6D6DDC5", 5, []byte{0x07}},
+		{"7E4F64A67B58219CABF609520C7502E254", 6, []byte{0xF0, 0xEE, 0x02}},
+	}
+
+	host, _ := NewEncryption(testKey)
+	slave, _ := NewEncryption(testKey)
+	host.Count, slave.Count = 5, 5
+	for i, v := range table {
+		packet, _ := hex.DecodeString(v.packet)
+		from, to := host, slave
+		if i%2 == 1 {
+			from, to = slave, host
+		}
+		if _, count, _ := from.Unseal(from.Encrypt(v.data)); count != v.count {
+			t.Errorf("%d: Encrypt failed, expected count %d, got %d", i, v.count, count)
+		}
+		dec, err := to.Decrypt(packet)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(dec, v.data) {
+			t.Errorf("%d: Decrypt failed, expected %X, got %X", i, v.data, dec)
+		}
+		if host.Count != v.count+1 || slave.Count != v.count+1 {
+			t.Errorf("%d: Decrypt failed, expected count %d, got %d and %d", i, v.count+1, host.Count, slave.Count)
+		}
+	}
+}
+
+// dhSlave answers the key exchange like a device
+type dhSlave struct {
+	fakeUnit
+	gen, mod *big.Int
+	slaveKey uint64
+}
+
+func (this *dhSlave) SendCommand(data []byte) ([]byte, error) {
+	this.sent = append(this.sent, data)
+	switch SspCommand(data[0]) {
+	case SspCmdSetGenerator:
+		this.gen = new(big.Int).SetUint64(binary.LittleEndian.Uint64(data[1:]))
+	case SspCmdSetModulus:
+		this.mod = new(big.Int).SetUint64(binary.LittleEndian.Uint64(data[1:]))
+	case SspCmdRequestKeyExchange:
+		secret := big.NewInt(0x1234567)
+		host := new(big.Int).SetUint64(binary.LittleEndian.Uint64(data[1:]))
+		this.slaveKey = new(big.Int).Exp(host, secret, this.mod).Uint64()
+		inter := new(big.Int).Exp(this.gen, secret, this.mod)
+		return append([]byte{0xF0}, uint64Bytes(inter.Uint64())...), nil
+	}
+	return []byte{0xF0}, nil
+}
+
+func TestNegotiateKeys(t *testing.T) {
+	u := &dhSlave{}
+	g := &generic{unit: u}
+	if err := g.NegotiateKeys(DefaultFixedKey); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.sent) != 3 || u.gen.Cmp(u.mod) <= 0 {
+		t.Fatalf("NegotiateKeys failed, sent %X", u.sent)
+	}
+	exp := append(uint64Bytes(DefaultFixedKey), uint64Bytes(u.slaveKey)...)
+	if !reflect.DeepEqual(u.key, exp) {
+		t.Errorf("NegotiateKeys failed, expected key %X, got %X", exp, u.key)
+	}
+}
+
+func TestPlainCommand(t *testing.T) {
+	if !PlainCommand([]byte{byte(SspCmdSync)}) || PlainCommand([]byte{byte(SspCmdPoll)}) {
+		t.Error("PlainCommand failed")
+	}
+}
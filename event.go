@@ -0,0 +1,293 @@
+package itlssp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownEvent = errors.New("Unknown poll event")
+
+type SspEvent byte
+
+const (
+	// generic events
+	SspEventSlaveReset      SspEvent = 0xF1
+	SspEventDisabled        SspEvent = 0xE8
+	SspEventChannelDisable  SspEvent = 0xB5
+	SspEventInitialising    SspEvent = 0xB6
+	SspEventFraudAttempt    SspEvent = 0xE6
+	SspEventCashboxRemoved  SspEvent = 0xE3
+	SspEventCashboxReplaced SspEvent = 0xE4
+	// validator events
+	SspEventRead               SspEvent = 0xEF
+	SspEventCredit             SspEvent = 0xEE
+	SspEventRejecting          SspEvent = 0xED
+	SspEventRejected           SspEvent = 0xEC
+	SspEventStacking           SspEvent = 0xCC
+	SspEventStacked            SspEvent = 0xEB
+	SspEventSafeJam            SspEvent = 0xEA
+	SspEventUnsafeJam          SspEvent = 0xE9
+	SspEventStackerFull        SspEvent = 0xE7
+	SspEventNoteClearedFront   SspEvent = 0xE1
+	SspEventNoteClearedCashbox SspEvent = 0xE2
+	SspEventNoteHeldInBezel    SspEvent = 0xCE
+	SspEventTicketInEscrow     SspEvent = 0xE5
+	SspEventTicketPrintedAck   SspEvent = 0xD1
+	// payout events
+	SspEventDispensing         SspEvent = 0xDA
+	SspEventDispensed          SspEvent = 0xD2
+	SspEventJammed             SspEvent = 0xD5
+	SspEventHalted             SspEvent = 0xD6
+	SspEventFloating           SspEvent = 0xD7
+	SspEventFloated            SspEvent = 0xD8
+	SspEventTimeout            SspEvent = 0xD9
+	SspEventIncompletePayout   SspEvent = 0xDC
+	SspEventIncompleteFloat    SspEvent = 0xDD
+	SspEventCashboxPaid        SspEvent = 0xDE
+	SspEventCoinCredit         SspEvent = 0xDF
+	SspEventNoteStored         SspEvent = 0xDB
+	SspEventNoteTransferred    SspEvent = 0xC9
+	SspEventEmptying           SspEvent = 0xC2
+	SspEventEmptied            SspEvent = 0xC3
+	SspEventSmartEmptying      SspEvent = 0xB3
+	SspEventSmartEmptied       SspEvent = 0xB4
+	SspEventJamRecovery        SspEvent = 0xB0
+	SspEventErrorDuringPayout  SspEvent = 0xB1
+	SspEventPayoutOutOfService SspEvent = 0xC6
+	SspEventCoinMechJammed     SspEvent = 0xC4
+	SspEventCoinMechReturn     SspEvent = 0xC5
+	SspEventCoinMechError      SspEvent = 0xB7
+	SspEventDeviceFull         SspEvent = 0xCF
+)
+
+func (code SspEvent) String() string {
+	switch code {
+	case SspEventSlaveReset:
+		return "SLAVE RESET"
+	case SspEventDisabled:
+		return "DISABLED"
+	case SspEventChannelDisable:
+		return "CHANNEL DISABLE"
+	case SspEventInitialising:
+		return "INITIALISING"
+	case SspEventFraudAttempt:
+		return "FRAUD ATTEMPT"
+	case SspEventCashboxRemoved:
+		return "CASHBOX REMOVED"
+	case SspEventCashboxReplaced:
+		return "CASHBOX REPLACED"
+	case SspEventRead:
+		return "READ NOTE"
+	case SspEventCredit:
+		return "CREDIT NOTE"
+	case SspEventRejecting:
+		return "NOTE REJECTING"
+	case SspEventRejected:
+		return "NOTE REJECTED"
+	case SspEventStacking:
+		return "NOTE STACKING"
+	case SspEventStacked:
+		return "NOTE STACKED"
+	case SspEventSafeJam:
+		return "SAFE NOTE JAM"
+	case SspEventUnsafeJam:
+		return "UNSAFE NOTE JAM"
+	case SspEventStackerFull:
+		return "STACKER FULL"
+	case SspEventNoteClearedFront:
+		return "NOTE CLEARED FROM FRONT"
+	case SspEventNoteClearedCashbox:
+		return "NOTE CLEARED TO CASHBOX"
+	case SspEventNoteHeldInBezel:
+		return "NOTE HELD IN BEZEL"
+	case SspEventTicketInEscrow:
+		return "BARCODE TICKET ESCROW"
+	case SspEventTicketPrintedAck:
+		return "BARCODE TICKET ACK"
+	case SspEventDispensing:
+		return "DISPENSING"
+	case SspEventDispensed:
+		return "DISPENSED"
+	case SspEventJammed:
+		return "JAMMED"
+	case SspEventHalted:
+		return "HALTED"
+	case SspEventFloating:
+		return "FLOATING"
+	case SspEventFloated:
+		return "FLOATED"
+	case SspEventTimeout:
+		return "TIMEOUT"
+	case SspEventIncompletePayout:
+		return "INCOMPLETE PAYOUT"
+	case SspEventIncompleteFloat:
+		return "INCOMPLETE FLOAT"
+	case SspEventCashboxPaid:
+		return "CASHBOX PAID"
+	case SspEventCoinCredit:
+		return "COIN CREDIT"
+	case SspEventNoteStored:
+		return "NOTE STORED IN PAYOUT"
+	case SspEventNoteTransferred:
+		return "NOTE TRANSFERRED TO STACKER"
+	case SspEventEmptying:
+		return "EMPTYING"
+	case SspEventEmptied:
+		return "EMPTIED"
+	case SspEventSmartEmptying:
+		return "SMART EMPTYING"
+	case SspEventSmartEmptied:
+		return "SMART EMPTIED"
+	case SspEventJamRecovery:
+		return "JAM RECOVERY"
+	case SspEventErrorDuringPayout:
+		return "ERROR DURING PAYOUT"
+	case SspEventPayoutOutOfService:
+		return "PAYOUT OUT OF SERVICE"
+	case SspEventCoinMechJammed:
+		return "COIN MECH JAMMED"
+	case SspEventCoinMechReturn:
+		return "COIN MECH RETURN PRESSED"
+	case SspEventCoinMechError:
+		return "COIN MECH ERROR"
+	case SspEventDeviceFull:
+		return "DEVICE FULL"
+	default:
+		return fmt.Sprintf("Unknown event 0x%02X", byte(code))
+	}
+}
+
+// Amount is a value in the currency reported by the event,
+// Requested is set by incomplete payout and float events only
+type Amount struct {
+	Value     uint32
+	Requested uint32
+	Currency  string
+}
+
+func (this *Amount) String() string {
+	return fmt.Sprintf(`{"Value":%d,"Requested":%d,"Currency":"%s"}`, this.Value, this.Requested, this.Currency)
+}
+
+// Event is a decoded poll event, Ticket is set by the validator
+// for the barcode ticket in escrow
+type Event struct {
+	Code    SspEvent
+	Channel byte
+	Amounts []Amount
+	Ticket  *Ticket
+	Data    []byte
+}
+
+func (this *Event) String() string {
+	data, _ := json.Marshal(this)
+	return string(data)
+}
+
+// jsonEvent is the JSON form of the event
+type jsonEvent struct {
+	Code    string
+	Channel byte
+	Amounts []Amount
+	Ticket  *Ticket
+	Data    string
+}
+
+// MarshalJSON encodes the code by name and the data in hex
+func (this Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonEvent{
+		Code:    this.Code.String(),
+		Channel: this.Channel,
+		Amounts: this.Amounts,
+		Ticket:  this.Ticket,
+		Data:    fmt.Sprintf("%X", this.Data),
+	})
+}
+
+// DecodeEvents parses poll response data without the leading OK byte.
+// The data length of an event unknown to the table is not known, so
+// decoding stops there: the unknown event is returned last with the rest
+// of the data and ErrUnknownEvent.
+func DecodeEvents(data []byte) ([]Event, error) {
+	var events []Event
+	for i := 0; i < len(data); {
+		ev := Event{Code: SspEvent(data[i])}
+		i++
+		var n int
+		switch ev.Code {
+		case SspEventSlaveReset, SspEventDisabled, SspEventChannelDisable, SspEventInitialising,
+			SspEventCashboxRemoved, SspEventCashboxReplaced, SspEventRejecting, SspEventRejected,
+			SspEventStacking, SspEventStacked, SspEventSafeJam, SspEventUnsafeJam, SspEventStackerFull,
+			SspEventTicketInEscrow, SspEventTicketPrintedAck, SspEventNoteStored, SspEventEmptying,
+			SspEventEmptied, SspEventJamRecovery, SspEventPayoutOutOfService, SspEventCoinMechJammed,
+			SspEventCoinMechReturn, SspEventCoinMechError, SspEventDeviceFull:
+			// no data
+		case SspEventRead, SspEventCredit, SspEventFraudAttempt, SspEventNoteClearedFront,
+			SspEventNoteClearedCashbox:
+			if i >= len(data) {
+				return events, errors.Errorf("Invalid %s event data: %X", ev.Code, data)
+			}
+			ev.Channel = data[i]
+			n = 1
+		case SspEventCoinCredit:
+			if i+7 > len(data) {
+				return events, errors.Errorf("Invalid %s event data: %X", ev.Code, data)
+			}
+			ev.Amounts = []Amount{readAmount(data[i:])}
+			n = 7
+		case SspEventDispensing, SspEventDispensed, SspEventJammed, SspEventHalted, SspEventFloating,
+			SspEventFloated, SspEventTimeout, SspEventCashboxPaid, SspEventNoteTransferred,
+			SspEventSmartEmptying, SspEventSmartEmptied, SspEventNoteHeldInBezel, SspEventErrorDuringPayout:
+			if i >= len(data) {
+				return events, errors.Errorf("Invalid %s event data: %X", ev.Code, data)
+			}
+			count := int(data[i])
+			n = 1 + count*7
+			if ev.Code == SspEventErrorDuringPayout {
+				n++ // error code
+			}
+			if i+n > len(data) {
+				return events, errors.Errorf("Invalid %s event data: %X", ev.Code, data)
+			}
+			for k := 0; k < count; k++ {
+				ev.Amounts = append(ev.Amounts, readAmount(data[i+1+k*7:]))
+			}
+		case SspEventIncompletePayout, SspEventIncompleteFloat:
+			if i >= len(data) || i+1+int(data[i])*11 > len(data) {
+				return events, errors.Errorf("Invalid %s event data: %X", ev.Code, data)
+			}
+			count := int(data[i])
+			for k := 0; k < count; k++ {
+				p := data[i+1+k*11:]
+				ev.Amounts = append(ev.Amounts, Amount{
+					Value:     binary.LittleEndian.Uint32(p[0:4]),
+					Requested: binary.LittleEndian.Uint32(p[4:8]),
+					Currency:  string(p[8:11]),
+				})
+			}
+			n = 1 + count*11
+		default:
+			if i < len(data) {
+				ev.Data = data[i:]
+			}
+			return append(events, ev), errors.Wrapf(ErrUnknownEvent, "0x%02X", byte(ev.Code))
+		}
+		if n > 0 {
+			ev.Data = data[i : i+n]
+		}
+		events = append(events, ev)
+		i += n
+	}
+	return events, nil
+}
+
+// readAmount reads four bytes value and three bytes currency
+func readAmount(data []byte) Amount {
+	return Amount{
+		Value:    binary.LittleEndian.Uint32(data[0:4]),
+		Currency: string(data[4:7]),
+	}
+}
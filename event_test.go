@@ -0,0 +1,78 @@
+package itlssp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDecodeEvents(t *testing.T) {
+	var table = []struct {
+		src []byte
+		exp []Event
+	}{
+		{[]byte{}, nil},
+		{[]byte{0xF1, 0xE8}, []Event{{Code: SspEventSlaveReset}, {Code: SspEventDisabled}}},
+		{[]byte{0xEF, 0x02, 0xEE, 0x02}, []Event{
+			{Code: SspEventRead, Channel: 2, Data: []byte{0x02}},
+			{Code: SspEventCredit, Channel: 2, Data: []byte{0x02}},
+		}},
+		{[]byte{0xDA, 0x01, 0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R'}, []Event{
+			{Code: SspEventDispensing, Amounts: []Amount{{Value: 1000, Currency: "EUR"}},
+				Data: []byte{0x01, 0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R'}},
+		}},
+		{[]byte{0xDC, 0x01, 0xF4, 0x01, 0x00, 0x00, 0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R', 0xE8}, []Event{
+			{Code: SspEventIncompletePayout, Amounts: []Amount{{Value: 500, Requested: 1000, Currency: "EUR"}},
+				Data: []byte{0x01, 0xF4, 0x01, 0x00, 0x00, 0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R'}},
+			{Code: SspEventDisabled},
+		}},
+	}
+
+	for _, v := range table {
+		r, err := DecodeEvents(v.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r, v.exp) {
+			t.Errorf("DecodeEvents failed, expected %v, got %v", v.exp, r)
+		}
+	}
+}
+
+func TestDecodeUnknownEvent(t *testing.T) {
+	var table = []struct {
+		src []byte
+		exp []Event
+	}{
+		{[]byte{0x42}, []Event{{Code: SspEvent(0x42)}}},
+		{[]byte{0x42, 0x10, 0xEE, 0x05, 0x00}, []Event{{Code: SspEvent(0x42), Data: []byte{0x10, 0xEE, 0x05, 0x00}}}},
+		{[]byte{0xEF, 0x02, 0x42, 0xEE, 0x03}, []Event{
+			{Code: SspEventRead, Channel: 2, Data: []byte{0x02}},
+			{Code: SspEvent(0x42), Data: []byte{0xEE, 0x03}},
+		}},
+	}
+
+	for _, v := range table {
+		r, err := DecodeEvents(v.src)
+		if errors.Cause(err) != ErrUnknownEvent {
+			t.Errorf("DecodeEvents failed, expected %v, got %v", ErrUnknownEvent, err)
+		}
+		if !reflect.DeepEqual(r, v.exp) {
+			t.Errorf("DecodeEvents failed, expected %v, got %v", v.exp, r)
+		}
+	}
+}
+
+func TestDecodeEventsError(t *testing.T) {
+	var table = [][]byte{
+		{0xEF},
+		{0xDA, 0x02, 0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R'},
+	}
+
+	for _, v := range table {
+		if _, err := DecodeEvents(v); err == nil {
+			t.Errorf("DecodeEvents failed, expected error for %X", v)
+		}
+	}
+}
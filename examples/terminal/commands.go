@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charoit/itlssp"
+)
+
+func init() {
+	commands["scan"] = &command{usage: "probe ports for devices", run: scan}
+	commands["info"] = &command{usage: "show device identity and setup", run: info}
+	commands["enable"] = &command{usage: "enable the device", run: func(opt *options, args []string) error {
+		return simple(opt, func(dev generic) error { return dev.Enable() })
+	}}
+	commands["disable"] = &command{usage: "disable the device", run: func(opt *options, args []string) error {
+		return simple(opt, func(dev generic) error { return dev.Disable() })
+	}}
+	commands["reset"] = &command{usage: "reset the device", run: func(opt *options, args []string) error {
+		return simple(opt, func(dev generic) error { return dev.Reset() })
+	}}
+	commands["inhibit"] = &command{usage: "<mask|channels> set enabled channels, hex mask 0x7F or list 1,2,5", run: inhibit}
+	commands["route"] = &command{usage: "<value> <currency> [payout|cashbox] show or set the denomination route", run: route}
+	commands["levels"] = &command{usage: "show stored notes of the payout", run: levels}
+	commands["empty"] = &command{usage: "move stored notes to the cashbox", flags: emptyFlags, run: empty}
+	commands["counters"] = &command{usage: "show note counters", flags: countersFlags, run: counters}
+	commands["raw"] = &command{usage: "<hex> send an arbitrary command, e.g. 0A or 3301", run: raw}
+	commands["poll"] = &command{usage: "poll events", flags: pollFlags, run: poll}
+	commands["payout"] = &command{usage: "<amount> <currency> pay out the amount", flags: testFlags, run: payoutAmount}
+	commands["float"] = &command{usage: "<amount> <currency> keep the amount, move the rest to the cashbox",
+		flags: floatFlags, run: floatAmount}
+}
+
+// generic is the device API of the commands that work with every device type
+type generic interface {
+	session
+	Enable() error
+	Disable() error
+	Reset() error
+	Info() (*itlssp.Info, error)
+	Poll() ([]itlssp.Event, error)
+	GetCounters() (*itlssp.Counters, error)
+	ResetCounters() error
+	SendCommand(data []byte) ([]byte, error)
+}
+
+// subcommand flags
+var (
+	follow     bool
+	interval   time.Duration
+	test       bool
+	minPayout  uint
+	smart      bool
+	resetAfter bool
+)
+
+func pollFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&follow, "follow", false, "keep polling until interrupted")
+	fs.DurationVar(&interval, "interval", 200*time.Millisecond, "poll interval with --follow")
+}
+
+func testFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&test, "test", false, "check the device can pay without paying")
+}
+
+func floatFlags(fs *flag.FlagSet) {
+	testFlags(fs)
+	fs.UintVar(&minPayout, "min", 100, "minimum payout value")
+}
+
+func emptyFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&smart, "smart", false, "smart empty, counts the emptied value")
+}
+
+func countersFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&resetAfter, "reset", false, "reset the counters after reading")
+}
+
+// simple connects the generic device and runs the action
+func simple(opt *options, action func(dev generic) error) error {
+	var dev generic = itlssp.NewGeneric(nil)
+	if err := connect(opt, dev); err != nil {
+		return err
+	}
+	defer dev.Close()
+	if err := action(dev); err != nil {
+		return err
+	}
+	return output(map[string]bool{"Ok": true})
+}
+
+func scan(opt *options, args []string) error {
+	cfg := &itlssp.DiscoverConfig{Bauds: []int{opt.baud}}
+	if opt.port != "" {
+		cfg.Ports = []string{opt.port}
+	}
+	type result struct {
+		Port    string
+		Devices []*itlssp.SSPDevice
+		Error   string `json:",omitempty"`
+	}
+	var res []result
+	for _, r := range itlssp.Discover(context.Background(), cfg) {
+		v := result{Port: r.Port, Devices: r.Devices}
+		if r.Err != nil {
+			v.Error = r.Err.Error()
+		}
+		res = append(res, v)
+	}
+	return output(res)
+}
+
+func info(opt *options, args []string) error {
+	var dev generic = itlssp.NewGeneric(nil)
+	if err := connect(opt, dev); err != nil {
+		return err
+	}
+	defer dev.Close()
+	res, err := dev.Info()
+	if err != nil {
+		return err
+	}
+	return output(res)
+}
+
+func poll(opt *options, args []string) error {
+	var dev generic = itlssp.NewGeneric(nil)
+	if err := connect(opt, dev); err != nil {
+		return err
+	}
+	defer dev.Close()
+	for {
+		events, err := dev.Poll()
+		if err != nil {
+			return err
+		}
+		for i := range events {
+			output(&events[i])
+		}
+		if !follow {
+			return nil
+		}
+		time.Sleep(interval)
+	}
+}
+
+func inhibit(opt *options, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("inhibit needs the mask or the channel list")
+	}
+	mask, err := parseInhibits(args[0])
+	if err != nil {
+		return err
+	}
+	dev := itlssp.NewValidator(nil)
+	if err = connect(opt, dev); err != nil {
+		return err
+	}
+	defer dev.Close()
+	if err = dev.SetInhibits(mask); err != nil {
+		return err
+	}
+	return output(map[string]uint16{"Inhibits": mask})
+}
+
+// parseInhibits reads the hex mask or the list of enabled channels
+func parseInhibits(s string) (uint16, error) {
+	if strings.HasPrefix(s, "0x") {
+		v, err := strconv.ParseUint(s[2:], 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid mask %q", s)
+		}
+		return uint16(v), nil
+	}
+	var mask uint16
+	for _, f := range strings.Split(s, ",") {
+		ch, err := strconv.ParseUint(strings.TrimSpace(f), 10, 8)
+		if err != nil || ch < 1 || ch > 16 {
+			return 0, fmt.Errorf("invalid channel %q", f)
+		}
+		mask |= 1 << (ch - 1)
+	}
+	return mask, nil
+}
+
+func route(opt *options, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return fmt.Errorf("route needs the value, the currency and optionally the route")
+	}
+	value, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return err
+	}
+	dev := itlssp.NewPayout(nil)
+	if err = connect(opt, dev); err != nil {
+		return err
+	}
+	defer dev.Close()
+	if len(args) == 3 {
+		r := itlssp.RouteCashbox
+		switch args[2] {
+		case "payout":
+			r = itlssp.RoutePayout
+		case "cashbox":
+		default:
+			return fmt.Errorf("unknown route %q", args[2])
+		}
+		if err = dev.SetDenominationRoute(r, uint32(value), args[1]); err != nil {
+			return err
+		}
+	}
+	r, err := dev.GetDenominationRoute(uint32(value), args[1])
+	if err != nil {
+		return err
+	}
+	return output(map[string]interface{}{"Value": value, "Currency": args[1], "Route": r.String()})
+}
+
+func levels(opt *options, args []string) error {
+	dev := itlssp.NewPayout(nil)
+	if err := connect(opt, dev); err != nil {
+		return err
+	}
+	defer dev.Close()
+	res, err := dev.GetAllLevels()
+	if err != nil {
+		return err
+	}
+	return output(res)
+}
+
+// amountArgs reads the amount and the currency
+func amountArgs(args []string) (uint32, string, error) {
+	if len(args) != 2 {
+		return 0, "", fmt.Errorf("the amount and the currency are required")
+	}
+	v, err := strconv.ParseUint(args[0], 10, 32)
+	return uint32(v), args[1], err
+}
+
+// rawArgs reads the command bytes in hex, split in any number of arguments
+func rawArgs(args []string) ([]byte, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("raw needs the command in hex")
+	}
+	data, err := hex.DecodeString(strings.Join(args, ""))
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid command %q", strings.Join(args, " "))
+	}
+	return data, nil
+}
+
+// payoutOption returns the option of the --test flag
+func payoutOption() itlssp.PayoutOption {
+	if test {
+		return itlssp.PayoutTest
+	}
+	return itlssp.PayoutReal
+}
+
+func payoutAmount(opt *options, args []string) error {
+	amount, currency, err := amountArgs(args)
+	if err != nil {
+		return err
+	}
+	dev := itlssp.NewPayout(nil)
+	if err = connect(opt, dev); err != nil {
+		return err
+	}
+	defer dev.Close()
+	if err = dev.EnablePayout(); err != nil {
+		return err
+	}
+	res, err := dev.PayoutAmount(amount, currency, payoutOption())
+	if err != nil {
+		return err
+	}
+	return output(res)
+}
+
+func floatAmount(opt *options, args []string) error {
+	amount, currency, err := amountArgs(args)
+	if err != nil {
+		return err
+	}
+	dev := itlssp.NewPayout(nil)
+	if err = connect(opt, dev); err != nil {
+		return err
+	}
+	defer dev.Close()
+	if err = dev.EnablePayout(); err != nil {
+		return err
+	}
+	res, err := dev.FloatAmount(uint16(minPayout), amount, currency, payoutOption())
+	if err != nil {
+		return err
+	}
+	return output(res)
+}
+
+func empty(opt *options, args []string) error {
+	dev := itlssp.NewPayout(nil)
+	if err := connect(opt, dev); err != nil {
+		return err
+	}
+	defer dev.Close()
+	var err error
+	if smart {
+		err = dev.SmartEmpty()
+	} else {
+		err = dev.EmptyAll()
+	}
+	if err != nil {
+		return err
+	}
+	return output(map[string]bool{"Ok": true})
+}
+
+func counters(opt *options, args []string) error {
+	var dev generic = itlssp.NewGeneric(nil)
+	if err := connect(opt, dev); err != nil {
+		return err
+	}
+	defer dev.Close()
+	res, err := dev.GetCounters()
+	if err != nil {
+		return err
+	}
+	if resetAfter {
+		if err = dev.ResetCounters(); err != nil {
+			return err
+		}
+	}
+	return output(res)
+}
+
+func raw(opt *options, args []string) error {
+	data, err := rawArgs(args)
+	if err != nil {
+		return err
+	}
+	var dev generic = itlssp.NewGeneric(nil)
+	if err = connect(opt, dev); err != nil {
+		return err
+	}
+	defer dev.Close()
+	res, err := dev.SendCommand(data)
+	var resp *itlssp.ResponseError
+	if errors.As(err, &resp) {
+		res = append([]byte{byte(resp.Code)}, resp.Data...)
+	} else if err != nil {
+		return err
+	}
+	return output(map[string]string{
+		"Command":  itlssp.SspCommand(data[0]).String(),
+		"Response": itlssp.SSPResponse(res[0]).String(),
+		"Data":     fmt.Sprintf("%X", res),
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseInhibits(t *testing.T) {
+	var table = []struct {
+		src  string
+		mask uint16
+		fail bool
+	}{
+		{"0x0005", 0x0005, false},
+		{"0xFFFF", 0xFFFF, false},
+		{"1", 0x0001, false},
+		{"1,3", 0x0005, false},
+		{"2, 16", 0x8002, false},
+		{"0x1FFFF", 0, true},
+		{"0", 0, true},
+		{"17", 0, true},
+		{"1,a", 0, true},
+		{"", 0, true},
+	}
+
+	for _, v := range table {
+		mask, err := parseInhibits(v.src)
+		if (err != nil) != v.fail || mask != v.mask {
+			t.Errorf("parseInhibits(%q) failed, expected %04X (error %v), got %04X (%v)", v.src, v.mask, v.fail, mask, err)
+		}
+	}
+}
+
+func TestAmountArgs(t *testing.T) {
+	var table = []struct {
+		args     []string
+		amount   uint32
+		currency string
+		fail     bool
+	}{
+		{[]string{"1500", "EUR"}, 1500, "EUR", false},
+		{[]string{"0", "GBP"}, 0, "GBP", false},
+		{[]string{"1500"}, 0, "", true},
+		{[]string{"1500", "EUR", "x"}, 0, "", true},
+		{[]string{"-5", "EUR"}, 0, "EUR", true},
+		{[]string{"4294967296", "EUR"}, 4294967295, "EUR", true},
+	}
+
+	for _, v := range table {
+		amount, currency, err := amountArgs(v.args)
+		if (err != nil) != v.fail || amount != v.amount || currency != v.currency {
+			t.Errorf("amountArgs(%q) failed, expected %d %s (error %v), got %d %s (%v)",
+				v.args, v.amount, v.currency, v.fail, amount, currency, err)
+		}
+	}
+}
+
+func TestRawArgs(t *testing.T) {
+	var table = []struct {
+		args []string
+		data []byte
+		fail bool
+	}{
+		{[]string{"07"}, []byte{0x07}, false},
+		{[]string{"33", "0500"}, []byte{0x33, 0x05, 0x00}, false},
+		{[]string{"0a0B"}, []byte{0x0A, 0x0B}, false},
+		{nil, nil, true},
+		{[]string{""}, nil, true},
+		{[]string{"7"}, nil, true},
+		{[]string{"zz"}, nil, true},
+	}
+
+	for _, v := range table {
+		data, err := rawArgs(v.args)
+		if (err != nil) != v.fail || !bytes.Equal(data, v.data) {
+			t.Errorf("rawArgs(%q) failed, expected % X (error %v), got % X (%v)", v.args, v.data, v.fail, data, err)
+		}
+	}
+}
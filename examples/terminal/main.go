@@ -1,8 +1,23 @@
+// Command sspctl controls SSP devices from the command line. Every
+// subcommand takes the connection flags and prints JSON, without
+// a subcommand it starts the interactive shell:
+//
+//	sspctl shell --port /dev/ttyUSB0
+//	sspctl info --port /dev/ttyUSB0
+//	sspctl poll --follow --key 0123456701234567
+//	sspctl payout --addr 16 1000 EUR
+//
+// The shell needs a terminal of Linux, macOS or BSD. On Windows the
+// subcommands work, the shell reports that the terminal is not supported.
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"os"
-	"time"
+	"sort"
+	"strconv"
 
 	"github.com/charoit/itlssp"
 	"github.com/rs/zerolog"
@@ -10,35 +25,128 @@ import (
 	"github.com/tarm/serial"
 )
 
-func main() {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-	log.Info().Msg("Start driver")
+// options are the connection flags of every subcommand
+type options struct {
+	port     string
+	addr     uint
+	baud     int
+	key      string
+	protocol uint
+}
 
-	//log.Info().Interface("Ports", itl.AvailablePorts()).Send()
-	//log.Info().Interface("Devices", itl.SearchSSPDevices()).Send()
+func (this *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&this.port, "port", "", "serial port, the first available port if empty")
+	fs.UintVar(&this.addr, "addr", uint(itlssp.AddrValidator), "SSP address of the device")
+	fs.IntVar(&this.baud, "baud", 9600, "baud rate")
+	fs.StringVar(&this.key, "key", "", "eSSP fixed key in hex, plain SSP if empty")
+	fs.UintVar(&this.protocol, "protocol", 7, "host protocol version")
+}
 
-	ports := itlssp.AvailablePorts()
-	cfg := &serial.Config{
-		Name:        ports[0].Name,
-		Baud:        9600,
-		ReadTimeout: time.Microsecond * 500,
-		Size:        8,
-		Parity:      0,
-		StopBits:    2,
+// session is the connection part of the device types
+type session interface {
+	SetAddress(addr byte)
+	Open(cfg *serial.Config) error
+	Close() error
+	Sync() error
+	HostProtocolVersion(version byte) error
+	NegotiateKeys(fixed uint64) error
+}
+
+// command is a subcommand, run gets the arguments after the flags
+type command struct {
+	usage string
+	flags func(fs *flag.FlagSet)
+	run   func(opt *options, args []string) error
+}
+
+var commands = map[string]*command{}
+
+func main() {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	if len(os.Args) < 2 {
+		os.Args = append(os.Args, "shell")
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	opt := &options{}
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	opt.register(fs)
+	if cmd.flags != nil {
+		cmd.flags(fs)
 	}
-	gen := itlssp.NewGeneric(cfg)
-	if err := gen.Open(cfg); err != nil {
-		log.Fatal().Err(err).Send()
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: sspctl %s [flags] %s\n", os.Args[1], cmd.usage)
+		fs.PrintDefaults()
 	}
-	defer gen.Close()
+	fs.Parse(os.Args[2:])
+	if err := cmd.run(opt, fs.Args()); err != nil {
+		log.Fatal().Err(err).Msg(os.Args[1])
+	}
+}
 
-	if err := gen.HostProtocolVersion(); err != nil {
-		log.Fatal().Err(err).Send()
+func usage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "usage: sspctl <command> [flags] [args]")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
 	}
+	os.Exit(2)
+}
 
-	//c := gen.Pkg([]byte{0x06,0x06})
-	//fmt.Printf("%X\n",c)
-	//c = gen.Pkg([]byte{0x06,0x06})
-	//fmt.Printf("%X\n",c)
+// connect opens the port and synchronizes with the device, sets the protocol
+// version and negotiates eSSP keys when the key is set
+func connect(opt *options, dev session) error {
+	name := opt.port
+	if name == "" {
+		ports := itlssp.AvailablePorts()
+		if len(ports) == 0 {
+			return itlssp.ErrNoDeviceFound
+		}
+		name = ports[0].Name
+	}
+	cfg := itlssp.PortConfig(name, opt.baud)
+	dev.SetAddress(byte(opt.addr))
+	if err := dev.Open(cfg); err != nil {
+		return err
+	}
+	if err := dev.Sync(); err != nil {
+		dev.Close()
+		return err
+	}
+	if err := dev.HostProtocolVersion(byte(opt.protocol)); err != nil {
+		dev.Close()
+		return err
+	}
+	if opt.key != "" {
+		key, err := strconv.ParseUint(opt.key, 16, 64)
+		if err != nil {
+			dev.Close()
+			return err
+		}
+		if err = dev.NegotiateKeys(key); err != nil {
+			dev.Close()
+			return err
+		}
+	}
+	return nil
+}
 
+// output prints the value as JSON, values with JSON String are printed as is
+func output(v interface{}) error {
+	if s, ok := v.(fmt.Stringer); ok {
+		fmt.Println(s.String())
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
 }
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "os"
+
+// notifyResize does nothing, the interactive shell needs a Unix terminal
+func notifyResize(c chan os.Signal) {}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charoit/itlssp"
+	"github.com/charoit/itlssp/internal/term"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	historyFile = ".sspctl_history"
+	historySize = 1000
+	prompt      = "ssp> "
+)
+
+const shellHelp = `Commands are SspCommand names with hex arguments, Tab completes names:
+  SETUP_REQUEST             SET_INHIBITS FF FF         0A (raw hex)
+Built-in commands:
+  poll on|off               start or stop the live event pane
+  info, counters            show device identity or note counters
+  clear                     clear the event pane
+  help, quit`
+
+func init() {
+	commands["shell"] = &command{usage: "interactive shell with live events, the default command", run: runShell}
+}
+
+// shell is the interactive terminal: the event pane scrolls above the
+// prompt line, the device is polled in the background
+type shell struct {
+	dev      generic
+	mu       sync.Mutex // device and screen
+	out      io.Writer
+	cols     int
+	rows     int
+	line     []rune
+	pos      int
+	history  []string
+	hpos     int
+	histPath string
+	polling  bool
+	names    map[string]byte
+	words    []string
+}
+
+func runShell(opt *options, args []string) error {
+	var dev generic = itlssp.NewGeneric(nil)
+	if err := connect(opt, dev); err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	defer term.Restore(int(os.Stdin.Fd()), state)
+
+	sh := newShell(dev, os.Stdout)
+	// debug lines of every poll would overwrite the prompt, warnings go to
+	// the event pane
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: paneWriter{sh}, NoColor: true}).With().Timestamp().Logger()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	defer func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	}()
+	if home, err := os.UserHomeDir(); err == nil {
+		sh.histPath = filepath.Join(home, historyFile)
+		sh.loadHistory()
+	}
+	sh.resize()
+	defer sh.leave()
+
+	winch := make(chan os.Signal, 1)
+	notifyResize(winch)
+	go func() {
+		for range winch {
+			sh.mu.Lock()
+			sh.resize()
+			sh.mu.Unlock()
+		}
+	}()
+	go sh.pollLoop(250 * time.Millisecond)
+	return sh.run(bufio.NewReader(os.Stdin))
+}
+
+func newShell(dev generic, out io.Writer) *shell {
+	this := &shell{dev: dev, out: out, polling: true, names: make(map[string]byte), cols: 80, rows: 24}
+	for c := 0; c < 0x100; c++ {
+		name := itlssp.SspCommand(c).String()
+		if name == itlssp.SspCommand(0xFF).String() || strings.HasSuffix(name, "RESPONSE") {
+			continue
+		}
+		word := strings.Replace(strings.TrimSuffix(name, " COMMAND"), " ", "_", -1)
+		this.names[word] = byte(c)
+		this.words = append(this.words, word)
+	}
+	this.words = append(this.words, "help", "quit", "poll", "info", "counters", "clear")
+	sort.Strings(this.words)
+	return this
+}
+
+// resize reads the terminal size and draws the layout
+func (this *shell) resize() {
+	if cols, rows, err := term.Size(int(os.Stdin.Fd())); err == nil && rows > 3 {
+		this.cols, this.rows = cols, rows
+	}
+	fmt.Fprintf(this.out, "\x1b[2J\x1b[1;%dr", this.rows-2)
+	title := " events (poll on/off, Tab completes, help) "
+	bar := strings.Repeat("-", 2) + title
+	if n := this.cols - len(bar); n > 0 {
+		bar += strings.Repeat("-", n)
+	}
+	fmt.Fprintf(this.out, "\x1b[%d;1H%s", this.rows-1, bar[:min(len(bar), this.cols)])
+	this.drawPrompt()
+}
+
+// leave resets the scroll region and moves below the layout
+func (this *shell) leave() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	fmt.Fprintf(this.out, "\x1b[r\x1b[%d;1H\r\n", this.rows)
+}
+
+// drawPrompt redraws the input line and places the cursor
+func (this *shell) drawPrompt() {
+	fmt.Fprintf(this.out, "\x1b[%d;1H\x1b[K%s%s\x1b[%d;%dH", this.rows, prompt, string(this.line),
+		this.rows, len(prompt)+this.pos+1)
+}
+
+// printf adds the line to the event pane, the caller holds the lock
+func (this *shell) printf(format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	for _, l := range strings.Split(text, "\n") {
+		fmt.Fprintf(this.out, "\x1b7\x1b[%d;1H\n%s\x1b8", this.rows-2, l)
+	}
+}
+
+// paneWriter prints log lines to the event pane. The device logs only
+// while the shell lock is held, so the writer does not take it.
+type paneWriter struct {
+	sh *shell
+}
+
+func (this paneWriter) Write(p []byte) (int, error) {
+	this.sh.printf("%s", strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// pollLoop polls the device and prints events while polling is on
+func (this *shell) pollLoop(interval time.Duration) {
+	var failed bool
+	for range time.Tick(interval) {
+		this.mu.Lock()
+		if this.polling {
+			events, err := this.dev.Poll()
+			if err != nil && !failed {
+				this.printf("%s poll failed: %v", time.Now().Format("15:04:05.000"), err)
+			}
+			failed = err != nil
+			for i := range events {
+				if events[i].Code != itlssp.SspEventDisabled {
+					this.printf("%s %s", time.Now().Format("15:04:05.000"), &events[i])
+				}
+			}
+		}
+		this.mu.Unlock()
+	}
+}
+
+// run edits the input line until quit, Ctrl-C or Ctrl-D
+func (this *shell) run(in *bufio.Reader) error {
+	for {
+		r, _, err := in.ReadRune()
+		if err != nil {
+			return nil
+		}
+		this.mu.Lock()
+		quit := this.key(r, in)
+		this.drawPrompt()
+		this.mu.Unlock()
+		if quit {
+			return nil
+		}
+	}
+}
+
+// key applies the key to the input line, reports whether to quit
+func (this *shell) key(r rune, in *bufio.Reader) bool {
+	switch r {
+	case 0x03:
+		return true
+	case 0x04:
+		return len(this.line) == 0
+	case '\r', '\n':
+		line := strings.TrimSpace(string(this.line))
+		this.line, this.pos = nil, 0
+		if line == "" {
+			return false
+		}
+		this.addHistory(line)
+		return this.execute(line)
+	case 0x7F, 0x08:
+		if this.pos > 0 {
+			this.line = append(this.line[:this.pos-1], this.line[this.pos:]...)
+			this.pos--
+		}
+	case 0x15:
+		this.line, this.pos = nil, 0
+	case '\t':
+		this.complete()
+	case 0x1B:
+		// the terminal writes an escape sequence at once, an Esc without the
+		// buffered sequence is a bare Esc key and must not wait for more input
+		if b, _ := in.Peek(in.Buffered()); len(b) < 2 || b[0] != '[' {
+			return false
+		}
+		in.ReadByte()
+		switch b, _ := in.ReadByte(); b {
+		case 'A':
+			this.recall(-1)
+		case 'B':
+			this.recall(1)
+		case 'C':
+			if this.pos < len(this.line) {
+				this.pos++
+			}
+		case 'D':
+			if this.pos > 0 {
+				this.pos--
+			}
+		}
+	default:
+		if r >= 0x20 {
+			this.line = append(this.line[:this.pos], append([]rune{r}, this.line[this.pos:]...)...)
+			this.pos++
+		}
+	}
+	return false
+}
+
+// complete completes the command name before the cursor
+func (this *shell) complete() {
+	prefix := strings.ToUpper(string(this.line[:this.pos]))
+	if strings.Contains(prefix, " ") {
+		return
+	}
+	var found []string
+	for _, w := range this.words {
+		if strings.HasPrefix(strings.ToUpper(w), prefix) {
+			found = append(found, w)
+		}
+	}
+	if len(found) == 0 {
+		return
+	}
+	common := found[0]
+	for _, w := range found[1:] {
+		for !strings.HasPrefix(strings.ToUpper(w), strings.ToUpper(common)) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(found) == 1 {
+		common += " "
+	} else if len(common) == len(prefix) {
+		this.printf("%s", strings.Join(found, "  "))
+	}
+	if len(common) >= len(prefix) {
+		this.line = append([]rune(common), this.line[this.pos:]...)
+		this.pos = len(common)
+	}
+}
+
+// execute runs the built-in or the device command, reports whether to quit
+func (this *shell) execute(line string) bool {
+	fields := strings.Fields(line)
+	switch strings.ToLower(fields[0]) {
+	case "quit", "exit":
+		return true
+	case "help":
+		this.printf("%s", shellHelp)
+		return false
+	case "clear":
+		fmt.Fprintf(this.out, "\x1b7\x1b[1;1H\x1b[1J\x1b[%d;1H\x1b[1J\x1b8", this.rows-2)
+		return false
+	case "poll":
+		this.polling = len(fields) < 2 || fields[1] != "off"
+		this.printf("polling %v", this.polling)
+		return false
+	case "info":
+		info, err := this.dev.Info()
+		this.result(info, err)
+		return false
+	case "counters":
+		counters, err := this.dev.GetCounters()
+		this.result(counters, err)
+		return false
+	}
+
+	data, err := this.parse(fields)
+	if err != nil {
+		this.printf("error: %v", err)
+		return false
+	}
+	this.printf("> %s %X", itlssp.SspCommand(data[0]), data)
+	res, err := this.dev.SendCommand(data)
+	var resp *itlssp.ResponseError
+	if errors.As(err, &resp) {
+		res = append([]byte{byte(resp.Code)}, resp.Data...)
+	} else if err != nil {
+		this.printf("error: %v", err)
+		return false
+	}
+	this.printf("< %s %X", itlssp.SSPResponse(res[0]), res)
+	if data[0] == byte(itlssp.SspCmdPoll) && len(res) > 1 {
+		events, _ := itlssp.DecodeEvents(res[1:])
+		for i := range events {
+			this.printf("  %s", &events[i])
+		}
+	}
+	return false
+}
+
+// result prints the JSON result or the error
+func (this *shell) result(v interface{}, err error) {
+	if err == nil {
+		if s, ok := v.(fmt.Stringer); ok {
+			this.printf("%s", s)
+			return
+		}
+		var data []byte
+		if data, err = json.Marshal(v); err == nil {
+			this.printf("%s", data)
+			return
+		}
+	}
+	this.printf("error: %v", err)
+}
+
+// parse returns the command data of the name or the hex code and hex arguments
+func (this *shell) parse(fields []string) ([]byte, error) {
+	var data []byte
+	if code, ok := this.names[strings.ToUpper(fields[0])]; ok {
+		data = []byte{code}
+	} else if b, err := hex.DecodeString(fields[0]); err == nil && len(b) > 0 {
+		data = b
+	} else {
+		return nil, fmt.Errorf("unknown command %q", fields[0])
+	}
+	for _, f := range fields[1:] {
+		b, err := hex.DecodeString(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex argument %q", f)
+		}
+		data = append(data, b...)
+	}
+	return data, nil
+}
+
+// recall moves in the history
+func (this *shell) recall(step int) {
+	if len(this.history) == 0 {
+		return
+	}
+	this.hpos += step
+	if this.hpos < 0 {
+		this.hpos = 0
+	}
+	if this.hpos >= len(this.history) {
+		this.hpos = len(this.history)
+		this.line, this.pos = nil, 0
+		return
+	}
+	this.line = []rune(this.history[this.hpos])
+	this.pos = len(this.line)
+}
+
+// loadHistory reads the last commands of the history file
+func (this *shell) loadHistory() {
+	data, err := ioutil.ReadFile(this.histPath)
+	if err != nil {
+		return
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			this.history = append(this.history, l)
+		}
+	}
+	if len(this.history) > historySize {
+		this.history = this.history[len(this.history)-historySize:]
+	}
+	this.hpos = len(this.history)
+}
+
+// addHistory keeps the command and appends it to the history file
+func (this *shell) addHistory(line string) {
+	if n := len(this.history); n == 0 || this.history[n-1] != line {
+		this.history = append(this.history, line)
+		if this.histPath != "" {
+			if f, err := os.OpenFile(this.histPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err == nil {
+				fmt.Fprintln(f, line)
+				f.Close()
+			}
+		}
+	}
+	this.hpos = len(this.history)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
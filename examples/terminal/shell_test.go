@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShellParse(t *testing.T) {
+	sh := newShell(nil, ioutil.Discard)
+	var table = []struct {
+		line string
+		data []byte
+		fail bool
+	}{
+		{"SETUP_REQUEST", []byte{0x05}, false},
+		{"setup_request", []byte{0x05}, false},
+		{"SET_INHIBITS FF 00", []byte{0x02, 0xFF, 0x00}, false},
+		{"SET_INHIBITS FF00", []byte{0x02, 0xFF, 0x00}, false},
+		{"0A", []byte{0x0A}, false},
+		{"330500 00", []byte{0x33, 0x05, 0x00, 0x00}, false},
+		{"NO_SUCH", nil, true},
+		{"SET_INHIBITS F", nil, true},
+		{"SET_INHIBITS GG", nil, true},
+	}
+
+	for _, v := range table {
+		data, err := sh.parse(strings.Fields(v.line))
+		if (err != nil) != v.fail || !bytes.Equal(data, v.data) {
+			t.Errorf("parse(%q) failed, expected % X (error %v), got % X (%v)", v.line, v.data, v.fail, data, err)
+		}
+	}
+}
+
+func TestShellComplete(t *testing.T) {
+	var table = []struct {
+		line string
+		pos  int
+		exp  string
+	}{
+		{"SETUP_R", 7, "SETUP_REQUEST "},
+		{"setup_r", 7, "SETUP_REQUEST "},
+		{"SET_INH", 7, "SET_INHIBITS "},
+		{"hel", 3, "help "},
+		{"SET_", 4, "SET_"},
+		{"SET_DE", 6, "SET_DENOMINATION_ROUTE "},
+		{"GET_", 4, "GET_"},
+		{"XYZ", 3, "XYZ"},
+		{"POLL 0", 6, "POLL 0"},
+		{"SETUP_R 05", 7, "SETUP_REQUEST  05"},
+	}
+
+	for _, v := range table {
+		sh := newShell(nil, ioutil.Discard)
+		sh.line, sh.pos = []rune(v.line), v.pos
+		sh.complete()
+		if string(sh.line) != v.exp {
+			t.Errorf("complete(%q) failed, expected %q, got %q", v.line, v.exp, string(sh.line))
+		}
+	}
+}
+
+func TestShellRecall(t *testing.T) {
+	sh := newShell(nil, ioutil.Discard)
+	sh.recall(-1)
+	if len(sh.line) != 0 {
+		t.Errorf("recall failed, expected empty line, got %q", string(sh.line))
+	}
+	sh.history = []string{"SYNC", "POLL", "SETUP_REQUEST"}
+	sh.hpos = len(sh.history)
+
+	var table = []struct {
+		step int
+		exp  string
+	}{
+		{-1, "SETUP_REQUEST"},
+		{-1, "POLL"},
+		{-1, "SYNC"},
+		{-1, "SYNC"},
+		{1, "POLL"},
+		{1, "SETUP_REQUEST"},
+		{1, ""},
+		{1, ""},
+		{-1, "SETUP_REQUEST"},
+	}
+
+	for i, v := range table {
+		sh.recall(v.step)
+		if string(sh.line) != v.exp || sh.pos != len(sh.line) {
+			t.Errorf("%d: recall(%d) failed, expected %q, got %q at %d", i, v.step, v.exp, string(sh.line), sh.pos)
+		}
+	}
+}
+
+func TestShellHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sspctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sh := newShell(nil, ioutil.Discard)
+	sh.histPath = filepath.Join(dir, historyFile)
+	for _, l := range []string{"SYNC", "POLL", "POLL", "SETUP_REQUEST"} {
+		sh.addHistory(l)
+	}
+	exp := []string{"SYNC", "POLL", "SETUP_REQUEST"}
+	if !reflect.DeepEqual(sh.history, exp) || sh.hpos != len(exp) {
+		t.Errorf("addHistory failed, expected %q, got %q", exp, sh.history)
+	}
+
+	loaded := newShell(nil, ioutil.Discard)
+	loaded.histPath = sh.histPath
+	loaded.loadHistory()
+	if !reflect.DeepEqual(loaded.history, exp) || loaded.hpos != len(exp) {
+		t.Errorf("loadHistory failed, expected %q, got %q", exp, loaded.history)
+	}
+
+	// only the last historySize commands are loaded
+	var lines []string
+	for i := 0; i < historySize+10; i++ {
+		lines = append(lines, strings.Repeat("X", i%7+1))
+	}
+	if err = ioutil.WriteFile(sh.histPath, []byte(strings.Join(lines, "\n")+"\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded = newShell(nil, ioutil.Discard)
+	loaded.histPath = sh.histPath
+	loaded.loadHistory()
+	if len(loaded.history) != historySize || loaded.history[0] != lines[10] {
+		t.Errorf("loadHistory failed, expected %d commands, got %d", historySize, len(loaded.history))
+	}
+}
+
+func TestShellKey(t *testing.T) {
+	var table = []struct {
+		input string
+		line  string
+		pos   int
+	}{
+		{"abc", "abc", 3},
+		{"abc\x7F", "ab", 2},
+		{"abc\x1b[D\x1b[DX", "aXbc", 2},
+		{"abc\x1b[D\x1b[C", "abc", 3},
+		{"abc\x15", "", 0},
+		{"ab\x1bc", "abc", 3},
+	}
+
+	for _, v := range table {
+		sh := newShell(nil, ioutil.Discard)
+		in := bufio.NewReader(strings.NewReader(v.input))
+		for {
+			r, _, err := in.ReadRune()
+			if err != nil {
+				break
+			}
+			sh.key(r, in)
+		}
+		if string(sh.line) != v.line || sh.pos != v.pos {
+			t.Errorf("key(%q) failed, expected %q at %d, got %q at %d", v.input, v.line, v.pos, string(sh.line), sh.pos)
+		}
+	}
+}
+
+func TestShellBareEsc(t *testing.T) {
+	sh := newShell(nil, ioutil.Discard)
+	r, w := io.Pipe()
+	defer w.Close()
+	in := bufio.NewReader(r)
+	go w.Write([]byte{0x1B})
+
+	done := make(chan struct{})
+	go func() {
+		c, _, _ := in.ReadRune()
+		sh.key(c, in)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("key failed, expected a bare Esc to return, got blocked")
+	}
+}
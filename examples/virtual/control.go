@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/charoit/itlssp/simulator"
+	"github.com/rs/zerolog/log"
+)
+
+const controlHelp = `insert <channel>            insert a note of the channel
+invalid <reason>            insert a note rejected with the reason code
+jam [safe]                  jam the note, unsafe by default
+fraud <channel>             report fraud attempt
+cashbox                     remove and replace the cashbox
+full                        report stacker full
+reset                       power cycle the device
+level <channel> <n> [cash]  set stored notes, routed to payout unless cash
+queue <hex>                 report raw events on the next poll
+status                      show levels and counters`
+
+// serveControl accepts control connections and runs their commands
+func serveControl(l net.Listener, sim *simulator.Simulator) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			control(conn, sim)
+		}()
+	}
+}
+
+// control runs one command per line and answers OK, ERR or the status
+func control(rw io.ReadWriter, sim *simulator.Simulator) {
+	scanner := bufio.NewScanner(rw)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		res, err := command(sim, args)
+		if err != nil {
+			fmt.Fprintf(rw, "ERR %v\n", err)
+			continue
+		}
+		log.Info().Str("command", strings.Join(args, " ")).Msg("Control")
+		fmt.Fprintf(rw, "%sOK\n", res)
+	}
+}
+
+// command applies the control command to the simulator
+func command(sim *simulator.Simulator, args []string) (string, error) {
+	num := func(i int) (int, error) {
+		if len(args) <= i {
+			return 0, fmt.Errorf("%s: missing argument", args[0])
+		}
+		n, err := strconv.ParseUint(args[i], 0, 8)
+		return int(n), err
+	}
+	switch args[0] {
+	case "help":
+		return controlHelp + "\n", nil
+	case "insert":
+		ch, err := num(1)
+		if err != nil {
+			return "", err
+		}
+		sim.InsertNote(byte(ch))
+	case "invalid":
+		reason, err := num(1)
+		if err != nil {
+			return "", err
+		}
+		sim.InsertInvalidNote(byte(reason))
+	case "jam":
+		sim.Jam(len(args) > 1 && args[1] == "safe")
+	case "fraud":
+		ch, err := num(1)
+		if err != nil {
+			return "", err
+		}
+		sim.Fraud(byte(ch))
+	case "cashbox":
+		sim.RemoveCashbox()
+	case "full":
+		sim.StackerFull()
+	case "reset":
+		sim.PowerReset()
+	case "level":
+		ch, err := num(1)
+		if err != nil {
+			return "", err
+		}
+		if len(args) < 3 {
+			return "", fmt.Errorf("level: missing count")
+		}
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return "", err
+		}
+		sim.SetLevel(byte(ch), n, len(args) < 4 || args[3] != "cash")
+	case "queue":
+		if len(args) < 2 {
+			return "", fmt.Errorf("queue: missing events")
+		}
+		events, err := hex.DecodeString(strings.Join(args[1:], ""))
+		if err != nil {
+			return "", err
+		}
+		sim.Queue(events...)
+	case "status":
+		var b strings.Builder
+		for _, ch := range sim.Levels() {
+			fmt.Fprintf(&b, "%s\n", &ch)
+		}
+		c := sim.Counters()
+		fmt.Fprintf(&b, "%s\n", &c)
+		return b.String(), nil
+	default:
+		return "", fmt.Errorf("unknown command %q, try help", args[0])
+	}
+	return "", nil
+}
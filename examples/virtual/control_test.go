@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/charoit/itlssp"
+	"github.com/charoit/itlssp/simulator"
+)
+
+func TestControl(t *testing.T) {
+	sim := simulator.New(itlssp.SMARTPayout, "EUR", 500, 1000)
+	var table = []struct {
+		line string
+		out  string
+	}{
+		{"help", "insert <channel>"},
+		{"insert 1", "OK"},
+		{"insert", "ERR insert: missing argument"},
+		{"insert x", "ERR strconv.ParseUint"},
+		{"invalid 0x02", "OK"},
+		{"jam safe", "OK"},
+		{"fraud 2", "OK"},
+		{"cashbox", "OK"},
+		{"full", "OK"},
+		{"reset", "OK"},
+		{"level 2 4 cash", "OK"},
+		{"level 2", "ERR level: missing count"},
+		{"level 2 many", "ERR strconv.Atoi"},
+		{"level 300 1", "ERR strconv.ParseUint"},
+		{"queue E8 F1", "OK"},
+		{"queue", "ERR queue: missing events"},
+		{"queue E", "ERR encoding/hex"},
+		{"status", `"Value":1000,"Level":4,"Channel":2,"Recycling":false`},
+		{"pay 500", `ERR unknown command "pay", try help`},
+	}
+
+	for i, v := range table {
+		var out bytes.Buffer
+		control(struct {
+			io.Reader
+			io.Writer
+		}{strings.NewReader(v.line + "\n"), &out}, sim)
+		if !strings.Contains(out.String(), v.out) {
+			t.Errorf("%d: control(%q) failed, expected %q, got %q", i, v.line, v.out, out.String())
+		}
+	}
+}
@@ -0,0 +1,12 @@
+module github.com/charoit/itlssp/examples/virtual
+
+go 1.15
+
+require (
+	github.com/charoit/itlssp v0.0.0
+	github.com/rs/zerolog v1.20.0
+	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
+	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68 // indirect
+)
+
+replace github.com/charoit/itlssp => ../..
@@ -0,0 +1,105 @@
+// Command virtual serves an emulated NV200 or SMART Payout on a Linux
+// pseudo-terminal, so applications open it as a serial port. Events are
+// injected at runtime through the control socket, one command per line:
+//
+//	virtual -link /tmp/ttyUSB0 -control /tmp/virtual.sock
+//	echo "insert 2" | nc -U /tmp/virtual.sock
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/charoit/itlssp"
+	"github.com/charoit/itlssp/internal/pty"
+	"github.com/charoit/itlssp/simulator"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	device := flag.String("type", "validator", "emulated device: validator (NV200) or payout (SMART Payout)")
+	currency := flag.String("currency", "EUR", "currency of the channels")
+	values := flag.String("values", "500,1000,2000,5000,10000,20000,50000", "channel values in cents")
+	serial := flag.Uint("serial", 1000001, "serial number")
+	link := flag.String("link", "", "symlink to the pseudo-terminal, e.g. /tmp/ttyUSB0")
+	socket := flag.String("control", "/tmp/itlssp-virtual.sock", "control socket path")
+	scenario := flag.String("scenario", "", "JSON or YAML scenario file played once the port is ready")
+	flag.Parse()
+
+	sim := simulator.New(itlssp.Validator, *currency)
+	if *device == "payout" {
+		sim = simulator.New(itlssp.SMARTPayout, *currency)
+	} else if *device != "validator" {
+		log.Fatal().Str("type", *device).Msg("Unknown device type")
+	}
+	for i, v := range strings.Split(*values, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid channel value")
+		}
+		sim.Channels = append(sim.Channels, itlssp.Channel{
+			Value:    value,
+			Channel:  byte(i + 1),
+			Currency: []byte(*currency),
+		})
+	}
+	sim.Serial = uint32(*serial)
+
+	master, slave, err := pty.Open()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Open pseudo-terminal")
+	}
+	defer master.Close()
+	defer slave.Close()
+	port := slave.Name()
+	if *link != "" {
+		os.Remove(*link)
+		if err = os.Symlink(port, *link); err != nil {
+			log.Fatal().Err(err).Msg("Link pseudo-terminal")
+		}
+		defer os.Remove(*link)
+		port = *link
+	}
+
+	os.Remove(*socket)
+	l, err := net.Listen("unix", *socket)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Listen control socket")
+	}
+	defer l.Close()
+	go serveControl(l, sim)
+
+	go func() {
+		if err := sim.Serve(master); err != nil {
+			log.Error().Err(err).Msg("Serve pseudo-terminal")
+		}
+	}()
+	log.Info().Str("port", port).Str("control", *socket).Str("type", *device).Msg("Virtual device ready")
+
+	if *scenario != "" {
+		sc, err := simulator.LoadScenario(*scenario)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Load scenario")
+		}
+		go func() {
+			if err := sim.Play(context.Background(), sc); err != nil {
+				log.Error().Err(err).Msg("Scenario failed")
+				return
+			}
+			log.Info().Str("scenario", sc.Name).Msg("Scenario passed")
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+}
@@ -0,0 +1,111 @@
+package itlssp
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// EncodeFrame packs data into SSP frame: STX, SEQ/ID, LEN, data and CRC,
+// every STX byte after the first one is stuffed
+func EncodeFrame(id byte, data []byte) []byte {
+	body := append([]byte{id, byte(len(data))}, data...)
+	body = append(body, crc16Bytes(body)...)
+	return append([]byte{xSTX}, stuffSTX(body)...)
+}
+
+// StuffFrame returns the unstuffed frame as it is sent on the line
+func StuffFrame(frame []byte) []byte {
+	if len(frame) == 0 {
+		return nil
+	}
+	return append([]byte{frame[0]}, stuffSTX(frame[1:])...)
+}
+
+// DecodeFrame checks unstuffed frame and returns its SEQ/ID byte and data
+func DecodeFrame(frame []byte) (byte, []byte, error) {
+	if len(frame) < 6 {
+		return 0, nil, errors.Errorf("Invalid data packet size (%d): %X", len(frame), frame)
+	}
+	if frame[0] != xSTX || int(frame[2])+5 != len(frame) {
+		return 0, nil, errors.Errorf("Invalid data packet format: %X", frame)
+	}
+	crc := crc16Bytes(frame[1 : len(frame)-2])
+	if frame[len(frame)-2] != crc[0] || frame[len(frame)-1] != crc[1] {
+		return 0, nil, errors.Errorf("Invalid packet checksum 0x%02X%02X", frame[len(frame)-1], frame[len(frame)-2])
+	}
+	return frame[1], frame[3 : len(frame)-2], nil
+}
+
+// ReadFrame reads the next frame and returns it unstuffed. Bytes before
+// STX are skipped, a single STX inside the frame starts a new frame.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var s frameScanner
+	for {
+		b, err := readByte(r)
+		if err != nil {
+			return nil, err
+		}
+		if frame := s.feed(b); frame != nil {
+			return frame, nil
+		}
+	}
+}
+
+// frameScanner splits the byte stream of a line into unstuffed frames
+type frameScanner struct {
+	frame   []byte
+	stuffed bool
+}
+
+// feed adds the byte and returns the frame it completes
+func (this *frameScanner) feed(b byte) []byte {
+	if this.frame == nil {
+		if b == xSTX {
+			this.frame = []byte{xSTX}
+		}
+		return nil
+	}
+	if b == xSTX && !this.stuffed {
+		this.stuffed = true
+		return nil
+	}
+	if this.stuffed && b != xSTX {
+		this.frame = []byte{xSTX}
+	}
+	this.stuffed = false
+	this.frame = append(this.frame, b)
+	if len(this.frame) > 2 && len(this.frame) == int(this.frame[2])+5 {
+		frame := this.frame
+		this.frame = nil
+		return frame
+	}
+	return nil
+}
+
+// readByte reads one byte, a port returns io.EOF on read timeout
+func readByte(r io.Reader) (byte, error) {
+	var b [1]byte
+	for i := 0; i < 100; i++ {
+		n, err := r.Read(b[:])
+		if n == 1 {
+			return b[0], nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, io.ErrNoProgress
+}
+
+// stuffSTX doubles every STX byte of the data
+func stuffSTX(data []byte) []byte {
+	res := make([]byte, 0, len(data)+2)
+	for _, b := range data {
+		res = append(res, b)
+		if b == xSTX {
+			res = append(res, xSTX)
+		}
+	}
+	return res
+}
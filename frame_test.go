@@ -0,0 +1,91 @@
+package itlssp
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodeFrame(t *testing.T) {
+	var table = []struct {
+		id   byte
+		data []byte
+	}{
+		{0x80, []byte{0x11}},
+		{0x00, []byte{0x7F, 0x01}},
+		{0x90, []byte{0xF0, 0x7F, 0x7F, 0x0A, 0x0D}},
+	}
+
+	for _, v := range table {
+		enc := EncodeFrame(v.id, v.data)
+		frame, err := ReadFrame(bytes.NewBuffer(enc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, data, err := DecodeFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != v.id || !reflect.DeepEqual(data, v.data) {
+			t.Errorf("frame failed, expected %02X %X, got %02X %X", v.id, v.data, id, data)
+		}
+		if !bytes.Equal(StuffFrame(frame), enc) {
+			t.Errorf("StuffFrame failed, expected %X, got %X", enc, StuffFrame(frame))
+		}
+		if bytes.Count(enc[1:], []byte{xSTX}) != 2*bytes.Count(frame[1:], []byte{xSTX}) {
+			t.Errorf("EncodeFrame failed, STX is not stuffed: %X", enc)
+		}
+	}
+}
+
+func TestReadFrameResync(t *testing.T) {
+	good := EncodeFrame(0x80, []byte{0xF0})
+	// broken frame interrupted by the next frame
+	src := append([]byte{0x01, xSTX, 0x80, 0x05, 0xF0}, good...)
+	frame, err := ReadFrame(bytes.NewBuffer(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(frame, good) {
+		t.Errorf("ReadFrame failed, expected %X, got %X", good, frame)
+	}
+	if _, err = ReadFrame(bytes.NewBuffer(good[:4])); err != io.EOF {
+		t.Errorf("ReadFrame failed, expected EOF, got %v", err)
+	}
+}
+
+func TestDecodeFrameError(t *testing.T) {
+	var table = [][]byte{
+		{xSTX, 0x80, 0x01},
+		{0x00, 0x80, 0x01, 0xF0, 0x00, 0x00},
+		{xSTX, 0x80, 0x02, 0xF0, 0x00, 0x00},
+		{xSTX, 0x80, 0x01, 0xF0, 0x00, 0x00},
+	}
+
+	for _, v := range table {
+		if _, _, err := DecodeFrame(v); err == nil {
+			t.Errorf("DecodeFrame failed, expected error for %X", v)
+		}
+	}
+}
+
+func TestPipe(t *testing.T) {
+	host, slave := Pipe(20 * time.Millisecond)
+	go slave.Write(EncodeFrame(0x80, []byte{0xF0}))
+	frame, err := ReadFrame(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, data, _ := DecodeFrame(frame); !reflect.DeepEqual(data, []byte{0xF0}) {
+		t.Errorf("Pipe failed, got %X", frame)
+	}
+	if _, err = host.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Pipe failed, expected read timeout, got %v", err)
+	}
+	slave.Close()
+	if _, err = host.Write([]byte{0x00}); err != io.ErrClosedPipe {
+		t.Errorf("Pipe failed, expected closed pipe, got %v", err)
+	}
+}
@@ -7,6 +7,8 @@ import (
 
 type generic struct {
 	unit
+	protocol byte
+	tracker  *Tracker
 }
 
 func NewGeneric(c *serial.Config) *generic {
@@ -18,6 +20,17 @@ func NewGeneric(c *serial.Config) *generic {
 	}
 }
 
+// SetAddress sets the SSP address of the device on the bus, set it before Open
+func (this *generic) SetAddress(addr byte) {
+	u := this.unit
+	if s, ok := u.(*supervisor); ok {
+		u = s.unit
+	}
+	if d, ok := u.(*device); ok {
+		d.addr = addr
+	}
+}
+
 func (this *generic) Reset() error {
 	buf := []byte{byte(SspCmdReset)}
 	_, err := this.unit.SendCommand(buf)
@@ -30,21 +43,64 @@ func (this *generic) Sync() error {
 	return errors.WithStack(err)
 }
 
-func (this *generic) FirmwareVersion() error {
+func (this *generic) FirmwareVersion() (string, error) {
 	buf := []byte{byte(SspCmdFirmwareVersion)}
+	res, err := this.unit.SendCommand(buf)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return asciiString(res[1:]), nil
+}
+
+// HostProtocolVersion sets the protocol version used by the host,
+// device responds FAIL if the version is not supported
+func (this *generic) HostProtocolVersion(version byte) error {
+	buf := []byte{byte(SspCmdHostProtocolVersion), version}
+	if _, err := this.unit.SendCommand(buf); err != nil {
+		return errors.WithStack(err)
+	}
+	this.protocol = version
+	return nil
+}
+
+func (this *generic) SetupRequest() (*SetupData, error) {
+	buf := []byte{byte(SspCmdSetupRequest)}
+	res, err := this.SendCommand(buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return parseSetup(res[1:])
+}
+
+// NegotiateKeys exchanges eSSP keys, next commands are encrypted
+func (this *generic) NegotiateKeys(fixed uint64) error {
+	return negotiateKeys(this.unit, fixed)
+}
+
+// Enable allows the device to accept and pay out
+func (this *generic) Enable() error {
+	buf := []byte{byte(SspCmdEnable)}
 	_, err := this.unit.SendCommand(buf)
 	return errors.WithStack(err)
 }
 
-func (this *generic) HostProtocolVersion() error {
-	buf := []byte{byte(SspCmdHostProtocolVersion)}
+// Disable stops the device, it replies to poll with disabled event
+func (this *generic) Disable() error {
+	buf := []byte{byte(SspCmdDisable)}
 	_, err := this.unit.SendCommand(buf)
 	return errors.WithStack(err)
 }
 
-func (this *generic) SetupRequest() error {
-	buf := []byte{byte(SspCmdSetupRequest)}
-	_, err := this.SendCommand(buf)
-
-	return errors.WithStack(err)
+// Poll returns events reported by the device since the last poll
+func (this *generic) Poll() ([]Event, error) {
+	buf := []byte{byte(SspCmdPoll)}
+	res, err := this.unit.SendCommand(buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	events, err := DecodeEvents(res[1:])
+	if err == nil && this.tracker != nil {
+		this.tracker.Update(events)
+	}
+	return events, err
 }
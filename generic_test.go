@@ -1 +1,78 @@
 package itlssp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/tarm/serial"
+)
+
+// fakeUnit records sent commands and replies with prepared responses
+type fakeUnit struct {
+	sent   [][]byte
+	reply  [][]byte
+	key    []byte
+	resent int
+}
+
+func (this *fakeUnit) Open(*serial.Config) error { return nil }
+
+func (this *fakeUnit) Close() error { return nil }
+
+func (this *fakeUnit) SetEncryption(key []byte) error {
+	this.key = key
+	return nil
+}
+
+func (this *fakeUnit) SendCommand(data []byte) ([]byte, error) {
+	this.sent = append(this.sent, data)
+	return this.next()
+}
+
+func (this *fakeUnit) Retransmit() ([]byte, error) {
+	this.resent++
+	return this.next()
+}
+
+// next returns the next prepared response
+func (this *fakeUnit) next() ([]byte, error) {
+	buf := []byte{byte(SspResponseOk)}
+	if len(this.reply) > 0 {
+		buf, this.reply = this.reply[0], this.reply[1:]
+	}
+	if err := (&device{}).checkResponse(buf); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf, nil
+}
+
+func TestGenericPoll(t *testing.T) {
+	u := &fakeUnit{reply: [][]byte{{0xF0, 0xEF, 0x01}}}
+	g := &generic{unit: u}
+	ev, err := g.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ev) != 1 || ev[0].Code != SspEventRead || ev[0].Channel != 1 {
+		t.Errorf("Poll failed, got %v", ev)
+	}
+	if !reflect.DeepEqual(u.sent[0], []byte{byte(SspCmdPoll)}) {
+		t.Errorf("Poll failed, sent %X", u.sent[0])
+	}
+}
+
+func TestGenericEnable(t *testing.T) {
+	u := &fakeUnit{}
+	g := &generic{unit: u}
+	if err := g.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	exp := [][]byte{{byte(SspCmdEnable)}, {byte(SspCmdDisable)}}
+	if !reflect.DeepEqual(u.sent, exp) {
+		t.Errorf("Enable/Disable failed, expected %X, got %X", exp, u.sent)
+	}
+}
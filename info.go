@@ -0,0 +1,172 @@
+package itlssp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SetupData is the reply of the setup request
+type SetupData struct {
+	Type     UnitType  `json:"Type"`
+	Firmware string    `json:"Firmware"`
+	Currency string    `json:"Currency"`
+	Protocol byte      `json:"Protocol"`
+	Channels []Channel `json:"Channels"`
+}
+
+func (this *SetupData) String() string {
+	return fmt.Sprintf(`{"Type":%d,"Firmware":"%s","Currency":"%s","Protocol":%d,"Channels":%v}`,
+		this.Type, this.Firmware, this.Currency, this.Protocol, this.Channels)
+}
+
+// BuildRevision is the build revision of the device or its attached module
+type BuildRevision struct {
+	Type     UnitType `json:"Type"`
+	Revision uint16   `json:"Revision"`
+}
+
+// Info is the identity of the device
+type Info struct {
+	SerialNumber   uint32          `json:"SerialNumber"`
+	Firmware       string          `json:"Firmware"`
+	Dataset        string          `json:"Dataset"`
+	BuildRevisions []BuildRevision `json:"BuildRevisions"`
+	Protocol       byte            `json:"Protocol"`
+	Setup          *SetupData      `json:"Setup"`
+}
+
+// GetSerialNumber returns the serial number of the device
+func (this *generic) GetSerialNumber() (uint32, error) {
+	buf := []byte{byte(SspCmdGetSerialNumber)}
+	res, err := this.unit.SendCommand(buf)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if len(res) < 5 {
+		return 0, errors.Errorf("Invalid serial number data: %X", res)
+	}
+	return binary.BigEndian.Uint32(res[1:5]), nil
+}
+
+// GetDatasetVersion returns the version of the currency dataset
+func (this *generic) GetDatasetVersion() (string, error) {
+	buf := []byte{byte(SspCmdGetDatasetVersion)}
+	res, err := this.unit.SendCommand(buf)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return asciiString(res[1:]), nil
+}
+
+// GetBuildRevision returns build revisions of the device and attached modules
+func (this *generic) GetBuildRevision() ([]BuildRevision, error) {
+	buf := []byte{byte(SspCmdGetBuildRevision)}
+	res, err := this.unit.SendCommand(buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(res) < 4 || (len(res)-1)%3 != 0 {
+		return nil, errors.Errorf("Invalid build revision data: %X", res)
+	}
+	var revs []BuildRevision
+	for i := 1; i < len(res); i += 3 {
+		revs = append(revs, BuildRevision{
+			Type:     UnitType(res[i]),
+			Revision: binary.LittleEndian.Uint16(res[i+1 : i+3]),
+		})
+	}
+	return revs, nil
+}
+
+// Info gathers identity, setup data and protocol version of the device
+func (this *generic) Info() (*Info, error) {
+	var err error
+	info := &Info{Protocol: this.protocol}
+	if info.SerialNumber, err = this.GetSerialNumber(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if info.Firmware, err = this.FirmwareVersion(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if info.Dataset, err = this.GetDatasetVersion(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if info.BuildRevisions, err = this.GetBuildRevision(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if info.Setup, err = this.SetupRequest(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if info.Protocol == 0 {
+		info.Protocol = info.Setup.Protocol
+	}
+	return info, nil
+}
+
+// parseSetup parses setup request data without the leading OK byte
+func parseSetup(data []byte) (*SetupData, error) {
+	if len(data) < 9 {
+		return nil, errors.Errorf("Invalid setup data: %X", data)
+	}
+	setup := &SetupData{
+		Type:     UnitType(data[0]),
+		Firmware: asciiString(data[1:5]),
+		Currency: string(data[5:8]),
+	}
+	if setup.Type == SMARTHopper {
+		return parseHopperSetup(setup, data)
+	}
+
+	// validator, SMART Payout and NV11
+	if len(data) < 12 {
+		return nil, errors.Errorf("Invalid setup data: %X", data)
+	}
+	n := int(data[11])
+	p := 12 + 2*n // channel values and security
+	if len(data) < p+4 {
+		return nil, errors.Errorf("Invalid setup data: %X", data)
+	}
+	multiplier := int(data[p])<<16 | int(data[p+1])<<8 | int(data[p+2])
+	setup.Protocol = data[p+3]
+	p += 4
+	extended := setup.Protocol >= 6 && len(data) >= p+7*n
+	for i := 0; i < n; i++ {
+		ch := Channel{
+			Channel:  byte(i + 1),
+			Value:    int(data[12+i]) * multiplier,
+			Currency: []byte(setup.Currency),
+		}
+		if extended {
+			ch.Currency = data[p+3*i : p+3*i+3]
+			ch.Value = int(binary.LittleEndian.Uint32(data[p+3*n+4*i:])) * multiplier
+		}
+		setup.Channels = append(setup.Channels, ch)
+	}
+	return setup, nil
+}
+
+// parseHopperSetup parses setup data of SMART Hopper
+func parseHopperSetup(setup *SetupData, data []byte) (*SetupData, error) {
+	if len(data) < 10 || len(data) < 10+5*int(data[9]) {
+		return nil, errors.Errorf("Invalid setup data: %X", data)
+	}
+	setup.Protocol = data[8]
+	n := int(data[9])
+	for i := 0; i < n; i++ {
+		p := 10 + 2*n + 3*i
+		setup.Channels = append(setup.Channels, Channel{
+			Channel:  byte(i + 1),
+			Value:    int(binary.LittleEndian.Uint16(data[10+2*i:])),
+			Currency: data[p : p+3],
+		})
+	}
+	return setup, nil
+}
+
+// asciiString converts device ASCII data to string without padding
+func asciiString(data []byte) string {
+	return strings.TrimRight(string(data), "\x00 ")
+}
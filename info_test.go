@@ -0,0 +1,77 @@
+package itlssp
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var validatorSetup = []byte{0xF0,
+	0x00, '0', '4', '0', '0', 'E', 'U', 'R', 0x00, 0x00, 0x01,
+	0x02, 0x05, 0x0A, 0x02, 0x02, 0x00, 0x00, 0x64, 0x06,
+	'E', 'U', 'R', 'E', 'U', 'R',
+	0x05, 0x00, 0x00, 0x00, 0x0A, 0x00, 0x00, 0x00,
+}
+
+func TestSetupRequest(t *testing.T) {
+	var table = []struct {
+		src []byte
+		exp *SetupData
+	}{
+		{validatorSetup, &SetupData{Type: Validator, Firmware: "0400", Currency: "EUR", Protocol: 6, Channels: []Channel{
+			{Channel: 1, Value: 500, Currency: []byte("EUR")},
+			{Channel: 2, Value: 1000, Currency: []byte("EUR")},
+		}}},
+		{[]byte{0xF0, 0x03, '0', '1', '0', '0', 'G', 'B', 'P', 0x06, 0x02,
+			0x0A, 0x00, 0x14, 0x00, 'G', 'B', 'P', 'G', 'B', 'P'},
+			&SetupData{Type: SMARTHopper, Firmware: "0100", Currency: "GBP", Protocol: 6, Channels: []Channel{
+				{Channel: 1, Value: 10, Currency: []byte("GBP")},
+				{Channel: 2, Value: 20, Currency: []byte("GBP")},
+			}}},
+	}
+
+	for _, v := range table {
+		g := &generic{unit: &fakeUnit{reply: [][]byte{v.src}}}
+		r, err := g.SetupRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r, v.exp) {
+			t.Errorf("SetupRequest failed, expected %s, got %s", v.exp, r)
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	u := &fakeUnit{reply: [][]byte{
+		{0xF0},
+		{0xF0, 0x00, 0x12, 0xD6, 0x87},
+		append([]byte{0xF0}, "NV02004141498000"...),
+		append([]byte{0xF0}, "EUR01610"...),
+		{0xF0, 0x00, 0x0A, 0x00, 0x06, 0x03, 0x00},
+		validatorSetup,
+	}}
+	g := &generic{unit: u}
+	if err := g.HostProtocolVersion(6); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u.sent[0], []byte{0x06, 0x06}) {
+		t.Errorf("HostProtocolVersion failed, got %X", u.sent[0])
+	}
+	info, err := g.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `{"SerialNumber":1234567,"Firmware":"NV02004141498000","Dataset":"EUR01610",` +
+		`"BuildRevisions":[{"Type":0,"Revision":10},{"Type":6,"Revision":3}],"Protocol":6,` +
+		`"Setup":{"Type":0,"Firmware":"0400","Currency":"EUR","Protocol":6,"Channels":[` +
+		`{"Value":500,"Level":0,"Channel":1,"Recycling":false,"Currency":"EUR"},` +
+		`{"Value":1000,"Level":0,"Channel":2,"Recycling":false,"Currency":"EUR"}]}}`
+	if string(buf) != exp {
+		t.Errorf("Info failed, expected %s, got %s", exp, buf)
+	}
+}
@@ -0,0 +1,59 @@
+// Package bus shares a serial port between devices at different addresses
+// and keeps every device polled, for the commands that own the devices.
+package bus
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/charoit/itlssp"
+	"github.com/tarm/serial"
+)
+
+// Bus is the serial port shared by devices at different addresses
+type Bus struct {
+	sync.Mutex
+	name string
+	com  io.ReadWriteCloser
+}
+
+// Open opens the serial port of the bus
+func Open(name string, baud int) (*Bus, error) {
+	com, err := serial.OpenPort(itlssp.PortConfig(name, baud))
+	if err != nil {
+		return nil, err
+	}
+	return &Bus{name: name, com: com}, nil
+}
+
+// Register makes the returned port name of the address open the shared port
+func (this *Bus) Register(addr byte) string {
+	name := fmt.Sprintf("%s#%d", this.name, addr)
+	itlssp.RegisterPort(name, func(cfg *serial.Config) (io.ReadWriteCloser, error) {
+		return &port{this}, nil
+	})
+	return name
+}
+
+// Close closes the serial port
+func (this *Bus) Close() error {
+	return this.com.Close()
+}
+
+// port is the connection of one device, closing it keeps the bus open
+type port struct {
+	bus *Bus
+}
+
+func (this *port) Read(p []byte) (int, error) {
+	return this.bus.com.Read(p)
+}
+
+func (this *port) Write(p []byte) (int, error) {
+	return this.bus.com.Write(p)
+}
+
+func (this *port) Close() error {
+	return nil
+}
@@ -0,0 +1,153 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/charoit/itlssp"
+	"github.com/tarm/serial"
+)
+
+// ReconnectFail is the number of failed polls before reconnecting
+const ReconnectFail = 5
+
+var ErrOffline = errors.New("device is offline")
+
+// Station is the device API the poller needs
+type Station interface {
+	SetAddress(addr byte)
+	Open(cfg *serial.Config) error
+	Close() error
+	Sync() error
+	HostProtocolVersion(version byte) error
+	NegotiateKeys(fixed uint64) error
+	Info() (*itlssp.Info, error)
+	Poll() ([]itlssp.Event, error)
+}
+
+// Handler receives what the poller reads. It is called without locks held
+// and may run actions through Poller.Do.
+type Handler interface {
+	// Connected is called after every connect attempt
+	Connected(info *itlssp.Info, err error)
+	// Polled is called after every poll, the poller is offline after
+	// ReconnectFail failed polls in a row
+	Polled(events []itlssp.Event, err error)
+}
+
+// Poller polls one device all the time, so the device stays enabled and
+// the key negotiated, reconnects after failures and runs actions between
+// polls
+type Poller struct {
+	Config   *serial.Config
+	Protocol byte
+	Key      uint64 // eSSP fixed key, plain SSP if zero
+
+	found   *itlssp.SSPDevice
+	dev     Station
+	bus     sync.Locker // serializes devices sharing the port
+	handler Handler
+
+	mu        sync.Mutex
+	connected bool
+	failed    int
+}
+
+// NewPoller returns the poller of the discovered device
+func NewPoller(found *itlssp.SSPDevice, dev Station, bus sync.Locker, handler Handler) *Poller {
+	return &Poller{found: found, dev: dev, bus: bus, handler: handler}
+}
+
+// Connected reports whether the device is connected
+func (this *Poller) Connected() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.connected
+}
+
+// Run polls the device until ctx is done, reconnects after failures
+func (this *Poller) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		if this.Connected() {
+			this.Poll()
+		} else {
+			this.Connect()
+		}
+		select {
+		case <-ctx.Done():
+			this.bus.Lock()
+			this.dev.Close()
+			this.bus.Unlock()
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// Connect opens the device, negotiates keys and reads its identity
+func (this *Poller) Connect() {
+	this.bus.Lock()
+	err := this.open()
+	var info *itlssp.Info
+	if err == nil {
+		info, err = this.dev.Info()
+	}
+	this.bus.Unlock()
+
+	this.mu.Lock()
+	if err == nil {
+		this.connected, this.failed = true, 0
+	}
+	this.mu.Unlock()
+	this.handler.Connected(info, err)
+}
+
+func (this *Poller) open() error {
+	this.dev.Close()
+	this.dev.SetAddress(this.found.Port.Addr)
+	if err := this.dev.Open(this.Config); err != nil {
+		return err
+	}
+	if err := this.dev.Sync(); err != nil {
+		return err
+	}
+	if err := this.dev.HostProtocolVersion(this.Protocol); err != nil {
+		return err
+	}
+	if this.Key != 0 {
+		return this.dev.NegotiateKeys(this.Key)
+	}
+	return nil
+}
+
+// Poll reads the events of the device
+func (this *Poller) Poll() {
+	this.bus.Lock()
+	events, err := this.dev.Poll()
+	this.bus.Unlock()
+
+	this.mu.Lock()
+	if err != nil {
+		if this.failed++; this.failed >= ReconnectFail {
+			this.connected = false
+		}
+	} else {
+		this.failed = 0
+	}
+	this.mu.Unlock()
+	this.handler.Polled(events, err)
+}
+
+// Do runs the action on the connected device between polls
+func (this *Poller) Do(action func() error) error {
+	if !this.Connected() {
+		return ErrOffline
+	}
+	this.bus.Lock()
+	defer this.bus.Unlock()
+	return action()
+}
@@ -0,0 +1,87 @@
+package bus
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/charoit/itlssp"
+	"github.com/tarm/serial"
+)
+
+// fakeStation fails polls while failing is set
+type fakeStation struct {
+	failing bool
+	opened  int
+}
+
+func (this *fakeStation) SetAddress(addr byte)                   {}
+func (this *fakeStation) Open(cfg *serial.Config) error          { this.opened++; return nil }
+func (this *fakeStation) Close() error                           { return nil }
+func (this *fakeStation) Sync() error                            { return nil }
+func (this *fakeStation) HostProtocolVersion(version byte) error { return nil }
+func (this *fakeStation) NegotiateKeys(fixed uint64) error       { return nil }
+func (this *fakeStation) Info() (*itlssp.Info, error)            { return &itlssp.Info{SerialNumber: 7}, nil }
+
+func (this *fakeStation) Poll() ([]itlssp.Event, error) {
+	if this.failing {
+		return nil, errors.New("timeout")
+	}
+	return []itlssp.Event{{Code: itlssp.SspEventDisabled}}, nil
+}
+
+// fakeHandler counts the callbacks
+type fakeHandler struct {
+	info   *itlssp.Info
+	events int
+	errs   int
+}
+
+func (this *fakeHandler) Connected(info *itlssp.Info, err error) {
+	this.info = info
+}
+
+func (this *fakeHandler) Polled(events []itlssp.Event, err error) {
+	this.events += len(events)
+	if err != nil {
+		this.errs++
+	}
+}
+
+func TestPoller(t *testing.T) {
+	dev, h := &fakeStation{}, &fakeHandler{}
+	p := NewPoller(&itlssp.SSPDevice{Port: &itlssp.SSPConnection{Addr: 16}}, dev, &sync.Mutex{}, h)
+	if err := p.Do(func() error { return nil }); err != ErrOffline {
+		t.Fatalf("Do failed, expected %v, got %v", ErrOffline, err)
+	}
+
+	p.Connect()
+	if !p.Connected() || h.info == nil || h.info.SerialNumber != 7 {
+		t.Fatalf("Connect failed, expected the connected device, got %v", h.info)
+	}
+	p.Poll()
+	if h.events != 1 {
+		t.Errorf("Poll failed, expected %v events, got %v", 1, h.events)
+	}
+
+	dev.failing = true
+	for i := 1; i < ReconnectFail; i++ {
+		p.Poll()
+		if !p.Connected() {
+			t.Fatalf("Poll failed, expected connected after %v failures", i)
+		}
+	}
+	p.Poll()
+	if p.Connected() || h.errs != ReconnectFail {
+		t.Fatalf("Poll failed, expected offline after %v failures, got %v", ReconnectFail, h.errs)
+	}
+
+	dev.failing = false
+	p.Connect()
+	if !p.Connected() || dev.opened != 2 {
+		t.Fatalf("Connect failed, expected %v opens, got %v", 2, dev.opened)
+	}
+	if err := p.Do(func() error { return nil }); err != nil {
+		t.Fatalf("Do failed, expected %v, got %v", nil, err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package pty
+
+import (
+	"errors"
+	"os"
+)
+
+// Open is not supported, pseudo-terminals are created on Linux only
+func Open() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("Pseudo-terminal is not supported on this system")
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package term
+
+import "errors"
+
+var errUnsupported = errors.New("Raw terminal is not supported on this system")
+
+// State is the terminal mode to restore
+type State struct{}
+
+func MakeRaw(fd int) (*State, error) {
+	return nil, errUnsupported
+}
+
+func Restore(fd int, state *State) error {
+	return errUnsupported
+}
+
+func Size(fd int) (int, int, error) {
+	return 0, 0, errUnsupported
+}
@@ -0,0 +1,61 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+// Package term switches the terminal to raw mode for interactive tools.
+// Linux, macOS and the BSDs are supported, on Windows the functions return
+// an error and the interactive tools are not available.
+package term
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// State is the terminal mode to restore
+type State struct {
+	termios syscall.Termios
+}
+
+// MakeRaw disables echo and line editing of the terminal and returns
+// the previous state
+func MakeRaw(fd int) (*State, error) {
+	var old State
+	if err := ioctl(fd, ioctlGetTermios, uintptr(unsafe.Pointer(&old.termios))); err != nil {
+		return nil, err
+	}
+	t := old.termios
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR |
+		syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, ioctlSetTermios, uintptr(unsafe.Pointer(&t))); err != nil {
+		return nil, err
+	}
+	return &old, nil
+}
+
+// Restore sets the terminal state
+func Restore(fd int, state *State) error {
+	return ioctl(fd, ioctlSetTermios, uintptr(unsafe.Pointer(&state.termios)))
+}
+
+// Size returns the columns and rows of the terminal
+func Size(fd int) (int, int, error) {
+	var ws struct {
+		rows, cols, x, y uint16
+	}
+	if err := ioctl(fd, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); err != nil {
+		return 0, 0, err
+	}
+	return int(ws.cols), int(ws.rows), nil
+}
+
+func ioctl(fd int, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,509 @@
+package itlssp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrJournalCorrupt = errors.New("Corrupt journal record")
+
+// EntryKind is the money-affecting operation of the journal entry
+type EntryKind byte
+
+const (
+	EntryCredit EntryKind = iota + 1
+	EntryPayout
+	EntryFloat
+	EntryEmpty
+	EntryCashboxRemoved
+	EntryCashboxReplaced
+	EntryCheckpoint
+	EntryDiscrepancy
+)
+
+var entryKinds = map[EntryKind]string{
+	EntryCredit:          "Credit",
+	EntryPayout:          "Payout",
+	EntryFloat:           "Float",
+	EntryEmpty:           "Empty",
+	EntryCashboxRemoved:  "CashboxRemoved",
+	EntryCashboxReplaced: "CashboxReplaced",
+	EntryCheckpoint:      "Checkpoint",
+	EntryDiscrepancy:     "Discrepancy",
+}
+
+func (k EntryKind) String() string {
+	if s, ok := entryKinds[k]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// MarshalText encodes the kind by name
+func (k EntryKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes the kind name
+func (k *EntryKind) UnmarshalText(text []byte) error {
+	for v, s := range entryKinds {
+		if s == string(text) {
+			*k = v
+			return nil
+		}
+	}
+	return errors.Errorf("Invalid entry kind %q", text)
+}
+
+// EntryStatus is the outcome of the operation
+type EntryStatus byte
+
+const (
+	// EntryDone is the finished operation
+	EntryDone EntryStatus = iota
+	// EntryPending is the started operation, a later entry settles it
+	EntryPending
+	// EntryIncomplete is the operation that ended with less than requested
+	EntryIncomplete
+	// EntryUnresolved closes the operation the device reported nothing
+	// about, its outcome is counted by hand
+	EntryUnresolved
+)
+
+var entryStatuses = map[EntryStatus]string{
+	EntryDone:       "Done",
+	EntryPending:    "Pending",
+	EntryIncomplete: "Incomplete",
+	EntryUnresolved: "Unresolved",
+}
+
+func (s EntryStatus) String() string {
+	if v, ok := entryStatuses[s]; ok {
+		return v
+	}
+	return "Unknown"
+}
+
+// MarshalText encodes the status by name
+func (s EntryStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes the status name
+func (s *EntryStatus) UnmarshalText(text []byte) error {
+	for v, name := range entryStatuses {
+		if name == string(text) {
+			*s = v
+			return nil
+		}
+	}
+	return errors.Errorf("Invalid entry status %q", text)
+}
+
+// JournalEntry is the record of the journal. Ref is the ID of the pending
+// entry the entry settles. Amount and Requested are in minor units. Key is
+// the idempotency key of the client request that started the operation,
+// settlements carry the key of their pending entry.
+type JournalEntry struct {
+	ID        uint64      `json:"ID"`
+	Time      time.Time   `json:"Time"`
+	Serial    uint32      `json:"Serial"`
+	Kind      EntryKind   `json:"Kind"`
+	Status    EntryStatus `json:"Status"`
+	Ref       uint64      `json:"Ref,omitempty"`
+	Channel   byte        `json:"Channel,omitempty"`
+	Amount    uint32      `json:"Amount"`
+	Requested uint32      `json:"Requested,omitempty"`
+	Currency  string      `json:"Currency,omitempty"`
+	Counters  *Counters   `json:"Counters,omitempty"`
+	Note      string      `json:"Note,omitempty"`
+	Key       string      `json:"Key,omitempty"`
+}
+
+func (this *JournalEntry) String() string {
+	data, _ := json.Marshal(this)
+	return string(data)
+}
+
+// Journal is the append-only log of money-affecting events. Every entry is
+// a line of the CRC-32 in hex and the JSON entry, written and synced to the
+// disk before Append returns. Opening replays the file, a torn last line of
+// a crash is cut off.
+type Journal struct {
+	mu      sync.Mutex
+	f       *os.File
+	entries []JournalEntry
+	settled map[uint64]bool
+	removed map[uint32]bool
+	next    uint64
+	size    int64
+}
+
+// OpenJournal opens or creates the journal file and replays its entries
+func OpenJournal(path string) (*Journal, error) {
+	_, err := os.Stat(path)
+	created := os.IsNotExist(err)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if created {
+		if err = syncDir(filepath.Dir(path)); err != nil {
+			f.Close()
+			return nil, errors.WithStack(err)
+		}
+	}
+	this := &Journal{f: f, settled: make(map[uint64]bool), removed: make(map[uint32]bool), next: 1}
+	if err = this.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return this, nil
+}
+
+// replay reads the entries and truncates the torn last line
+func (this *Journal) replay() error {
+	data, err := ioutil.ReadAll(this.f)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	good := 0
+	for n := 1; good < len(data); n++ {
+		end := bytes.IndexByte(data[good:], '\n')
+		var e *JournalEntry
+		if end >= 0 {
+			e, err = parseEntry(data[good : good+end])
+		}
+		if end < 0 || err != nil {
+			if end < 0 || good+end+1 == len(data) {
+				break // torn write of a crash
+			}
+			return errors.Wrapf(ErrJournalCorrupt, "line %d", n)
+		}
+		this.add(e)
+		good += end + 1
+	}
+	if good < len(data) {
+		if err = this.f.Truncate(int64(good)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	this.size = int64(good)
+	_, err = this.f.Seek(this.size, 0)
+	return errors.WithStack(err)
+}
+
+// parseEntry checks the checksum and decodes the line
+func parseEntry(line []byte) (*JournalEntry, error) {
+	if len(line) < 10 || line[8] != ' ' {
+		return nil, ErrJournalCorrupt
+	}
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE(line[9:]) {
+		return nil, ErrJournalCorrupt
+	}
+	e := &JournalEntry{}
+	if err = json.Unmarshal(line[9:], e); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return e, nil
+}
+
+// add keeps the entry in memory, the caller holds the lock
+func (this *Journal) add(e *JournalEntry) {
+	this.entries = append(this.entries, *e)
+	if e.Ref != 0 {
+		this.settled[e.Ref] = true
+	}
+	switch e.Kind {
+	case EntryCashboxRemoved:
+		this.removed[e.Serial] = true
+	case EntryCashboxReplaced:
+		this.removed[e.Serial] = false
+	}
+	if e.ID >= this.next {
+		this.next = e.ID + 1
+	}
+}
+
+// Append sets the ID and the time of the entry, writes and syncs it
+func (this *Journal) Append(e *JournalEntry) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.append(e)
+}
+
+func (this *Journal) append(e *JournalEntry) error {
+	e.ID = this.next
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)
+	if _, err = this.f.WriteString(line); err == nil {
+		err = this.f.Sync()
+	}
+	if err != nil {
+		// cut the partial line off, the next entry must follow a whole one
+		this.f.Truncate(this.size)
+		this.f.Seek(this.size, 0)
+		return errors.WithStack(err)
+	}
+	this.size += int64(len(line))
+	this.add(e)
+	return nil
+}
+
+// Entries returns all entries of the journal
+func (this *Journal) Entries() []JournalEntry {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]JournalEntry(nil), this.entries...)
+}
+
+// Keyed returns the entries of the operation started with the idempotency
+// key, the started entry first
+func (this *Journal) Keyed(key string) []JournalEntry {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var res []JournalEntry
+	for _, e := range this.entries {
+		if key != "" && e.Key == key {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// Pending returns started operations of the device without outcome,
+// zero serial returns those of all devices
+func (this *Journal) Pending(serial uint32) []JournalEntry {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.pending(serial)
+}
+
+func (this *Journal) pending(serial uint32) []JournalEntry {
+	var res []JournalEntry
+	for _, e := range this.entries {
+		if e.Status == EntryPending && !this.settled[e.ID] && (serial == 0 || e.Serial == serial) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// Begin records the payout or float before the command is sent
+func (this *Journal) Begin(serial uint32, kind EntryKind, requested uint32, currency string) (*JournalEntry, error) {
+	e := &JournalEntry{Serial: serial, Kind: kind, Status: EntryPending, Requested: requested, Currency: currency}
+	if err := this.Append(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Settle records the outcome of the pending entry, an amount less than
+// requested makes the operation incomplete
+func (this *Journal) Settle(pending *JournalEntry, amount uint32) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.settle(pending, amount, "")
+}
+
+func (this *Journal) settle(pending *JournalEntry, amount uint32, note string) error {
+	status := EntryDone
+	if amount < pending.Requested {
+		status = EntryIncomplete
+	}
+	return this.append(&JournalEntry{Serial: pending.Serial, Kind: pending.Kind, Status: status, Ref: pending.ID,
+		Amount: amount, Requested: pending.Requested, Currency: pending.Currency, Note: note, Key: pending.Key})
+}
+
+// Unresolve closes the pending entry whose outcome is unknown, so later
+// events are not matched with it
+func (this *Journal) Unresolve(pending *JournalEntry, note string) error {
+	return this.Append(&JournalEntry{Serial: pending.Serial, Kind: pending.Kind, Status: EntryUnresolved,
+		Ref: pending.ID, Requested: pending.Requested, Currency: pending.Currency, Note: note, Key: pending.Key})
+}
+
+// RecordEvents journals money-affecting events of one poll. Channels are
+// the channel table of the device for the values of credited notes.
+// Dispensed, floated and incomplete events settle the pending operation
+// of the same requested value or the latest one.
+func (this *Journal) RecordEvents(serial uint32, channels []Channel, events []Event) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for i := range events {
+		ev := &events[i]
+		var e *JournalEntry
+		switch ev.Code {
+		case SspEventCredit:
+			e = &JournalEntry{Kind: EntryCredit, Channel: ev.Channel}
+			if n := int(ev.Channel); n > 0 && n <= len(channels) {
+				e.Amount, e.Currency = uint32(channels[n-1].Value), string(channels[n-1].Currency)
+			}
+		case SspEventCoinCredit:
+			e = &JournalEntry{Kind: EntryCredit}
+			e.Amount, _, e.Currency = sumAmounts(ev.Amounts)
+		case SspEventDispensed, SspEventFloated, SspEventIncompletePayout, SspEventIncompleteFloat:
+			kind := EntryPayout
+			if ev.Code == SspEventFloated || ev.Code == SspEventIncompleteFloat {
+				kind = EntryFloat
+			}
+			amount, requested, currency := sumAmounts(ev.Amounts)
+			if p := this.match(serial, kind, requested); p != nil {
+				if err := this.settle(p, amount, ev.Code.String()); err != nil {
+					return err
+				}
+				continue
+			}
+			e = &JournalEntry{Kind: kind, Amount: amount, Requested: requested, Currency: currency}
+			if requested > amount {
+				e.Status = EntryIncomplete
+			}
+		case SspEventEmptied, SspEventSmartEmptied:
+			e = &JournalEntry{Kind: EntryEmpty}
+			e.Amount, _, e.Currency = sumAmounts(ev.Amounts)
+		case SspEventCashboxRemoved:
+			if this.removed[serial] {
+				continue // repeated while the cashbox is out
+			}
+			e = &JournalEntry{Kind: EntryCashboxRemoved}
+		case SspEventCashboxReplaced:
+			e = &JournalEntry{Kind: EntryCashboxReplaced}
+		default:
+			continue
+		}
+		e.Serial = serial
+		if e.Note == "" {
+			e.Note = ev.Code.String()
+		}
+		if err := this.append(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match returns the latest pending operation of the kind and the requested
+// value, the latest one of the kind if none requested the value. Dispensed
+// events carry no requested value and end the operation started last.
+func (this *Journal) match(serial uint32, kind EntryKind, requested uint32) *JournalEntry {
+	var latest, same *JournalEntry
+	for _, e := range this.pending(serial) {
+		if e.Kind != kind {
+			continue
+		}
+		e := e
+		if requested != 0 && e.Requested == requested {
+			same = &e
+		}
+		latest = &e
+	}
+	if same != nil {
+		return same
+	}
+	return latest
+}
+
+// sumAmounts adds values of the amounts, multi-currency devices report
+// one currency at a time
+func sumAmounts(amounts []Amount) (value, requested uint32, currency string) {
+	for _, a := range amounts {
+		value += a.Value
+		requested += a.Requested
+		currency = a.Currency
+	}
+	return value, requested, currency
+}
+
+// Reconciliation compares the journal with the device counters since the
+// last checkpoint. Missing notes are counted by the device and absent
+// from the journal, negative when the journal has more.
+type Reconciliation struct {
+	Serial    uint32
+	Journaled uint32
+	Counted   uint32
+	Missing   int
+	Pending   []JournalEntry
+}
+
+func (this *Reconciliation) String() string {
+	data, _ := json.Marshal(this)
+	return string(data)
+}
+
+// Checkpoint records the device counters as the base of the next reconciliation
+func (this *Journal) Checkpoint(serial uint32, counters *Counters) error {
+	c := *counters
+	return this.Append(&JournalEntry{Serial: serial, Kind: EntryCheckpoint, Counters: &c})
+}
+
+// Reconcile runs at startup with the counters read from the device. Credits
+// since the last checkpoint are compared with the notes the device stacked
+// and stored, a difference is journaled as a discrepancy. A new checkpoint
+// is written, pending operations are returned for recovery.
+func (this *Journal) Reconcile(serial uint32, counters *Counters) (*Reconciliation, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	res := &Reconciliation{Serial: serial, Pending: this.pending(serial)}
+	var base *Counters
+	for _, e := range this.entries {
+		if e.Serial != serial {
+			continue
+		}
+		switch {
+		case e.Kind == EntryCheckpoint:
+			base, res.Journaled = e.Counters, 0
+		case e.Kind == EntryCredit && e.Channel > 0:
+			res.Journaled++
+		}
+	}
+	if base != nil {
+		d := counters.Sub(base)
+		res.Counted = d.Stacked + d.Stored
+		res.Missing = int(res.Counted) - int(res.Journaled)
+	}
+	if res.Missing != 0 {
+		err := this.append(&JournalEntry{Serial: serial, Kind: EntryDiscrepancy,
+			Note: fmt.Sprintf("Device counted %d notes, journal has %d credits", res.Counted, res.Journaled)})
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := *counters
+	if err := this.append(&JournalEntry{Serial: serial, Kind: EntryCheckpoint, Counters: &c}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Close closes the journal file
+func (this *Journal) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.f.Close()
+}
+
+// syncDir makes the creation of a file in the directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,267 @@
+package itlssp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// tempJournal opens the journal in a temporary directory
+func tempJournal(t *testing.T) (*Journal, string) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "journal.log")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j, path
+}
+
+var journalChannels = []Channel{
+	{Channel: 1, Value: 500, Currency: []byte("EUR")},
+	{Channel: 2, Value: 1000, Currency: []byte("EUR")},
+}
+
+func TestJournalReplay(t *testing.T) {
+	j, path := tempJournal(t)
+	err := j.RecordEvents(7, journalChannels, []Event{
+		{Code: SspEventRead, Channel: 2},
+		{Code: SspEventCredit, Channel: 2},
+		{Code: SspEventCashboxRemoved},
+		{Code: SspEventCashboxRemoved},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := j.Begin(7, EntryPayout, 1500, "EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	if j, err = OpenJournal(path); err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	entries := j.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("OpenJournal failed, expected 3 entries, got %v", entries)
+	}
+	if e := entries[0]; e.ID != 1 || e.Kind != EntryCredit || e.Amount != 1000 || e.Currency != "EUR" || e.Serial != 7 {
+		t.Fatalf("OpenJournal failed, expected credit 1000 EUR of serial 7, got %s", &e)
+	}
+	if pending := j.Pending(7); len(pending) != 1 || pending[0].ID != p.ID {
+		t.Fatalf("Pending failed, expected payout %d, got %v", p.ID, pending)
+	}
+
+	// the cashbox is still out after the restart
+	if err = j.RecordEvents(7, nil, []Event{{Code: SspEventCashboxRemoved}}); err != nil {
+		t.Fatal(err)
+	}
+	err = j.RecordEvents(7, nil, []Event{
+		{Code: SspEventDispensed, Amounts: []Amount{{Value: 1500, Currency: "EUR"}}},
+		{Code: SspEventCashboxReplaced},
+		{Code: SspEventCashboxRemoved},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = j.Entries()
+	if len(entries) != 6 || entries[3].ID != 4 || entries[3].Ref != p.ID || entries[3].Status != EntryDone {
+		t.Fatalf("RecordEvents failed, expected 6 entries settling payout %d, got %v", p.ID, entries)
+	}
+	if pending := j.Pending(0); len(pending) != 0 {
+		t.Fatalf("Pending failed, expected none, got %v", pending)
+	}
+}
+
+func TestJournalSettle(t *testing.T) {
+	j, _ := tempJournal(t)
+	defer j.Close()
+	var table = []struct {
+		kind   EntryKind
+		amount uint32
+		status EntryStatus
+	}{
+		{EntryPayout, 2000, EntryDone},
+		{EntryFloat, 500, EntryIncomplete},
+	}
+
+	for i, v := range table {
+		p, err := j.Begin(1, v.kind, 2000, "EUR")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = j.Settle(p, v.amount); err != nil {
+			t.Fatal(err)
+		}
+		entries := j.Entries()
+		e := entries[len(entries)-1]
+		if e.Kind != v.kind || e.Status != v.status || e.Ref != p.ID || e.Amount != v.amount || e.Requested != 2000 {
+			t.Errorf("%d: Settle failed, expected %s of %d, got %s", i, v.status, v.amount, &e)
+		}
+	}
+	if pending := j.Pending(1); len(pending) != 0 {
+		t.Fatalf("Pending failed, expected none, got %v", pending)
+	}
+}
+
+func TestJournalKeyed(t *testing.T) {
+	j, path := tempJournal(t)
+	p := &JournalEntry{Serial: 1, Kind: EntryPayout, Status: EntryPending, Requested: 1500, Currency: "EUR", Key: "k1"}
+	if err := j.Append(p); err != nil {
+		t.Fatal(err)
+	}
+	j.Begin(1, EntryPayout, 1000, "EUR")
+	j.RecordEvents(1, journalChannels, []Event{{Code: SspEventDispensed, Amounts: []Amount{{Value: 1000, Currency: "EUR"}}}})
+	j.RecordEvents(1, journalChannels, []Event{{Code: SspEventDispensed, Amounts: []Amount{{Value: 1500, Currency: "EUR"}}}})
+	j.Close()
+
+	if j, err := OpenJournal(path); err != nil {
+		t.Fatal(err)
+	} else {
+		defer j.Close()
+		keyed := j.Keyed("k1")
+		if len(keyed) != 2 || keyed[0].ID != p.ID || keyed[1].Ref != p.ID || keyed[1].Amount != 1500 {
+			t.Errorf("Keyed failed, expected the payout and its settlement, got %v", keyed)
+		}
+		if keyed = j.Keyed(""); len(keyed) != 0 {
+			t.Errorf("Keyed failed, expected no entries of the empty key, got %v", keyed)
+		}
+	}
+}
+
+func TestJournalTornWrite(t *testing.T) {
+	j, path := tempJournal(t)
+	j.RecordEvents(1, journalChannels, []Event{{Code: SspEventCredit, Channel: 1}, {Code: SspEventCredit, Channel: 2}})
+	j.Close()
+
+	data, _ := ioutil.ReadFile(path)
+	var table = []struct {
+		data    string
+		entries int
+		err     error
+	}{
+		{string(data) + `1234abcd {"ID":3,"Ki`, 2, nil},
+		{string(data[:len(data)-5]), 1, nil},
+		{strings.Replace(string(data), `"Amount":500`, `"Amount":900`, 1), 0, ErrJournalCorrupt},
+	}
+
+	for i, v := range table {
+		if err := ioutil.WriteFile(path, []byte(v.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		j, err := OpenJournal(path)
+		if errors.Cause(err) != v.err {
+			t.Fatalf("%d: OpenJournal failed, expected %v, got %v", i, v.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if n := len(j.Entries()); n != v.entries {
+			t.Errorf("%d: OpenJournal failed, expected %d entries, got %d", i, v.entries, n)
+		}
+		// appending after the cut off line keeps the journal readable
+		if err = j.Append(&JournalEntry{Serial: 1, Kind: EntryEmpty}); err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+		if j, err = OpenJournal(path); err != nil {
+			t.Fatalf("%d: OpenJournal failed, expected nil, got %v", i, err)
+		}
+		if n := len(j.Entries()); n != v.entries+1 {
+			t.Errorf("%d: Append failed, expected %d entries, got %d", i, v.entries+1, n)
+		}
+		j.Close()
+	}
+}
+
+func TestJournalReconcile(t *testing.T) {
+	j, _ := tempJournal(t)
+	defer j.Close()
+
+	res, err := j.Reconcile(3, &Counters{Stacked: 10, Stored: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Missing != 0 {
+		t.Fatalf("Reconcile failed, expected nothing missing, got %s", res)
+	}
+
+	j.RecordEvents(3, journalChannels, []Event{{Code: SspEventCredit, Channel: 1}, {Code: SspEventCredit, Channel: 2}})
+	j.RecordEvents(4, journalChannels, []Event{{Code: SspEventCredit, Channel: 1}})
+	p, _ := j.Begin(3, EntryPayout, 500, "EUR")
+
+	// the power went out after the device stacked the third note
+	res, err = j.Reconcile(3, &Counters{Stacked: 12, Stored: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Journaled != 2 || res.Counted != 3 || res.Missing != 1 || len(res.Pending) != 1 || res.Pending[0].ID != p.ID {
+		t.Fatalf("Reconcile failed, expected 1 missing and pending payout %d, got %s", p.ID, res)
+	}
+	entries := j.Entries()
+	if d := entries[len(entries)-2]; d.Kind != EntryDiscrepancy || d.Serial != 3 {
+		t.Fatalf("Reconcile failed, expected discrepancy of serial 3, got %s", &d)
+	}
+
+	res, err = j.Reconcile(3, &Counters{Stacked: 12, Stored: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Missing != 0 || res.Counted != 0 {
+		t.Fatalf("Reconcile failed, expected nothing counted after the checkpoint, got %s", res)
+	}
+}
+
+func TestJournalMatchLatest(t *testing.T) {
+	j, _ := tempJournal(t)
+	defer j.Close()
+	stale, _ := j.Begin(5, EntryPayout, 3000, "EUR")
+	if err := j.Unresolve(stale, "lost"); err != nil {
+		t.Fatal(err)
+	}
+	older, _ := j.Begin(5, EntryPayout, 2000, "EUR")
+	latest, _ := j.Begin(5, EntryPayout, 1000, "EUR")
+
+	// dispensed events carry no requested value
+	err := j.RecordEvents(5, nil, []Event{{Code: SspEventDispensed, Amounts: []Amount{{Value: 1000, Currency: "EUR"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := j.Entries()
+	if e := entries[len(entries)-1]; e.Ref != latest.ID || e.Status != EntryDone {
+		t.Errorf("RecordEvents failed, expected settlement of %d, got %s", latest.ID, &e)
+	}
+	if pending := j.Pending(5); len(pending) != 1 || pending[0].ID != older.ID {
+		t.Errorf("RecordEvents failed, expected pending %d, got %v", older.ID, pending)
+	}
+}
+
+func TestJournalMatchSameRequested(t *testing.T) {
+	j, _ := tempJournal(t)
+	defer j.Close()
+	orphan, _ := j.Begin(5, EntryPayout, 3000, "EUR")
+	latest, _ := j.Begin(5, EntryPayout, 3000, "EUR")
+
+	err := j.RecordEvents(5, nil, []Event{{Code: SspEventIncompletePayout,
+		Amounts: []Amount{{Value: 2000, Requested: 3000, Currency: "EUR"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := j.Entries()
+	if e := entries[len(entries)-1]; e.Ref != latest.ID || e.Amount != 2000 {
+		t.Errorf("RecordEvents failed, expected settlement of %d, got %s", latest.ID, &e)
+	}
+	if pending := j.Pending(5); len(pending) != 1 || pending[0].ID != orphan.ID {
+		t.Errorf("RecordEvents failed, expected pending %d, got %v", orphan.ID, pending)
+	}
+}
@@ -0,0 +1,320 @@
+package itlssp
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/tarm/serial"
+)
+
+var (
+	ErrInvalidCurrency      = errors.New("Invalid currency code")
+	ErrInvalidDenominations = errors.New("Invalid number of denominations")
+)
+
+// PayoutOption selects whether a payout or float is executed or only tested
+type PayoutOption byte
+
+const (
+	// PayoutReal dispenses the requested value
+	PayoutReal PayoutOption = 0x58
+	// PayoutTest only checks the request can be paid, nothing is dispensed
+	PayoutTest PayoutOption = 0x19
+)
+
+// PayoutStatus is the reason the device declines a payout or float request
+type PayoutStatus byte
+
+const (
+	PayoutOk              PayoutStatus = 0x00
+	PayoutNotEnoughValue  PayoutStatus = 0x01
+	PayoutCannotPayExact  PayoutStatus = 0x02
+	PayoutDeviceBusy      PayoutStatus = 0x03
+	PayoutDeviceDisabled  PayoutStatus = 0x04
+	PayoutUnknownDeclined PayoutStatus = 0xFF
+)
+
+func (code PayoutStatus) String() string {
+	switch code {
+	case PayoutOk:
+		return "Success"
+	case PayoutNotEnoughValue:
+		return "Not enough value in device"
+	case PayoutCannotPayExact:
+		return "Cannot pay exact amount"
+	case PayoutDeviceBusy:
+		return "Device busy"
+	case PayoutDeviceDisabled:
+		return "Device disabled"
+	default:
+		return "Unknown payout status"
+	}
+}
+
+// PayoutResult is the answer of the device to a payout or float request.
+// In PayoutTest mode Ok reports the request would succeed, otherwise
+// Status holds the reason it would fail.
+type PayoutResult struct {
+	Ok     bool
+	Status PayoutStatus
+	Option PayoutOption
+}
+
+func (this *PayoutResult) String() string {
+	return fmt.Sprintf(`{"Ok":%v,"Status":"%s","Test":%v}`, this.Ok, this.Status, this.Option == PayoutTest)
+}
+
+// Denomination is a number of notes or coins of the value in the currency
+type Denomination struct {
+	Count    uint16
+	Value    uint32
+	Currency string
+}
+
+func (this *Denomination) String() string {
+	return fmt.Sprintf(`{"Count":%d,"Value":%d,"Currency":"%s"}`, this.Count, this.Value, this.Currency)
+}
+
+// Route is where the note or coin of a denomination goes after credit
+type Route byte
+
+const (
+	RoutePayout  Route = 0x00
+	RouteCashbox Route = 0x01
+)
+
+func (r Route) String() string {
+	switch r {
+	case RoutePayout:
+		return "Payout"
+	case RouteCashbox:
+		return "Cashbox"
+	default:
+		return "Unknown route"
+	}
+}
+
+// ReportingType selects whether payout events report values or channels
+type ReportingType byte
+
+const (
+	ReportValue   ReportingType = 0x00
+	ReportChannel ReportingType = 0x01
+)
+
+type payout struct {
+	generic
+}
+
+func NewPayout(c *serial.Config) *payout {
+	return &payout{
+		generic: *NewGeneric(c),
+	}
+}
+
+// EnablePayout enables the payout unit of the device
+func (this *payout) EnablePayout() error {
+	buf := []byte{byte(SspCmdEnablePayout)}
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// DisablePayout disables the payout unit, all notes go to the cashbox
+func (this *payout) DisablePayout() error {
+	buf := []byte{byte(SspCmdDisablePayout)}
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// SetInhibits enables note channels by the mask, bit 0 is channel 1
+func (this *payout) SetInhibits(mask uint16) error {
+	buf := append([]byte{byte(SspCmdSetInhibits)}, uint16Bytes(mask)...)
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// EmptyAll moves all stored notes to the cashbox
+func (this *payout) EmptyAll() error {
+	buf := []byte{byte(SspCmdEmptyAll)}
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// SmartEmpty moves all stored notes to the cashbox and counts their value
+func (this *payout) SmartEmpty() error {
+	buf := []byte{byte(SspCmdSmartEmpty)}
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// HaltPayout stops the payout in progress
+func (this *payout) HaltPayout() error {
+	buf := []byte{byte(SspCmdHaltPayout)}
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// SetValueReportingType selects reporting of values or channels
+func (this *payout) SetValueReportingType(t ReportingType) error {
+	buf := []byte{byte(SspCmdSetValueReportingType), byte(t)}
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// PayoutAmount pays out the amount in the currency
+func (this *payout) PayoutAmount(amount uint32, currency string, opt PayoutOption) (*PayoutResult, error) {
+	cc, err := currencyBytes(currency)
+	if err != nil {
+		return nil, err
+	}
+	buf := []byte{byte(SspCmdPayoutAmount)}
+	buf = append(buf, uint32Bytes(amount)...)
+	buf = append(buf, cc...)
+	buf = append(buf, byte(opt))
+	return this.payoutCommand(buf, opt)
+}
+
+// PayoutByDenomination pays out the requested number of each denomination
+func (this *payout) PayoutByDenomination(req []Denomination, opt PayoutOption) (*PayoutResult, error) {
+	buf, err := denominationsBytes(SspCmdPayoutByDenomination, req)
+	if err != nil {
+		return nil, err
+	}
+	return this.payoutCommand(append(buf, byte(opt)), opt)
+}
+
+// FloatAmount moves everything above the amount to the cashbox, keeping
+// payable values not less than minPayout
+func (this *payout) FloatAmount(minPayout uint16, amount uint32, currency string, opt PayoutOption) (*PayoutResult, error) {
+	cc, err := currencyBytes(currency)
+	if err != nil {
+		return nil, err
+	}
+	buf := []byte{byte(SspCmdFloatAmount)}
+	buf = append(buf, uint16Bytes(minPayout)...)
+	buf = append(buf, uint32Bytes(amount)...)
+	buf = append(buf, cc...)
+	buf = append(buf, byte(opt))
+	return this.payoutCommand(buf, opt)
+}
+
+// FloatByDenomination keeps the requested number of each denomination and
+// moves the rest to the cashbox
+func (this *payout) FloatByDenomination(req []Denomination, opt PayoutOption) (*PayoutResult, error) {
+	buf, err := denominationsBytes(SspCmdFloatByDenomination, req)
+	if err != nil {
+		return nil, err
+	}
+	return this.payoutCommand(append(buf, byte(opt)), opt)
+}
+
+// GetAllLevels returns the stored level of every denomination
+func (this *payout) GetAllLevels() ([]Denomination, error) {
+	buf := []byte{byte(SspCmdGetAllLevels)}
+	res, err := this.unit.SendCommand(buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(res) < 2 || len(res) < 2+int(res[1])*9 {
+		return nil, errors.Errorf("Invalid levels data: %X", res)
+	}
+	levels := make([]Denomination, res[1])
+	for i := range levels {
+		p := res[2+i*9:]
+		levels[i] = Denomination{
+			Count:    binary.LittleEndian.Uint16(p[0:2]),
+			Value:    binary.LittleEndian.Uint32(p[2:6]),
+			Currency: string(p[6:9]),
+		}
+	}
+	return levels, nil
+}
+
+// SetDenominationRoute sends the denomination to the payout or to the cashbox
+func (this *payout) SetDenominationRoute(route Route, value uint32, currency string) error {
+	cc, err := currencyBytes(currency)
+	if err != nil {
+		return err
+	}
+	buf := []byte{byte(SspCmdSetDenominationRoute), byte(route)}
+	buf = append(buf, uint32Bytes(value)...)
+	buf = append(buf, cc...)
+	_, err = this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// GetDenominationRoute returns the current route of the denomination
+func (this *payout) GetDenominationRoute(value uint32, currency string) (Route, error) {
+	cc, err := currencyBytes(currency)
+	if err != nil {
+		return 0, err
+	}
+	buf := []byte{byte(SspCmdGetDenominationRoute)}
+	buf = append(buf, uint32Bytes(value)...)
+	buf = append(buf, cc...)
+	res, err := this.unit.SendCommand(buf)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if len(res) < 2 {
+		return 0, errors.Errorf("Invalid route data: %X", res)
+	}
+	return Route(res[1]), nil
+}
+
+// payoutCommand sends payout or float command and converts decline into result
+func (this *payout) payoutCommand(buf []byte, opt PayoutOption) (*PayoutResult, error) {
+	_, err := this.unit.SendCommand(buf)
+	if err == nil {
+		return &PayoutResult{Ok: true, Status: PayoutOk, Option: opt}, nil
+	}
+	if resp, ok := errors.Cause(err).(*ResponseError); ok && resp.Code == SspResponseCannotProcess {
+		status := PayoutUnknownDeclined
+		if len(resp.Data) > 0 {
+			status = PayoutStatus(resp.Data[0])
+		}
+		return &PayoutResult{Ok: false, Status: status, Option: opt}, nil
+	}
+	return nil, errors.WithStack(err)
+}
+
+// denominationsBytes packs command with the list of denominations
+func denominationsBytes(cmd SspCommand, req []Denomination) ([]byte, error) {
+	if len(req) == 0 || len(req) > 20 {
+		return nil, ErrInvalidDenominations
+	}
+	buf := []byte{byte(cmd), byte(len(req))}
+	for _, v := range req {
+		cc, err := currencyBytes(v.Currency)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, uint16Bytes(v.Count)...)
+		buf = append(buf, uint32Bytes(v.Value)...)
+		buf = append(buf, cc...)
+	}
+	return buf, nil
+}
+
+// currencyBytes return three bytes ASCII country code
+func currencyBytes(currency string) ([]byte, error) {
+	if len(currency) != 3 {
+		return nil, errors.WithStack(ErrInvalidCurrency)
+	}
+	return []byte(currency), nil
+}
+
+// uint16Bytes return two bytes little endian value
+func uint16Bytes(v uint16) []byte {
+	buf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(buf, v)
+	return buf
+}
+
+// uint32Bytes return four bytes little endian value
+func uint32Bytes(v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, v)
+	return buf
+}
@@ -0,0 +1,142 @@
+package itlssp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPayoutAmount(t *testing.T) {
+	var table = []struct {
+		opt   PayoutOption
+		reply []byte
+		exp   PayoutResult
+	}{
+		{PayoutTest, []byte{0xF0}, PayoutResult{Ok: true, Status: PayoutOk, Option: PayoutTest}},
+		{PayoutTest, []byte{0xF5, 0x01}, PayoutResult{Ok: false, Status: PayoutNotEnoughValue, Option: PayoutTest}},
+		{PayoutReal, []byte{0xF5, 0x02}, PayoutResult{Ok: false, Status: PayoutCannotPayExact, Option: PayoutReal}},
+		{PayoutReal, []byte{0xF5}, PayoutResult{Ok: false, Status: PayoutUnknownDeclined, Option: PayoutReal}},
+	}
+
+	for _, v := range table {
+		u := &fakeUnit{reply: [][]byte{v.reply}}
+		p := &payout{generic{unit: u}}
+		r, err := p.PayoutAmount(1050, "EUR", v.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*r, v.exp) {
+			t.Errorf("PayoutAmount failed, expected %s, got %s", &v.exp, r)
+		}
+		exp := []byte{0x33, 0x1A, 0x04, 0x00, 0x00, 'E', 'U', 'R', byte(v.opt)}
+		if !reflect.DeepEqual(u.sent[0], exp) {
+			t.Errorf("PayoutAmount command failed, expected %X, got %X", exp, u.sent[0])
+		}
+	}
+}
+
+func TestPayoutFail(t *testing.T) {
+	p := &payout{generic{unit: &fakeUnit{reply: [][]byte{{0xF8}}}}}
+	if _, err := p.PayoutAmount(100, "EUR", PayoutTest); err == nil {
+		t.Error("PayoutAmount failed, expected error on FAIL response")
+	}
+	if _, err := p.PayoutAmount(100, "EURO", PayoutTest); err == nil {
+		t.Error("PayoutAmount failed, expected invalid currency error")
+	}
+}
+
+func TestPayoutByDenomination(t *testing.T) {
+	u := &fakeUnit{}
+	p := &payout{generic{unit: u}}
+	req := []Denomination{
+		{Count: 2, Value: 500, Currency: "EUR"},
+		{Count: 1, Value: 1000, Currency: "EUR"},
+	}
+	if _, err := p.PayoutByDenomination(req, PayoutTest); err != nil {
+		t.Fatal(err)
+	}
+	exp := []byte{0x46, 0x02,
+		0x02, 0x00, 0xF4, 0x01, 0x00, 0x00, 'E', 'U', 'R',
+		0x01, 0x00, 0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R',
+		0x19}
+	if !reflect.DeepEqual(u.sent[0], exp) {
+		t.Errorf("PayoutByDenomination failed, expected %X, got %X", exp, u.sent[0])
+	}
+	if _, err := p.PayoutByDenomination(nil, PayoutTest); err == nil {
+		t.Error("PayoutByDenomination failed, expected error on empty request")
+	}
+}
+
+func TestFloatAmount(t *testing.T) {
+	u := &fakeUnit{}
+	p := &payout{generic{unit: u}}
+	if _, err := p.FloatAmount(100, 5000, "EUR", PayoutReal); err != nil {
+		t.Fatal(err)
+	}
+	exp := []byte{0x3D, 0x64, 0x00, 0x88, 0x13, 0x00, 0x00, 'E', 'U', 'R', 0x58}
+	if !reflect.DeepEqual(u.sent[0], exp) {
+		t.Errorf("FloatAmount failed, expected %X, got %X", exp, u.sent[0])
+	}
+}
+
+func TestGetAllLevels(t *testing.T) {
+	u := &fakeUnit{reply: [][]byte{{0xF0, 0x02,
+		0x05, 0x00, 0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R',
+		0x00, 0x00, 0xD0, 0x07, 0x00, 0x00, 'E', 'U', 'R'}}}
+	p := &payout{generic{unit: u}}
+	r, err := p.GetAllLevels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []Denomination{{Count: 5, Value: 1000, Currency: "EUR"}, {Count: 0, Value: 2000, Currency: "EUR"}}
+	if !reflect.DeepEqual(r, exp) {
+		t.Errorf("GetAllLevels failed, expected %v, got %v", exp, r)
+	}
+}
+
+func TestDenominationRoute(t *testing.T) {
+	u := &fakeUnit{reply: [][]byte{{0xF0}, {0xF0, 0x01}}}
+	p := &payout{generic{unit: u}}
+	if err := p.SetDenominationRoute(RouteCashbox, 1000, "EUR"); err != nil {
+		t.Fatal(err)
+	}
+	exp := []byte{0x3B, 0x01, 0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R'}
+	if !reflect.DeepEqual(u.sent[0], exp) {
+		t.Errorf("SetDenominationRoute failed, expected %X, got %X", exp, u.sent[0])
+	}
+	r, err := p.GetDenominationRoute(1000, "EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != RouteCashbox {
+		t.Errorf("GetDenominationRoute failed, expected %s, got %s", RouteCashbox, r)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	u := &fakeUnit{}
+	p := &payout{generic{unit: u}}
+	if err := p.EmptyAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SmartEmpty(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.HaltPayout(); err != nil {
+		t.Fatal(err)
+	}
+	exp := [][]byte{{0x3F}, {0x52}, {0x38}}
+	if !reflect.DeepEqual(u.sent, exp) {
+		t.Errorf("Empty commands failed, expected %X, got %X", exp, u.sent)
+	}
+}
+
+func TestPayoutInhibits(t *testing.T) {
+	u := &fakeUnit{}
+	p := &payout{generic{unit: u}}
+	if err := p.SetInhibits(0x0005); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []byte{0x02, 0x05, 0x00}; !reflect.DeepEqual(u.sent[0], exp) {
+		t.Errorf("SetInhibits failed, expected %X, got %X", exp, u.sent[0])
+	}
+}
@@ -0,0 +1,95 @@
+package itlssp
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	recoverInterval = 200 * time.Millisecond
+	recoverQuiet    = 3 // polls without payout activity that end the recovery
+)
+
+// PayoutRecovery is the result of RecoverPayouts. Settled are the settlement
+// entries written to the journal, Unresolved are pending operations the device
+// reported nothing about, closed in the journal with EntryUnresolved. Events
+// are all polled events for the application.
+type PayoutRecovery struct {
+	Serial     uint32
+	Settled    []JournalEntry
+	Unresolved []JournalEntry
+	Events     []Event
+}
+
+func (this *PayoutRecovery) String() string {
+	data, _ := json.Marshal(this)
+	return string(data)
+}
+
+// RecoverPayouts settles payouts and floats of the journal interrupted by a
+// reset or power loss. Run it at open, after the sync, the protocol version
+// and the key negotiation. SMART Payout and SMART Hopper report interrupted
+// operations with incomplete events after the reset, carrying the dispensed
+// and the requested values, the operation still running reports its end.
+// Polling stops when nothing is pending or the device stays quiet, ctx limits
+// the time. All polled events are journaled. Operations still pending are
+// closed as unresolved, so they are not settled by later payouts.
+func (this *payout) RecoverPayouts(ctx context.Context, j *Journal) (*PayoutRecovery, error) {
+	serial, err := this.GetSerialNumber()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	setup, err := this.SetupRequest()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	res := &PayoutRecovery{Serial: serial}
+	pending := j.Pending(serial)
+	before := len(j.Entries())
+
+	for polls, quiet := 0, 0; len(j.Pending(serial)) > 0 && quiet < recoverQuiet; polls++ {
+		if polls > 0 {
+			select {
+			case <-ctx.Done():
+				return res, errors.WithStack(ctx.Err())
+			case <-time.After(recoverInterval):
+			}
+		}
+		events, err := this.Poll()
+		if err != nil {
+			return res, errors.WithStack(err)
+		}
+		res.Events = append(res.Events, events...)
+		if err = j.RecordEvents(serial, setup.Channels, events); err != nil {
+			return res, errors.WithStack(err)
+		}
+		quiet++
+		for _, e := range events {
+			switch e.Code {
+			case SspEventSlaveReset, SspEventInitialising, SspEventDispensing, SspEventFloating:
+				quiet = 0
+			}
+		}
+	}
+
+	settled := make(map[uint64]bool)
+	for _, e := range j.Entries()[before:] {
+		if e.Ref != 0 {
+			res.Settled = append(res.Settled, e)
+			settled[e.Ref] = true
+		}
+	}
+	for _, p := range pending {
+		if settled[p.ID] {
+			continue
+		}
+		if err = j.Unresolve(&p, "No outcome reported after reset"); err != nil {
+			return res, errors.WithStack(err)
+		}
+		res.Unresolved = append(res.Unresolved, p)
+	}
+	return res, nil
+}
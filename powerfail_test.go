@@ -0,0 +1,56 @@
+package itlssp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRecoverPayouts(t *testing.T) {
+	serial := []byte{0xF0, 0x00, 0x00, 0x00, 0x2A}
+	// 2000 of 3000 EUR dispensed
+	incomplete := []byte{0xF0, 0xDC, 0x01, 0xD0, 0x07, 0x00, 0x00, 0xB8, 0x0B, 0x00, 0x00, 'E', 'U', 'R', 0xE8}
+	var table = []struct {
+		replies    [][]byte
+		settled    uint32
+		status     EntryStatus
+		unresolved int
+	}{
+		{[][]byte{serial, validatorSetup, {0xF0, 0xF1, 0xE8}, incomplete}, 2000, EntryIncomplete, 0},
+		{[][]byte{serial, validatorSetup, {0xF0, 0xDA, 0x01, 0xB8, 0x0B, 0x00, 0x00, 'E', 'U', 'R'},
+			{0xF0, 0xD2, 0x01, 0xB8, 0x0B, 0x00, 0x00, 'E', 'U', 'R'}}, 3000, EntryDone, 0},
+		{[][]byte{serial, validatorSetup, {0xF0, 0xE8}}, 0, EntryDone, 1},
+	}
+
+	for i, v := range table {
+		j, _ := tempJournal(t)
+		p, err := j.Begin(42, EntryPayout, 3000, "EUR")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev := &payout{generic: generic{unit: &fakeUnit{reply: v.replies}}}
+		res, err := dev.RecoverPayouts(context.Background(), j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Serial != 42 || len(res.Unresolved) != v.unresolved {
+			t.Errorf("%d: RecoverPayouts failed, expected serial 42 with %d unresolved, got %s", i, v.unresolved, res)
+		}
+		if v.unresolved > 0 {
+			entries := j.Entries()
+			last := entries[len(entries)-1]
+			if len(res.Settled) != 0 || len(j.Pending(42)) != 0 || last.Ref != p.ID || last.Status != EntryUnresolved {
+				t.Errorf("%d: RecoverPayouts failed, expected payout %d unresolved, got %s, last entry %s", i, p.ID, res, &last)
+			}
+			j.Close()
+			continue
+		}
+		if len(res.Settled) != 1 {
+			t.Fatalf("%d: RecoverPayouts failed, expected 1 settled payout, got %s", i, res)
+		}
+		e := res.Settled[0]
+		if e.Ref != p.ID || e.Amount != v.settled || e.Requested != 3000 || e.Status != v.status {
+			t.Errorf("%d: RecoverPayouts failed, expected %s of %d, got %s", i, v.status, v.settled, &e)
+		}
+		j.Close()
+	}
+}
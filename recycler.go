@@ -0,0 +1,123 @@
+package itlssp
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// RouteRule keeps Target notes or coins of the denomination in the payout,
+// everything above goes to the cashbox. Zero Value matches every value
+// of the currency, empty Currency matches every currency.
+type RouteRule struct {
+	Value    uint32
+	Currency string
+	Target   uint16
+}
+
+func (this *RouteRule) String() string {
+	return fmt.Sprintf(`{"Value":%d,"Currency":"%s","Target":%d}`, this.Value, this.Currency, this.Target)
+}
+
+// match reports whether the rule covers the denomination, exact rules first
+func (this *RouteRule) match(d Denomination, exact bool) bool {
+	if this.Currency != "" && this.Currency != d.Currency {
+		return false
+	}
+	if exact {
+		return this.Value == d.Value
+	}
+	return this.Value == 0
+}
+
+// Router is the device API of the route policy, the payout or a wrapper of it
+type Router interface {
+	GetAllLevels() ([]Denomination, error)
+	SetDenominationRoute(route Route, value uint32, currency string) error
+}
+
+// RoutePolicy watches poll events and payout levels and keeps denomination
+// routes according to the rules. Routes are changed only when the device is idle.
+type RoutePolicy struct {
+	Rules  []RouteRule
+	dev    Router
+	routes map[string]Route
+	busy   bool
+	dirty  bool
+}
+
+// NewRoutePolicy returns the policy keeping the routes of the device
+func NewRoutePolicy(dev Router, rules ...RouteRule) *RoutePolicy {
+	return &RoutePolicy{
+		Rules:  rules,
+		dev:    dev,
+		routes: make(map[string]Route),
+		dirty:  true,
+	}
+}
+
+// Update takes events of the last poll and applies routes when the device is idle
+func (this *RoutePolicy) Update(events []Event) error {
+	for _, ev := range events {
+		switch ev.Code {
+		case SspEventRead, SspEventStacking, SspEventRejecting, SspEventDispensing, SspEventFloating,
+			SspEventEmptying, SspEventSmartEmptying:
+			this.busy = true
+		case SspEventSlaveReset:
+			this.routes = make(map[string]Route)
+			this.busy, this.dirty = false, true
+		case SspEventCredit, SspEventCoinCredit, SspEventNoteStored, SspEventStacked, SspEventDispensed,
+			SspEventFloated, SspEventEmptied, SspEventSmartEmptied, SspEventCashboxPaid, SspEventRejected,
+			SspEventIncompletePayout, SspEventIncompleteFloat, SspEventNoteTransferred, SspEventHalted,
+			SspEventTimeout:
+			this.busy, this.dirty = false, true
+		}
+	}
+	if len(events) == 0 {
+		this.busy = false
+	}
+	if this.busy || !this.dirty {
+		return nil
+	}
+	return this.Apply()
+}
+
+// Apply reads payout levels and sets changed routes
+func (this *RoutePolicy) Apply() error {
+	levels, err := this.dev.GetAllLevels()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, v := range levels {
+		rule := this.rule(v)
+		if rule == nil {
+			continue
+		}
+		route := RoutePayout
+		if v.Count >= rule.Target {
+			route = RouteCashbox
+		}
+		key := fmt.Sprintf("%d%s", v.Value, v.Currency)
+		if cur, ok := this.routes[key]; ok && cur == route {
+			continue
+		}
+		if err = this.dev.SetDenominationRoute(route, v.Value, v.Currency); err != nil {
+			return errors.WithStack(err)
+		}
+		this.routes[key] = route
+	}
+	this.dirty = false
+	return nil
+}
+
+// rule returns the rule for the denomination or nil
+func (this *RoutePolicy) rule(d Denomination) *RouteRule {
+	for _, exact := range []bool{true, false} {
+		for i := range this.Rules {
+			if this.Rules[i].match(d, exact) {
+				return &this.Rules[i]
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package itlssp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func levelsReply(levels ...Denomination) []byte {
+	buf := []byte{0xF0, byte(len(levels))}
+	for _, v := range levels {
+		buf = append(buf, uint16Bytes(v.Count)...)
+		buf = append(buf, uint32Bytes(v.Value)...)
+		buf = append(buf, v.Currency...)
+	}
+	return buf
+}
+
+func TestRoutePolicy(t *testing.T) {
+	u := &fakeUnit{reply: [][]byte{
+		levelsReply(
+			Denomination{Count: 30, Value: 1000, Currency: "EUR"},
+			Denomination{Count: 10, Value: 2000, Currency: "EUR"},
+		),
+		{0xF0}, {0xF0},
+	}}
+	p := NewRoutePolicy(&payout{generic{unit: u}},
+		RouteRule{Value: 1000, Currency: "EUR", Target: 30},
+		RouteRule{Currency: "EUR", Target: 20},
+	)
+
+	// device is busy, nothing is applied
+	if err := p.Update([]Event{{Code: SspEventRead, Channel: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.sent) != 0 {
+		t.Fatalf("Update failed, expected no commands while busy, got %X", u.sent)
+	}
+
+	if err := p.Update([]Event{{Code: SspEventCredit, Channel: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	exp := [][]byte{
+		{byte(SspCmdGetAllLevels)},
+		{0x3B, 0x01, 0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R'},
+		{0x3B, 0x00, 0xD0, 0x07, 0x00, 0x00, 'E', 'U', 'R'},
+	}
+	if !reflect.DeepEqual(u.sent, exp) {
+		t.Errorf("Update failed, expected %X, got %X", exp, u.sent)
+	}
+
+	// levels unchanged, routes are not sent again
+	u.sent = nil
+	u.reply = [][]byte{levelsReply(
+		Denomination{Count: 30, Value: 1000, Currency: "EUR"},
+		Denomination{Count: 10, Value: 2000, Currency: "EUR"},
+	)}
+	if err := p.Update([]Event{{Code: SspEventNoteStored}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.sent) != 1 {
+		t.Errorf("Update failed, expected only levels request, got %X", u.sent)
+	}
+
+	// idle poll without changes does nothing
+	u.sent = nil
+	if err := p.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.sent) != 0 {
+		t.Errorf("Update failed, expected no commands, got %X", u.sent)
+	}
+}
@@ -0,0 +1,56 @@
+package itlssp
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// OpenTrace returns the reader of the binary or JSON Lines trace
+func OpenTrace(r io.Reader) (TraceReader, error) {
+	buf := bufio.NewReader(r)
+	head, err := buf.Peek(len(traceMagic))
+	if err != nil && err != io.EOF {
+		return nil, errors.WithStack(err)
+	}
+	if string(head) == traceMagic {
+		return NewBinaryTraceReader(buf), nil
+	}
+	return NewJSONTraceReader(buf), nil
+}
+
+// ReplayEvents decodes poll replies of the trace and calls fn with
+// the record and its events, as the device would report them to the host
+func ReplayEvents(r TraceReader, fn func(rec *Record, events []Event) error) error {
+	last := make(map[byte]SspCommand)
+	for i := 0; ; i++ {
+		rec, err := r.ReadRecord()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(rec.Data) == 0 || rec.Name == "INVALID FRAME" {
+			continue
+		}
+		if rec.Data[0] == xSTEX {
+			return errors.Wrapf(ErrEncryptedPacket, "record %d has no key", i)
+		}
+		if rec.Direction == HostToDevice {
+			last[rec.Addr] = SspCommand(rec.Data[0])
+			continue
+		}
+		if last[rec.Addr] != SspCmdPoll || SSPResponse(rec.Data[0]) != SspResponseOk {
+			continue
+		}
+		events, err := DecodeEvents(rec.Data[1:])
+		if err != nil {
+			return errors.Wrapf(err, "record %d", i)
+		}
+		if err = fn(rec, events); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package itlssp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestReplayEvents(t *testing.T) {
+	var buf bytes.Buffer
+	rec := NewRecorder(NewBinaryTraceWriter(&buf))
+	frames := []struct {
+		dir  Direction
+		data []byte
+	}{
+		{HostToDevice, []byte{byte(SspCmdPoll)}},
+		{DeviceToHost, []byte{0xF0, byte(SspEventRead), 0x00}},
+		{HostToDevice, []byte{byte(SspCmdSetupRequest)}},
+		{DeviceToHost, []byte{0xF0, byte(SspEventRead), 0x00}},
+		{HostToDevice, []byte{byte(SspCmdPoll)}},
+		{DeviceToHost, []byte{0xF0, byte(SspEventCredit), 0x03, byte(SspEventStacking)}},
+	}
+	for _, f := range frames {
+		frame, _ := ReadFrame(bytes.NewReader(EncodeFrame(0x80, f.data)))
+		rec.Record(f.dir, frame)
+	}
+
+	r, err := OpenTrace(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codes []SspEvent
+	err = ReplayEvents(r, func(rec *Record, events []Event) error {
+		for _, ev := range events {
+			codes = append(codes, ev.Code)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []SspEvent{SspEventRead, SspEventCredit, SspEventStacking}
+	if !reflect.DeepEqual(codes, exp) {
+		t.Errorf("ReplayEvents failed, expected %v, got %v", exp, codes)
+	}
+}
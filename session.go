@@ -0,0 +1,511 @@
+package itlssp
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrSessionBusy       = errors.New("Session in progress")
+	ErrNoDispenser       = errors.New("Session has no payout device")
+	ErrNothingAcceptable = errors.New("No denomination can be changed")
+)
+
+const (
+	sessionPoll          = 200 * time.Millisecond
+	defaultPayoutTimeout = time.Minute
+)
+
+// SessionState is the stage of the vending session
+type SessionState byte
+
+const (
+	SessionIdle SessionState = iota
+	SessionCollecting
+	SessionPaid
+	SessionCompleted
+	SessionCancelled
+)
+
+var sessionStates = map[SessionState]string{
+	SessionIdle:       "Idle",
+	SessionCollecting: "Collecting",
+	SessionPaid:       "Paid",
+	SessionCompleted:  "Completed",
+	SessionCancelled:  "Cancelled",
+}
+
+func (s SessionState) String() string {
+	if v, ok := sessionStates[s]; ok {
+		return v
+	}
+	return "Unknown"
+}
+
+// MarshalText encodes the state by name
+func (s SessionState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Kinds of receipt items
+const (
+	ItemCredit = "Credit"
+	ItemChange = "Change"
+	ItemRefund = "Refund"
+)
+
+// ReceiptItem is the credited note or coin, the change or the refund.
+// Requested is the payout amount asked from the device.
+type ReceiptItem struct {
+	Time      time.Time
+	Kind      string
+	Channel   byte `json:",omitempty"`
+	Amount    uint32
+	Requested uint32 `json:",omitempty"`
+}
+
+// Receipt is the complete record of the session. Owed is the change or
+// refund the device could not pay out.
+type Receipt struct {
+	Serial   uint32
+	Currency string
+	Price    uint32
+	Paid     uint32
+	Change   uint32
+	Refunded uint32
+	Owed     uint32
+	State    SessionState
+	Started  time.Time
+	Finished time.Time
+	Items    []ReceiptItem
+}
+
+func (this *Receipt) String() string {
+	data, _ := json.Marshal(this)
+	return string(data)
+}
+
+// acceptor is the device taking cash, a validator or a payout
+type acceptor interface {
+	SetupRequest() (*SetupData, error)
+	GetSerialNumber() (uint32, error)
+	SetInhibits(mask uint16) error
+	Enable() error
+	Disable() error
+	Poll() ([]Event, error)
+}
+
+// dispenser is the device giving change, a payout or a hopper
+type dispenser interface {
+	GetSerialNumber() (uint32, error)
+	Enable() error
+	Disable() error
+	EnablePayout() error
+	PayoutAmount(amount uint32, currency string, opt PayoutOption) (*PayoutResult, error)
+	Poll() ([]Event, error)
+}
+
+// Session is the vending flow of one sale: Collect takes cash until the price
+// is met, GiveChange pays out the overpayment and Cancel refunds the collected
+// cash. Channels whose value could not be changed are inhibited. The dispenser
+// may be the acceptor itself (SMART Payout) or nil when no change is given.
+// With ExactChange the inhibits are computed again after every credit from
+// the remaining amount and the current stock of the dispenser, when no note
+// is acceptable any more Collect ends with ErrNothingAcceptable.
+type Session struct {
+	PayoutTimeout time.Duration
+	ExactChange   bool
+
+	acc      acceptor
+	disp     dispenser
+	journal  *Journal
+	currency string
+	channels []Channel
+	serial   uint32
+	dserial  uint32 // serial of the dispenser, its operations are journaled under it
+	ready    bool
+
+	mu      sync.Mutex
+	receipt Receipt
+	stop    context.CancelFunc
+	done    chan struct{}
+}
+
+func NewSession(acc acceptor, disp dispenser, currency string) *Session {
+	return &Session{PayoutTimeout: defaultPayoutTimeout, acc: acc, disp: disp, currency: currency}
+}
+
+// SetJournal journals credits and payouts of the session
+func (this *Session) SetJournal(j *Journal) {
+	this.journal = j
+}
+
+// Receipt returns the receipt of the current or the last session
+func (this *Session) Receipt() *Receipt {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.copyReceipt()
+}
+
+func (this *Session) copyReceipt() *Receipt {
+	r := this.receipt
+	r.Items = append([]ReceiptItem(nil), r.Items...)
+	return &r
+}
+
+// setup reads channel values and the serial number once
+func (this *Session) setup() error {
+	if this.ready {
+		return nil
+	}
+	setup, err := this.acc.SetupRequest()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if this.serial, err = this.acc.GetSerialNumber(); err != nil {
+		return errors.WithStack(err)
+	}
+	this.dserial = this.serial
+	if this.disp != nil && !this.shared() {
+		if this.dserial, err = this.disp.GetSerialNumber(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	this.channels, this.ready = setup.Channels, true
+	return nil
+}
+
+// shared reports whether the acceptor gives the change itself
+func (this *Session) shared() bool {
+	a, ok := this.disp.(acceptor)
+	return ok && a == this.acc
+}
+
+// Collect enables the acceptor and takes cash until the price is met, then
+// disables it. When ctx is done the collected cash stays in the session,
+// Cancel refunds it.
+func (this *Session) Collect(ctx context.Context, price uint32) (*Receipt, error) {
+	this.mu.Lock()
+	if s := this.receipt.State; s == SessionCollecting || s == SessionPaid {
+		this.mu.Unlock()
+		return nil, ErrSessionBusy
+	}
+	ctx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	this.stop, this.done = stop, done
+	this.receipt = Receipt{Currency: this.currency, Price: price, State: SessionCollecting, Started: time.Now()}
+	this.mu.Unlock()
+	defer close(done)
+	defer stop()
+
+	err := this.collect(ctx, price)
+	if e := this.acc.Disable(); err == nil {
+		err = errors.WithStack(e)
+	}
+	if this.disp != nil && !this.shared() {
+		if e := this.disp.Disable(); err == nil {
+			err = errors.WithStack(e)
+		}
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.receipt.Paid >= price {
+		this.receipt.State = SessionPaid
+	}
+	return this.copyReceipt(), err
+}
+
+func (this *Session) collect(ctx context.Context, price uint32) error {
+	if err := this.setup(); err != nil {
+		return err
+	}
+	this.mu.Lock()
+	this.receipt.Serial = this.serial
+	this.mu.Unlock()
+
+	// payout tests of the change need the dispenser enabled, nothing is
+	// accepted until the inhibits are known
+	if err := this.acc.SetInhibits(0); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := this.acc.Enable(); err != nil {
+		return errors.WithStack(err)
+	}
+	if this.disp != nil {
+		if err := this.enableDispenser(); err != nil {
+			return err
+		}
+	}
+	if err := this.inhibit(price); err != nil {
+		return err
+	}
+	for {
+		events, err := this.acc.Poll()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		this.mu.Lock()
+		before := this.receipt.Paid
+		this.mu.Unlock()
+		if err = this.record(events); err != nil {
+			return err
+		}
+		this.mu.Lock()
+		paid := this.receipt.Paid
+		this.mu.Unlock()
+		if paid >= price {
+			return nil
+		}
+		if this.ExactChange && paid != before {
+			if err = this.inhibit(price); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(sessionPoll):
+		}
+	}
+}
+
+// dispChannels are the channels of the dispenser for journaling its events
+func (this *Session) dispChannels() []Channel {
+	if this.shared() {
+		return this.channels
+	}
+	return nil
+}
+
+// record journals the events and adds credits to the receipt
+func (this *Session) record(events []Event) error {
+	if this.journal != nil {
+		if err := this.journal.RecordEvents(this.serial, this.channels, events); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, e := range events {
+		item := ReceiptItem{Time: time.Now(), Kind: ItemCredit, Channel: e.Channel}
+		switch e.Code {
+		case SspEventCredit:
+			if n := int(e.Channel); n > 0 && n <= len(this.channels) {
+				item.Amount = uint32(this.channels[n-1].Value)
+			}
+		case SspEventCoinCredit:
+			item.Amount, _, _ = sumAmounts(e.Amounts)
+		default:
+			continue
+		}
+		this.receipt.Paid += item.Amount
+		this.receipt.Items = append(this.receipt.Items, item)
+	}
+	return nil
+}
+
+// inhibit sets the channel inhibits for the remaining amount
+func (this *Session) inhibit(price uint32) error {
+	mask, err := this.changeMask(price)
+	if err != nil {
+		return err
+	}
+	if mask == 0 {
+		return ErrNothingAcceptable
+	}
+	return errors.WithStack(this.acc.SetInhibits(mask))
+}
+
+// changeMask enables the channels of the currency whose notes need no
+// change at the price or the change can be paid out now
+func (this *Session) changeMask(price uint32) (uint16, error) {
+	this.mu.Lock()
+	remaining := int64(price) - int64(this.receipt.Paid)
+	this.mu.Unlock()
+	var mask uint16
+	for i, ch := range this.channels {
+		if i >= 16 || string(ch.Currency) != this.currency {
+			continue
+		}
+		ok, err := this.canChange(int64(ch.Value) - remaining)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask, nil
+}
+
+// canChange tests whether the dispenser can pay out the overpayment
+func (this *Session) canChange(over int64) (bool, error) {
+	if over <= 0 {
+		return true, nil
+	}
+	if this.disp == nil {
+		return false, nil
+	}
+	res, err := this.disp.PayoutAmount(uint32(over), this.currency, PayoutTest)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return res.Ok, nil
+}
+
+// GiveChange pays out the overpayment of the paid session
+func (this *Session) GiveChange() (*Receipt, error) {
+	this.mu.Lock()
+	if this.receipt.State != SessionPaid {
+		defer this.mu.Unlock()
+		return this.copyReceipt(), errors.Errorf("Session is %s", this.receipt.State)
+	}
+	change := this.receipt.Paid - this.receipt.Price
+	this.mu.Unlock()
+
+	var paid uint32
+	var err error
+	if change > 0 {
+		paid, err = this.pay(change)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.receipt.Change = paid
+	this.receipt.Owed = change - paid
+	if change > 0 {
+		this.receipt.Items = append(this.receipt.Items,
+			ReceiptItem{Time: time.Now(), Kind: ItemChange, Amount: paid, Requested: change})
+	}
+	this.receipt.State, this.receipt.Finished = SessionCompleted, time.Now()
+	return this.copyReceipt(), err
+}
+
+// Cancel stops collecting and refunds the collected cash
+func (this *Session) Cancel() (*Receipt, error) {
+	this.mu.Lock()
+	stop, done := this.stop, this.done
+	this.mu.Unlock()
+	if stop != nil {
+		stop()
+		<-done
+	}
+
+	this.mu.Lock()
+	if s := this.receipt.State; s != SessionCollecting && s != SessionPaid {
+		defer this.mu.Unlock()
+		return this.copyReceipt(), errors.Errorf("Session is %s", s)
+	}
+	refund := this.receipt.Paid
+	this.mu.Unlock()
+
+	var paid uint32
+	var err error
+	if refund > 0 {
+		paid, err = this.pay(refund)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.receipt.Refunded = paid
+	this.receipt.Owed = refund - paid
+	if refund > 0 {
+		this.receipt.Items = append(this.receipt.Items,
+			ReceiptItem{Time: time.Now(), Kind: ItemRefund, Amount: paid, Requested: refund})
+	}
+	this.receipt.State, this.receipt.Finished = SessionCancelled, time.Now()
+	return this.copyReceipt(), err
+}
+
+// enableDispenser enables the dispenser and its payout, a shared unit with
+// all channels inhibited so it takes no cash meanwhile
+func (this *Session) enableDispenser() error {
+	if this.shared() {
+		if err := this.acc.SetInhibits(0); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := this.disp.Enable(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(this.disp.EnablePayout())
+}
+
+// pay pays out the amount and polls the dispenser until the payout ends,
+// returns the dispensed value. The dispenser is enabled meanwhile as
+// disabled units decline payouts.
+func (this *Session) pay(amount uint32) (uint32, error) {
+	if this.disp == nil {
+		return 0, ErrNoDispenser
+	}
+	if err := this.setup(); err != nil {
+		return 0, err
+	}
+	if err := this.enableDispenser(); err != nil {
+		return 0, err
+	}
+	defer this.disp.Disable()
+	var pending *JournalEntry
+	if this.journal != nil {
+		var err error
+		if pending, err = this.journal.Begin(this.dserial, EntryPayout, amount, this.currency); err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	res, err := this.disp.PayoutAmount(amount, this.currency, PayoutReal)
+	if err != nil {
+		// a refused or unsent command paid nothing, otherwise the outcome
+		// is unknown and RecoverPayouts settles it
+		if Refused(err) || errors.Cause(err) == ErrInvalidCurrency {
+			if serr := this.settle(pending, 0); serr != nil {
+				return 0, serr
+			}
+		}
+		return 0, errors.WithStack(err)
+	}
+	if !res.Ok {
+		if err = this.settle(pending, 0); err != nil {
+			return 0, err
+		}
+		return 0, errors.Errorf("Payout declined: %s", res.Status)
+	}
+
+	var dispensed uint32
+	deadline := time.Now().Add(this.PayoutTimeout)
+	for time.Now().Before(deadline) {
+		events, err := this.disp.Poll()
+		if err != nil {
+			return dispensed, errors.WithStack(err)
+		}
+		if this.journal != nil {
+			if err = this.journal.RecordEvents(this.dserial, this.dispChannels(), events); err != nil {
+				return dispensed, errors.WithStack(err)
+			}
+		}
+		for _, e := range events {
+			switch e.Code {
+			case SspEventDispensing, SspEventJammed:
+				dispensed, _, _ = sumAmounts(e.Amounts)
+			case SspEventDispensed, SspEventIncompletePayout:
+				dispensed, _, _ = sumAmounts(e.Amounts)
+				return dispensed, nil
+			case SspEventHalted:
+				// the journal settles dispensed and incomplete events only
+				dispensed, _, _ = sumAmounts(e.Amounts)
+				return dispensed, this.settle(pending, dispensed)
+			}
+		}
+		time.Sleep(sessionPoll)
+	}
+	return dispensed, errors.Errorf("Payout not finished in %v", this.PayoutTimeout)
+}
+
+// settle closes the journaled payout with the dispensed value
+func (this *Session) settle(pending *JournalEntry, dispensed uint32) error {
+	if pending == nil {
+		return nil
+	}
+	return errors.WithStack(this.journal.Settle(pending, dispensed))
+}
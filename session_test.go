@@ -0,0 +1,321 @@
+package itlssp
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fakeCash is a SMART Payout taking the scripted credits and paying out up
+// to stock
+type fakeCash struct {
+	serial   uint32 // 9 if zero
+	mu       sync.Mutex
+	credits  [][]Event
+	stock    uint32
+	inhibits uint16
+	enabled  bool
+	decline  bool
+	halt     bool  // payouts end with the halted event
+	fail     error // returned by PayoutAmount
+	broken   error // returned by EnablePayout
+	payouts  []uint32
+}
+
+func (this *fakeCash) SetupRequest() (*SetupData, error) {
+	return &SetupData{Channels: []Channel{
+		{Channel: 1, Value: 500, Currency: []byte("EUR")},
+		{Channel: 2, Value: 1000, Currency: []byte("EUR")},
+		{Channel: 3, Value: 2000, Currency: []byte("EUR")},
+		{Channel: 4, Value: 500, Currency: []byte("GBP")},
+	}}, nil
+}
+
+func (this *fakeCash) GetSerialNumber() (uint32, error) {
+	if this.serial == 0 {
+		return 9, nil
+	}
+	return this.serial, nil
+}
+
+func (this *fakeCash) SetInhibits(mask uint16) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.inhibits = mask
+	return nil
+}
+
+func (this *fakeCash) Enable() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.enabled = true
+	return nil
+}
+
+func (this *fakeCash) Disable() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.enabled = false
+	return nil
+}
+
+func (this *fakeCash) EnablePayout() error { return this.broken }
+
+func (this *fakeCash) PayoutAmount(amount uint32, currency string, opt PayoutOption) (*PayoutResult, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if !this.enabled {
+		return &PayoutResult{Ok: false, Status: PayoutDeviceDisabled, Option: opt}, nil
+	}
+	if opt == PayoutTest {
+		return &PayoutResult{Ok: amount <= this.stock, Option: opt}, nil
+	}
+	if this.decline {
+		return &PayoutResult{Ok: false, Status: PayoutNotEnoughValue, Option: opt}, nil
+	}
+	if this.fail != nil {
+		return nil, this.fail
+	}
+	this.payouts = append(this.payouts, amount)
+	return &PayoutResult{Ok: true, Status: PayoutOk, Option: opt}, nil
+}
+
+func (this *fakeCash) Poll() ([]Event, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if n := len(this.payouts); n > 0 {
+		amount := this.payouts[n-1]
+		this.payouts = this.payouts[:n-1]
+		code := SspEventDispensed
+		if amount > this.stock {
+			amount, code = this.stock, SspEventIncompletePayout
+		}
+		if this.halt {
+			amount, code = amount/2, SspEventHalted
+		}
+		this.stock -= amount
+		return []Event{{Code: code, Amounts: []Amount{{Value: amount, Currency: "EUR"}}}}, nil
+	}
+	if len(this.credits) == 0 || !this.enabled {
+		return nil, nil
+	}
+	events := this.credits[0]
+	this.credits = this.credits[1:]
+	for _, e := range events {
+		if e.Code == SspEventCredit && this.inhibits&(1<<(e.Channel-1)) == 0 {
+			return []Event{{Code: SspEventRejected}}, nil
+		}
+	}
+	return events, nil
+}
+
+func credit(channel byte) []Event {
+	return []Event{{Code: SspEventRead, Channel: channel}, {Code: SspEventCredit, Channel: channel}}
+}
+
+func TestSessionCollect(t *testing.T) {
+	var table = []struct {
+		price    uint32
+		credits  [][]Event
+		stock    uint32
+		inhibits uint16
+		change   uint32
+		owed     uint32
+	}{
+		{1500, [][]Event{credit(2), nil, credit(1)}, 0, 0x03, 0, 0},
+		{1500, [][]Event{credit(3)}, 500, 0x07, 500, 0},
+		{1500, [][]Event{credit(2), credit(2)}, 0, 0x03, 0, 500},
+		{300, [][]Event{credit(1)}, 200, 0x01, 200, 0},
+	}
+
+	for i, v := range table {
+		dev := &fakeCash{credits: v.credits, stock: v.stock}
+		s := NewSession(dev, dev, "EUR")
+		r, err := s.Collect(context.Background(), v.price)
+		if err != nil {
+			t.Fatalf("%d: Collect failed, expected nil, got %v", i, err)
+		}
+		if r.State != SessionPaid || r.Serial != 9 || dev.inhibits != v.inhibits || dev.enabled {
+			t.Errorf("%d: Collect failed, expected paid session of serial 9 and inhibits %#x, got %s, inhibits %#x", i, v.inhibits, r, dev.inhibits)
+		}
+		if _, err = s.Collect(context.Background(), v.price); err != ErrSessionBusy {
+			t.Errorf("%d: Collect failed, expected %v, got %v", i, ErrSessionBusy, err)
+		}
+		r, err = s.GiveChange()
+		if err != nil {
+			t.Fatalf("%d: GiveChange failed, expected nil, got %v", i, err)
+		}
+		if r.State != SessionCompleted || r.Change != v.change || r.Owed != v.owed {
+			t.Errorf("%d: GiveChange failed, expected change %d owed %d, got %s", i, v.change, v.owed, r)
+		}
+	}
+}
+
+func TestSessionExactChange(t *testing.T) {
+	var table = []struct {
+		price    uint32
+		credits  [][]Event
+		stock    uint32
+		paid     uint32
+		inhibits uint16
+		err      error
+	}{
+		{1500, [][]Event{credit(2), credit(2), credit(1)}, 0, 1500, 0x01, nil},
+		{1500, [][]Event{credit(2), credit(3), credit(2)}, 500, 2000, 0x03, nil},
+		{1200, [][]Event{credit(2)}, 0, 1000, 0x03, ErrNothingAcceptable},
+	}
+
+	for i, v := range table {
+		dev := &fakeCash{credits: v.credits, stock: v.stock}
+		s := NewSession(dev, dev, "EUR")
+		s.ExactChange = true
+		r, err := s.Collect(context.Background(), v.price)
+		if errors.Cause(err) != v.err || r.Paid != v.paid || dev.inhibits != v.inhibits {
+			t.Errorf("%d: Collect failed, expected paid %d, %v, inhibits %#x, got %s, %v, inhibits %#x", i, v.paid, v.err, v.inhibits, r, err, dev.inhibits)
+		}
+	}
+}
+
+func TestSessionCancel(t *testing.T) {
+	dev := &fakeCash{credits: [][]Event{credit(1)}, stock: 2000}
+	s := NewSession(dev, dev, "EUR")
+	done := make(chan error)
+	go func() {
+		_, err := s.Collect(context.Background(), 1500)
+		done <- err
+	}()
+	for s.Receipt().Paid == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r, err := s.Cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; errors.Cause(err) != context.Canceled {
+		t.Errorf("Collect failed, expected %v, got %v", context.Canceled, err)
+	}
+	if r.State != SessionCancelled || r.Refunded != 500 || r.Owed != 0 || len(r.Items) != 2 || r.Items[1].Kind != ItemRefund {
+		t.Errorf("Cancel failed, expected 500 refunded, got %s", r)
+	}
+	if _, err = s.Cancel(); err == nil {
+		t.Error("Cancel failed, expected error of a cancelled session, got nil")
+	}
+	if _, err = s.GiveChange(); err == nil {
+		t.Error("GiveChange failed, expected error of a cancelled session, got nil")
+	}
+}
+
+func TestSessionNoChange(t *testing.T) {
+	dev := &fakeCash{credits: [][]Event{credit(1)}}
+	s := NewSession(dev, nil, "EUR")
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	r, err := s.Collect(ctx, 700)
+	if errors.Cause(err) != context.DeadlineExceeded || dev.inhibits != 0x01 || r.Paid != 500 {
+		t.Fatalf("Collect failed, expected paid 500, %v, inhibits 0x1, got %s, %v, inhibits %#x", context.DeadlineExceeded, r, err, dev.inhibits)
+	}
+	if r, err = s.Cancel(); err != ErrNoDispenser || r.Owed != 500 || r.State != SessionCancelled {
+		t.Errorf("Cancel failed, expected 500 owed, %v, got %s, %v", ErrNoDispenser, r, err)
+	}
+
+	// nothing is acceptable below the smallest note
+	if _, err = s.Collect(context.Background(), 200); err != ErrNothingAcceptable {
+		t.Errorf("Collect failed, expected %v, got %v", ErrNothingAcceptable, err)
+	}
+}
+
+func TestSessionJournal(t *testing.T) {
+	j, _ := tempJournal(t)
+	defer j.Close()
+	dev := &fakeCash{credits: [][]Event{credit(3)}, stock: 500, decline: true}
+	s := NewSession(dev, dev, "EUR")
+	s.SetJournal(j)
+	if _, err := s.Collect(context.Background(), 1500); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.GiveChange()
+	if err == nil || r.Owed != 500 {
+		t.Fatalf("GiveChange failed, expected error and 500 owed, got %s, %v", r, err)
+	}
+
+	entries := j.Entries()
+	if len(entries) != 3 || entries[0].Kind != EntryCredit || entries[0].Amount != 2000 || entries[0].Serial != 9 {
+		t.Fatalf("GiveChange failed, expected credit of serial 9 and settled payout, got %v", entries)
+	}
+	if e := entries[2]; e.Kind != EntryPayout || e.Ref != entries[1].ID || e.Amount != 0 || e.Requested != 500 {
+		t.Errorf("GiveChange failed, expected settlement of %d with 0 of 500, got %s", entries[1].ID, &e)
+	}
+	if pending := j.Pending(9); len(pending) != 0 {
+		t.Errorf("GiveChange failed, expected no pending payout, got %v", pending)
+	}
+}
+
+func TestSessionHopperJournal(t *testing.T) {
+	j, _ := tempJournal(t)
+	defer j.Close()
+	acc := &fakeCash{credits: [][]Event{credit(3)}}
+	hopper := &fakeCash{serial: 77, stock: 1000}
+	s := NewSession(acc, hopper, "EUR")
+	s.SetJournal(j)
+	if _, err := s.Collect(context.Background(), 1500); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.GiveChange()
+	if err != nil || r.Change != 500 || hopper.enabled {
+		t.Fatalf("GiveChange failed, expected change 500 and disabled hopper, got %s, %v, hopper enabled %v", r, err, hopper.enabled)
+	}
+
+	entries := j.Entries()
+	if len(entries) != 3 || entries[0].Serial != 9 || entries[1].Serial != 77 || entries[2].Serial != 77 ||
+		entries[2].Ref != entries[1].ID {
+		t.Fatalf("GiveChange failed, expected credit of serial 9 and settled payout of serial 77, got %v", entries)
+	}
+	if pending := j.Pending(77); len(pending) != 0 {
+		t.Errorf("GiveChange failed, expected no pending payout, got %v", pending)
+	}
+}
+
+func TestSessionPayoutJournal(t *testing.T) {
+	var table = []struct {
+		hopper  *fakeCash
+		broken  error // of the payout after the collect
+		entries int
+		pending bool
+		amount  uint32
+	}{
+		{&fakeCash{}, errors.New("port closed"), 0, false, 0},
+		{&fakeCash{fail: &ResponseError{Code: SspResponseFail}}, nil, 2, false, 0},
+		{&fakeCash{fail: ErrReplyLost}, nil, 1, true, 0},
+		{&fakeCash{halt: true}, nil, 2, false, 250},
+	}
+
+	for i, v := range table {
+		j, _ := tempJournal(t)
+		acc := &fakeCash{credits: [][]Event{credit(3)}}
+		v.hopper.serial, v.hopper.stock = 77, 1000
+		s := NewSession(acc, v.hopper, "EUR")
+		s.SetJournal(j)
+		if _, err := s.Collect(context.Background(), 1500); err != nil {
+			t.Fatal(err)
+		}
+		v.hopper.broken = v.broken
+		s.GiveChange()
+
+		var entries []JournalEntry
+		for _, e := range j.Entries() {
+			if e.Serial == 77 {
+				entries = append(entries, e)
+			}
+		}
+		if len(entries) != v.entries || (len(j.Pending(77)) != 0) != v.pending {
+			t.Errorf("%d: GiveChange failed, expected %d entries, pending %t, got %v", i, v.entries, v.pending, entries)
+		} else if v.entries == 2 && (entries[1].Ref != entries[0].ID || entries[1].Amount != v.amount) {
+			t.Errorf("%d: GiveChange failed, expected settlement of %d, got %s", i, v.amount, &entries[1])
+		}
+		j.Close()
+	}
+}
@@ -0,0 +1,135 @@
+package simulator
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/charoit/itlssp"
+	"github.com/pkg/errors"
+)
+
+// exchange is a recorded command and the device reply, nil if the
+// device did not answer
+type exchange struct {
+	command []byte
+	reply   []byte
+}
+
+// Mismatch is a host command different from the recorded one,
+// Want is nil for commands after the end of the trace
+type Mismatch struct {
+	Index int
+	Want  []byte
+	Got   []byte
+}
+
+func (this *Mismatch) String() string {
+	if this.Want == nil {
+		return fmt.Sprintf("command %d: unexpected %s %X", this.Index, itlssp.SspCommand(this.Got[0]), this.Got)
+	}
+	return fmt.Sprintf("command %d: want %s %X, got %s %X", this.Index,
+		itlssp.SspCommand(this.Want[0]), this.Want, itlssp.SspCommand(this.Got[0]), this.Got)
+}
+
+// Replay answers the host with the device replies of the recorded trace
+// and compares host commands with the recorded ones. eSSP keys are
+// negotiated again, so the trace must be recorded with decrypted payloads.
+type Replay struct {
+	*Simulator
+	exchanges  []exchange
+	next       int
+	mismatches []Mismatch
+}
+
+// NewReplay reads the trace and returns the replay of its device
+func NewReplay(r itlssp.TraceReader) (*Replay, error) {
+	this := &Replay{Simulator: New(itlssp.Validator, "")}
+	this.exec = this.execute
+	addr := -1
+	for i := 0; ; i++ {
+		rec, err := r.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(rec.Data) == 0 || rec.Name == "INVALID FRAME" || (addr >= 0 && int(rec.Addr) != addr) {
+			continue
+		}
+		if rec.Data[0] == itlssp.STEX {
+			return nil, errors.Errorf("Trace record %d is encrypted, record it with the key", i)
+		}
+		if rec.Direction == itlssp.HostToDevice {
+			addr = int(rec.Addr)
+			this.exchanges = append(this.exchanges, exchange{command: rec.Data})
+		} else if n := len(this.exchanges); n > 0 && this.exchanges[n-1].reply == nil {
+			this.exchanges[n-1].reply = rec.Data
+		}
+	}
+	if addr < 0 {
+		return nil, errors.New("Trace has no host commands")
+	}
+	this.Addr = byte(addr)
+	return this, nil
+}
+
+// Mismatches returns host commands different from the trace
+func (this *Replay) Mismatches() []Mismatch {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]Mismatch(nil), this.mismatches...)
+}
+
+// Done reports whether all recorded commands were received
+func (this *Replay) Done() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.next >= len(this.exchanges)
+}
+
+// Err returns the mismatches and the number of commands the host did not send
+func (this *Replay) Err() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var failed []string
+	for _, m := range this.mismatches {
+		failed = append(failed, m.String())
+	}
+	if rest := len(this.exchanges) - this.next; rest > 0 {
+		failed = append(failed, fmt.Sprintf("%d recorded commands not sent", rest))
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("Replay failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// execute compares the command with the trace and returns the recorded
+// reply, key exchange commands are compared by code and answered live
+func (this *Replay) execute(data []byte) []byte {
+	this.received = append(this.received, Command{Time: time.Now(), Data: append([]byte(nil), data...)})
+	if this.next >= len(this.exchanges) {
+		this.mismatches = append(this.mismatches, Mismatch{Index: this.next, Got: data})
+		this.next++
+		return []byte{respFail}
+	}
+	ex := this.exchanges[this.next]
+	index := this.next
+	this.next++
+
+	switch cmd := itlssp.SspCommand(data[0]); cmd {
+	case itlssp.SspCmdSetGenerator, itlssp.SspCmdSetModulus, itlssp.SspCmdRequestKeyExchange:
+		if ex.command[0] == data[0] {
+			return this.keyExchange(cmd, data)
+		}
+	default:
+		if string(ex.command) == string(data) {
+			return ex.reply
+		}
+	}
+	this.mismatches = append(this.mismatches, Mismatch{Index: index, Want: ex.command, Got: data})
+	return ex.reply
+}
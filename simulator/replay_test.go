@@ -0,0 +1,79 @@
+package simulator
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/charoit/itlssp"
+)
+
+// session runs the host logic of the test, enable skips the enable command
+func session(name string, rec *itlssp.Recorder, enable bool) error {
+	cfg := itlssp.PortConfig(name, 9600)
+	dev := itlssp.NewValidator(cfg)
+	if rec != nil {
+		dev.SetRecorder(rec)
+	}
+	if err := dev.Open(cfg); err != nil {
+		return err
+	}
+	defer dev.Close()
+	if err := dev.Sync(); err != nil {
+		return err
+	}
+	if err := dev.NegotiateKeys(itlssp.DefaultFixedKey); err != nil {
+		return err
+	}
+	if err := dev.SetInhibits(0x0003); err != nil {
+		return err
+	}
+	if enable {
+		if err := dev.Enable(); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < 6; i++ {
+		if _, err := dev.Poll(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestReplay(t *testing.T) {
+	sim := New(itlssp.Validator, "EUR", 500, 1000)
+	sim.Listen("replay-record")
+	defer itlssp.UnregisterPort("replay-record")
+	sim.InsertNote(2)
+
+	var trace bytes.Buffer
+	if err := session("replay-record", itlssp.NewRecorder(itlssp.NewJSONTraceWriter(&trace)), true); err != nil {
+		t.Fatal(err)
+	}
+
+	var table = []struct {
+		enable bool
+		ok     bool
+	}{
+		{true, true},
+		{false, false},
+	}
+	for i, v := range table {
+		r, err := itlssp.OpenTrace(bytes.NewReader(trace.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		replay, err := NewReplay(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replay.Listen("replay-play")
+		if err = session("replay-play", nil, v.enable); err != nil {
+			t.Fatal(err)
+		}
+		itlssp.UnregisterPort("replay-play")
+		if err = replay.Err(); (err == nil) != v.ok {
+			t.Errorf("%d: Replay failed, expected ok %t, got %v", i, v.ok, err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package simulator
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/charoit/itlssp"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Device describes the simulated device of the scenario. Levels and
+// Recycling are the stored notes and the payout route of each channel.
+type Device struct {
+	Type      string `json:"Type" yaml:"Type"` // validator, payout, nv11 or hopper
+	Currency  string `json:"Currency" yaml:"Currency"`
+	Values    []int  `json:"Values" yaml:"Values"`
+	Levels    []int  `json:"Levels,omitempty" yaml:"Levels,omitempty"`
+	Recycling []bool `json:"Recycling,omitempty" yaml:"Recycling,omitempty"`
+}
+
+// Action is an event of the device at the poll of the host, counted from
+// the scenario start. The poll reply already reports the action.
+type Action struct {
+	Poll    int    `json:"Poll" yaml:"Poll"`
+	Do      string `json:"Do" yaml:"Do"`
+	Channel byte   `json:"Channel,omitempty" yaml:"Channel,omitempty"`
+	Reason  byte   `json:"Reason,omitempty" yaml:"Reason,omitempty"`
+	Safe    bool   `json:"Safe,omitempty" yaml:"Safe,omitempty"`
+	Events  string `json:"Events,omitempty" yaml:"Events,omitempty"` // hex poll events of queue
+}
+
+// Actions of scenario files
+const (
+	ActionInsert           = "insert"
+	ActionInvalid          = "invalid"
+	ActionJam              = "jam"
+	ActionFraud            = "fraud"
+	ActionCashbox          = "cashbox"
+	ActionStackerFull      = "stacker-full"
+	ActionReset            = "reset"
+	ActionPayoutJam        = "payout-jam"
+	ActionPayoutIncomplete = "payout-incomplete"
+	ActionPayoutPowerLoss  = "payout-power-loss"
+	ActionQueue            = "queue"
+)
+
+// Expect asserts the number of host commands received from the poll From
+// up to the poll To, zero To is the scenario end. Command is the command
+// name as "POLL COMMAND" or hex prefix of the command data as "3301". Max
+// nil does not limit the number.
+type Expect struct {
+	Command string `json:"Command" yaml:"Command"`
+	Min     int    `json:"Min" yaml:"Min"`
+	Max     *int   `json:"Max,omitempty" yaml:"Max,omitempty"`
+	From    int    `json:"From,omitempty" yaml:"From,omitempty"`
+	To      int    `json:"To,omitempty" yaml:"To,omitempty"`
+
+	prefix []byte
+}
+
+// Scenario is the sequence of device events with assertions on commands
+// the host sends in response. The time line is the number of host polls,
+// so the scenario does not depend on the poll interval. The scenario ends
+// with the poll Polls, at least the poll of the last action.
+type Scenario struct {
+	Name        string   `json:"Name" yaml:"Name"`
+	Description string   `json:"Description,omitempty" yaml:"Description,omitempty"`
+	Device      *Device  `json:"Device,omitempty" yaml:"Device,omitempty"`
+	Polls       int      `json:"Polls" yaml:"Polls"`
+	Actions     []Action `json:"Actions" yaml:"Actions"`
+	Expect      []Expect `json:"Expect" yaml:"Expect"`
+}
+
+// script is the scenario played by the simulator, polls count from base
+type script struct {
+	actions []Action
+	base    int
+	end     int
+	done    chan struct{}
+}
+
+// LoadScenario reads the scenario file, .yaml and .yml files are YAML,
+// other files JSON
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	parse := ParseScenario
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		parse = ParseYAMLScenario
+	}
+	sc, err := parse(data)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	return sc, nil
+}
+
+// ParseScenario decodes and checks the JSON scenario
+func ParseScenario(data []byte) (*Scenario, error) {
+	sc := &Scenario{}
+	if err := json.Unmarshal(data, sc); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := sc.check(); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// ParseYAMLScenario decodes and checks the YAML scenario, keys are the
+// field names as in JSON
+func ParseYAMLScenario(data []byte) (*Scenario, error) {
+	sc := &Scenario{}
+	if err := yaml.Unmarshal(data, sc); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := sc.check(); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// check checks the actions and expectations and sets the scenario end
+func (this *Scenario) check() error {
+	for i, a := range this.Actions {
+		if err := a.check(); err != nil {
+			return errors.Wrapf(err, "Action %d", i)
+		}
+		if a.Poll > this.Polls {
+			this.Polls = a.Poll
+		}
+	}
+	for i := range this.Expect {
+		prefix, err := commandPrefix(this.Expect[i].Command)
+		if err != nil {
+			return errors.Wrapf(err, "Expect %d", i)
+		}
+		this.Expect[i].prefix = prefix
+	}
+	return nil
+}
+
+// Simulator returns a new simulator of the scenario device
+func (this *Scenario) Simulator() (*Simulator, error) {
+	d := this.Device
+	if d == nil {
+		return nil, errors.Errorf("Scenario %q has no device", this.Name)
+	}
+	var t itlssp.UnitType
+	switch d.Type {
+	case "", "validator":
+		t = itlssp.Validator
+	case "payout":
+		t = itlssp.SMARTPayout
+	case "nv11":
+		t = itlssp.NV11
+	case "hopper":
+		t = itlssp.SMARTHopper
+	default:
+		return nil, errors.Errorf("Unknown device type %q", d.Type)
+	}
+	sim := New(t, d.Currency, d.Values...)
+	for i := range sim.Channels {
+		if i < len(d.Levels) {
+			sim.Channels[i].Level = d.Levels[i]
+		}
+		if i < len(d.Recycling) {
+			sim.Channels[i].Recycling = d.Recycling[i]
+		}
+	}
+	return sim, nil
+}
+
+// Play runs the scenario actions at the polls of the host and checks the
+// expectations when the scenario ends. A host that stops polling blocks
+// Play until ctx is done.
+func (this *Simulator) Play(ctx context.Context, sc *Scenario) error {
+	this.mu.Lock()
+	start := len(this.received)
+	sp := &script{base: this.polls, end: this.polls + sc.Polls, done: make(chan struct{})}
+	sp.actions = append(sp.actions, sc.Actions...)
+	sort.SliceStable(sp.actions, func(i, j int) bool { return sp.actions[i].Poll < sp.actions[j].Poll })
+	this.script = sp
+	this.advance()
+	this.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		this.mu.Lock()
+		this.script = nil
+		this.mu.Unlock()
+		return errors.WithStack(ctx.Err())
+	case <-sp.done:
+	}
+	commands := this.Commands()[start:]
+	for i := range commands {
+		commands[i].Poll -= sp.base
+	}
+	return sc.Check(commands)
+}
+
+// Do applies the action to the device
+func (this *Simulator) Do(a Action) error {
+	if err := a.check(); err != nil {
+		return errors.WithStack(err)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.do(a)
+	return nil
+}
+
+// do applies the checked action
+func (this *Simulator) do(a Action) {
+	switch a.Do {
+	case ActionInsert:
+		this.insertNote(a.Channel)
+	case ActionInvalid:
+		this.rejectNote(a.Reason)
+	case ActionJam:
+		this.jam(a.Safe)
+	case ActionFraud:
+		this.queue(byte(itlssp.SspEventFraudAttempt), a.Channel)
+	case ActionCashbox:
+		this.removeCashbox()
+	case ActionStackerFull:
+		this.queue(byte(itlssp.SspEventStackerFull))
+	case ActionReset:
+		this.powerReset()
+	case ActionPayoutJam:
+		this.fault = FaultJam
+	case ActionPayoutIncomplete:
+		this.fault = FaultIncomplete
+	case ActionPayoutPowerLoss:
+		this.fault = FaultPowerLoss
+	case ActionQueue:
+		events, _ := hex.DecodeString(a.Events)
+		this.queue(events...)
+	}
+}
+
+// advance applies the script actions due at the current poll and ends
+// the script at its last poll
+func (this *Simulator) advance() {
+	sp := this.script
+	if sp == nil {
+		return
+	}
+	for len(sp.actions) > 0 && sp.base+sp.actions[0].Poll <= this.polls {
+		this.do(sp.actions[0])
+		sp.actions = sp.actions[1:]
+	}
+	if this.polls >= sp.end && len(sp.actions) == 0 {
+		close(sp.done)
+		this.script = nil
+	}
+}
+
+// Check matches commands received since the scenario start with the
+// expectations, Poll of the commands counts from the start
+func (this *Scenario) Check(commands []Command) error {
+	var failed []string
+	for _, e := range this.Expect {
+		to := this.Polls
+		if e.To != 0 {
+			to = e.To
+		}
+		var n int
+		for _, cmd := range commands {
+			if cmd.Poll >= e.From && cmd.Poll <= to && e.match(cmd.Data) {
+				n++
+			}
+		}
+		if n < e.Min || (e.Max != nil && n > *e.Max) {
+			failed = append(failed, fmt.Sprintf("%s received %d times", e.String(), n))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("Scenario %q failed: %s", this.Name, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (this *Expect) String() string {
+	max := "any"
+	if this.Max != nil {
+		max = fmt.Sprint(*this.Max)
+	}
+	return fmt.Sprintf("%s [%d..%s] in polls %d..%d", this.Command, this.Min, max, this.From, this.To)
+}
+
+// match reports whether the command data starts with the expected prefix
+func (this *Expect) match(data []byte) bool {
+	return len(data) >= len(this.prefix) && string(data[:len(this.prefix)]) == string(this.prefix)
+}
+
+// check reports actions with invalid parameters
+func (this *Action) check() error {
+	if this.Poll < 0 {
+		return errors.Errorf("Invalid poll %d", this.Poll)
+	}
+	switch this.Do {
+	case ActionInsert, ActionFraud:
+		if this.Channel == 0 {
+			return errors.Errorf("%s needs a channel", this.Do)
+		}
+	case ActionQueue:
+		if _, err := hex.DecodeString(this.Events); err != nil || this.Events == "" {
+			return errors.Errorf("Invalid queue events %q", this.Events)
+		}
+	case ActionInvalid, ActionJam, ActionCashbox, ActionStackerFull, ActionReset, ActionPayoutJam,
+		ActionPayoutIncomplete, ActionPayoutPowerLoss:
+	default:
+		return errors.Errorf("Unknown action %q", this.Do)
+	}
+	return nil
+}
+
+// commandPrefix returns the command data prefix of the command name or hex
+func commandPrefix(s string) ([]byte, error) {
+	for c := 0; c < 0x100; c++ {
+		if strings.EqualFold(itlssp.SspCommand(c).String(), s) {
+			return []byte{byte(c)}, nil
+		}
+	}
+	prefix, err := hex.DecodeString(s)
+	if err != nil || len(prefix) == 0 {
+		return nil, errors.Errorf("Unknown command %q", s)
+	}
+	return prefix, nil
+}
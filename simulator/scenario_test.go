@@ -0,0 +1,236 @@
+package simulator
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/charoit/itlssp"
+)
+
+// TestScenarios plays the regression scenarios against a polling host
+func TestScenarios(t *testing.T) {
+	files, err := filepath.Glob("testdata/scenarios/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	yamlFiles, err := filepath.Glob("testdata/scenarios/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, yamlFiles...)
+	for _, file := range files {
+		sc, err := LoadScenario(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(sc.Name, func(t *testing.T) {
+			sim, err := sc.Simulator()
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := "scenario-" + sc.Name
+			sim.Listen(name)
+			defer itlssp.UnregisterPort(name)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			polling := make(chan error, 1)
+			go func() { polling <- host(ctx, name) }()
+			if err := sim.Play(ctx, sc); err != nil {
+				t.Error(err)
+			}
+			cancel()
+			if err := <-polling; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// host sets up the validator and polls it until the context is done
+func host(ctx context.Context, name string) error {
+	cfg := itlssp.PortConfig(name, 9600)
+	dev := itlssp.NewValidator(cfg)
+	dev.Supervise(itlssp.Recovery{Protocol: 7})
+	if err := dev.Open(cfg); err != nil {
+		return err
+	}
+	defer dev.Close()
+	if err := dev.Sync(); err != nil {
+		return err
+	}
+	if err := dev.HostProtocolVersion(7); err != nil {
+		return err
+	}
+	if err := dev.SetInhibits(0xFFFF); err != nil {
+		return err
+	}
+	if err := dev.Enable(); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if _, err := dev.Poll(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func TestParseScenario(t *testing.T) {
+	var table = []struct {
+		data  string
+		ok    bool
+		polls int
+	}{
+		{`{"Name":"a","Actions":[{"Poll":3,"Do":"insert","Channel":1}],"Expect":[{"Command":"POLL COMMAND","Min":1}]}`, true, 3},
+		{`{"Name":"b","Polls":10,"Actions":[{"Poll":3,"Do":"reset"}]}`, true, 10},
+		{`{"Name":"c","Actions":[{"Poll":1,"Do":"insert"}]}`, false, 0},
+		{`{"Name":"d","Actions":[{"Poll":1,"Do":"explode"}]}`, false, 0},
+		{`{"Name":"e","Actions":[{"Poll":"soon","Do":"reset"}]}`, false, 0},
+		{`{"Name":"f","Expect":[{"Command":"PING"}]}`, false, 0},
+		{`{"Name":"g","Expect":[{"Command":"3301"}]}`, true, 0},
+	}
+
+	for i, v := range table {
+		sc, err := ParseScenario([]byte(v.data))
+		if (err == nil) != v.ok {
+			t.Errorf("%d: ParseScenario failed, expected ok %t, got %v", i, v.ok, err)
+			continue
+		}
+		if v.ok && sc.Polls != v.polls {
+			t.Errorf("%d: ParseScenario failed, expected %d polls, got %d", i, v.polls, sc.Polls)
+		}
+	}
+}
+
+func TestParseYAMLScenario(t *testing.T) {
+	var table = []struct {
+		data  string
+		ok    bool
+		polls int
+	}{
+		{"Name: a\nActions:\n  - {Poll: 3, Do: insert, Channel: 1}\nExpect:\n  - {Command: POLL COMMAND, Min: 1}\n", true, 3},
+		{"Name: b\nPolls: 10\nActions:\n  - Poll: 3\n    Do: reset\n", true, 10},
+		{"Name: c\nActions:\n  - {Poll: 1, Do: insert}\n", false, 0},
+		{"Name: e\nActions:\n  - {Poll: soon, Do: reset}\n", false, 0},
+		{"Name: g\nExpect:\n  - {Command: \"3301\", Max: 0}\n", true, 0},
+		{"Name: [h\n", false, 0},
+	}
+
+	for i, v := range table {
+		sc, err := ParseYAMLScenario([]byte(v.data))
+		if (err == nil) != v.ok {
+			t.Errorf("%d: ParseYAMLScenario failed, expected ok %t, got %v", i, v.ok, err)
+			continue
+		}
+		if v.ok && sc.Polls != v.polls {
+			t.Errorf("%d: ParseYAMLScenario failed, expected %d polls, got %d", i, v.polls, sc.Polls)
+		}
+	}
+}
+
+func TestScenarioCheck(t *testing.T) {
+	zero := 0
+	sc := &Scenario{
+		Name:  "check",
+		Polls: 10,
+		Expect: []Expect{
+			{Command: "POLL COMMAND", Min: 2, prefix: []byte{byte(itlssp.SspCmdPoll)}},
+			{Command: "PAYOUT", Max: &zero, From: 5, prefix: []byte{byte(itlssp.SspCmdPayoutAmount)}},
+		},
+	}
+	commands := []Command{
+		{Poll: 1, Data: []byte{byte(itlssp.SspCmdPoll)}},
+		{Poll: 1, Data: []byte{byte(itlssp.SspCmdPayoutAmount)}},
+		{Poll: 2, Data: []byte{byte(itlssp.SspCmdPoll)}},
+		{Poll: 11, Data: []byte{byte(itlssp.SspCmdPayoutAmount)}},
+	}
+	if err := sc.Check(commands); err != nil {
+		t.Error(err)
+	}
+	commands = append(commands, Command{Poll: 7, Data: []byte{byte(itlssp.SspCmdPayoutAmount)}})
+	if err := sc.Check(commands); err == nil {
+		t.Error("Check failed, expected error of payout after poll 5")
+	}
+}
+
+func TestScenarioPlay(t *testing.T) {
+	sc, err := ParseScenario([]byte(`{"Name":"play","Polls":6,
+		"Actions":[{"Poll":1,"Do":"queue","Events":"E8"},{"Poll":2,"Do":"insert","Channel":1}],
+		"Expect":[{"Command":"POLL COMMAND","Min":6,"Max":6}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim := New(itlssp.Validator, "EUR", 500, 1000)
+	sim.enabled = true
+	sim.inhibits = 0x0003
+
+	done := make(chan error)
+	go func() { done <- sim.Play(context.Background(), sc) }()
+	for started := false; !started; runtime.Gosched() {
+		sim.mu.Lock()
+		started = sim.script != nil
+		sim.mu.Unlock()
+	}
+	var events []byte
+	for i := 0; i < 6; i++ {
+		sim.mu.Lock()
+		events = append(events, sim.execute([]byte{byte(itlssp.SspCmdPoll)})[1:]...)
+		sim.mu.Unlock()
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	read, credit := byte(itlssp.SspEventRead), byte(itlssp.SspEventCredit)
+	exp := []byte{0xE8, read, 0x00, read, 0x01, byte(itlssp.SspEventStacking), credit, 0x01, byte(itlssp.SspEventStacking),
+		byte(itlssp.SspEventStacked)}
+	if string(events) != string(exp) {
+		t.Errorf("Play failed, expected events %X, got %X", exp, events)
+	}
+}
+
+func TestPayoutFault(t *testing.T) {
+	var table = []struct {
+		fault  Fault
+		code   itlssp.SspEvent
+		paid   uint32
+		levels []int
+	}{
+		{FaultIncomplete, itlssp.SspEventIncompletePayout, 2000, []int{2, 1}},
+		{FaultJam, itlssp.SspEventJammed, 2000, []int{2, 1}},
+		{FaultNone, itlssp.SspEventDispensed, 3000, []int{1, 1}},
+	}
+
+	for i, v := range table {
+		sim := New(itlssp.SMARTPayout, "EUR", 1000, 2000)
+		sim.SetLevel(1, 2, true)
+		sim.SetLevel(2, 2, true)
+		sim.enabled, sim.payoutOn = true, true
+		sim.PayoutFault(v.fault)
+		if res := sim.payoutAmount(3000, "EUR", byte(itlssp.PayoutReal)); res[0] != respOk {
+			t.Fatalf("%d: PayoutAmount failed, expected %X, got %X", i, respOk, res)
+		}
+		sim.poll()
+		events, err := itlssp.DecodeEvents(sim.poll()[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].Code != v.code || events[0].Amounts[0].Value != v.paid {
+			t.Errorf("%d: Poll failed, expected %s of %d, got %v", i, v.code, v.paid, events)
+		}
+		for j, level := range v.levels {
+			if sim.Channels[j].Level != level {
+				t.Errorf("%d: PayoutAmount failed, expected channel %d level %d, got %d", i, j+1, level, sim.Channels[j].Level)
+			}
+		}
+	}
+}
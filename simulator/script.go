@@ -0,0 +1,384 @@
+package simulator
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/charoit/itlssp"
+)
+
+// step is the reply of one poll, apply changes the device state when
+// the events are reported and returns more events
+type step struct {
+	events []byte
+	apply  func(*Simulator) []byte
+	note   bool // part of the note in escrow, dropped on reject
+}
+
+// Reject reasons of the last reject code command
+const (
+	RejectNoteAccepted   byte = 0x00
+	RejectLengthFail     byte = 0x01
+	RejectChannelInhibit byte = 0x06
+	RejectValidation     byte = 0x07
+	RejectRearSensor     byte = 0x0D
+	RejectDisabled       byte = 0x13
+)
+
+// Fault is a failure of the next payout
+type Fault byte
+
+const (
+	FaultNone       Fault = iota
+	FaultJam              // payout jams before the last note
+	FaultIncomplete       // payout ends without the last note
+	FaultPowerLoss        // power fails before the last note, reported after PowerReset
+)
+
+// PayoutFault makes the next payout or float fail
+func (this *Simulator) PayoutFault(fault Fault) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.fault = fault
+}
+
+// Queue adds a poll reply with raw events
+func (this *Simulator) Queue(events ...byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.queue(events...)
+}
+
+// Pending returns the number of poll replies not reported yet
+func (this *Simulator) Pending() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.steps)
+}
+
+// InsertNote reads the note of the channel, holds it in escrow and
+// stacks it or stores it in the payout if the channel is recycling.
+// A note of an inhibited channel or inserted while disabled is rejected.
+func (this *Simulator) InsertNote(channel byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.insertNote(channel)
+}
+
+// InsertInvalidNote reads a note and rejects it with the reason
+func (this *Simulator) InsertInvalidNote(reason byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.rejectNote(reason)
+}
+
+// Jam jams the note in the device, safe jam is not reachable from the front
+func (this *Simulator) Jam(safe bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.jam(safe)
+}
+
+// Fraud reports fraud attempt on the channel
+func (this *Simulator) Fraud(channel byte) {
+	this.Queue(byte(itlssp.SspEventFraudAttempt), channel)
+}
+
+// RemoveCashbox reports the cashbox removed and replaced
+func (this *Simulator) RemoveCashbox() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.removeCashbox()
+}
+
+// StackerFull reports the stacker is full
+func (this *Simulator) StackerFull() {
+	this.Queue(byte(itlssp.SspEventStackerFull))
+}
+
+// PowerReset resets the device, it loses the session and reports slave reset
+func (this *Simulator) PowerReset() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.powerReset()
+}
+
+// SetLevel sets the stored number of notes of the channel
+func (this *Simulator) SetLevel(channel byte, level int, recycling bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if channel > 0 && int(channel) <= len(this.Channels) {
+		this.Channels[channel-1].Level = level
+		this.Channels[channel-1].Recycling = recycling
+	}
+}
+
+// queue adds a poll reply with raw events
+func (this *Simulator) queue(events ...byte) {
+	this.steps = append(this.steps, step{events: events})
+}
+
+// insertNote adds the read, credit and stack sequence of the note
+func (this *Simulator) insertNote(channel byte) {
+	if !this.enabled {
+		this.rejectNote(RejectDisabled)
+		return
+	}
+	if channel == 0 || int(channel) > len(this.Channels) || this.inhibits&(1<<(channel-1)) == 0 {
+		this.rejectNote(RejectChannelInhibit)
+		return
+	}
+	read, credit := byte(itlssp.SspEventRead), byte(itlssp.SspEventCredit)
+	this.steps = append(this.steps,
+		step{events: []byte{read, 0x00}},
+		step{events: []byte{read, channel}, note: true, apply: func(s *Simulator) []byte {
+			s.escrow = channel
+			return nil
+		}},
+		step{events: []byte{byte(itlssp.SspEventStacking)}, note: true, apply: func(s *Simulator) []byte {
+			s.escrow = 0
+			return nil
+		}},
+		step{events: []byte{credit, channel, byte(itlssp.SspEventStacking)}, note: true},
+		step{note: true, apply: func(s *Simulator) []byte {
+			ch := &s.Channels[channel-1]
+			if ch.Recycling && s.payoutOn {
+				ch.Level++
+				s.counters.Stored++
+				return []byte{byte(itlssp.SspEventNoteStored)}
+			}
+			s.counters.Stacked++
+			return []byte{byte(itlssp.SspEventStacked)}
+		}},
+	)
+}
+
+// jam queues the jam event
+func (this *Simulator) jam(safe bool) {
+	ev := itlssp.SspEventUnsafeJam
+	if safe {
+		ev = itlssp.SspEventSafeJam
+	}
+	this.queue(byte(ev))
+}
+
+// removeCashbox queues the cashbox removed and replaced events
+func (this *Simulator) removeCashbox() {
+	this.queue(byte(itlssp.SspEventCashboxRemoved))
+	this.queue(byte(itlssp.SspEventCashboxReplaced))
+}
+
+// powerReset drops the scripted events and resets the device
+func (this *Simulator) powerReset() {
+	this.steps = nil
+	this.reset()
+}
+
+// rejectNote adds the reject sequence of a note
+func (this *Simulator) rejectNote(reason byte) {
+	this.steps = append(this.steps,
+		step{events: []byte{byte(itlssp.SspEventRead), 0x00}},
+		step{events: []byte{byte(itlssp.SspEventRejecting)}},
+		step{events: []byte{byte(itlssp.SspEventRejected)}, apply: func(s *Simulator) []byte {
+			s.lastReject = reason
+			s.counters.Rejected++
+			return nil
+		}},
+	)
+}
+
+// rejectEscrow replaces the rest of the note in escrow with rejecting
+func (this *Simulator) rejectEscrow() {
+	rest := this.steps[:0]
+	for _, s := range this.steps {
+		if !s.note {
+			rest = append(rest, s)
+		}
+	}
+	this.escrow = 0
+	this.steps = append([]step{
+		{events: []byte{byte(itlssp.SspEventRejecting)}},
+		{events: []byte{byte(itlssp.SspEventRejected)}, apply: func(s *Simulator) []byte {
+			s.lastReject = RejectNoteAccepted
+			s.counters.Rejected++
+			return nil
+		}},
+	}, rest...)
+}
+
+// payoutAmount pays the amount with stored notes, highest values first
+func (this *Simulator) payoutAmount(amount uint32, currency string, opt byte) []byte {
+	plan, status := this.plan(amount, currency)
+	if status != 0 {
+		return []byte{respCannotProcess, status}
+	}
+	if opt == byte(itlssp.PayoutTest) {
+		return []byte{respOk}
+	}
+	this.dispense(plan, amount, currency, itlssp.SspEventDispensing, itlssp.SspEventDispensed)
+	return []byte{respOk}
+}
+
+// payoutByDenomination pays the requested number of each denomination
+func (this *Simulator) payoutByDenomination(data []byte) []byte {
+	if len(data) < 2 || len(data) < 3+int(data[1])*9 {
+		return []byte{respWrongParams}
+	}
+	if !this.enabled || !this.payoutOn {
+		return []byte{respCannotProcess, byte(itlssp.PayoutDeviceDisabled)}
+	}
+	plan := make(map[int]int)
+	var amount uint32
+	var currency string
+	for i := 0; i < int(data[1]); i++ {
+		p := data[2+i*9:]
+		count := int(binary.LittleEndian.Uint16(p[0:2]))
+		value := binary.LittleEndian.Uint32(p[2:6])
+		currency = string(p[6:9])
+		ch := this.channel(value, currency)
+		if ch == nil || !ch.Recycling || ch.Level < count {
+			return []byte{respCannotProcess, byte(itlssp.PayoutNotEnoughValue)}
+		}
+		plan[int(ch.Channel)-1] += count
+		amount += value * uint32(count)
+	}
+	if data[len(data)-1] == byte(itlssp.PayoutTest) {
+		return []byte{respOk}
+	}
+	this.dispense(plan, amount, currency, itlssp.SspEventDispensing, itlssp.SspEventDispensed)
+	return []byte{respOk}
+}
+
+// floatAmount moves stored notes above the amount to the cashbox
+func (this *Simulator) floatAmount(amount uint32, currency string, opt byte) []byte {
+	if !this.enabled || !this.payoutOn {
+		return []byte{respCannotProcess, byte(itlssp.PayoutDeviceDisabled)}
+	}
+	total := this.stored(currency)
+	if total < amount {
+		return []byte{respCannotProcess, byte(itlssp.PayoutNotEnoughValue)}
+	}
+	plan, status := this.plan(total-amount, currency)
+	if status != 0 {
+		return []byte{respCannotProcess, status}
+	}
+	if opt == byte(itlssp.PayoutTest) {
+		return []byte{respOk}
+	}
+	this.dispense(plan, total-amount, currency, itlssp.SspEventFloating, itlssp.SspEventFloated)
+	return []byte{respOk}
+}
+
+// empty moves all stored notes to the cashbox
+func (this *Simulator) empty(cmd itlssp.SspCommand) []byte {
+	var total uint32
+	for i := range this.Channels {
+		total += uint32(this.Channels[i].Value * this.Channels[i].Level)
+		this.counters.Transferred += uint32(this.Channels[i].Level)
+		this.Channels[i].Level = 0
+	}
+	if cmd == itlssp.SspCmdSmartEmpty {
+		value := valueData(total, this.Currency)
+		this.steps = append(this.steps,
+			step{events: append([]byte{byte(itlssp.SspEventSmartEmptying)}, value...)},
+			step{events: append([]byte{byte(itlssp.SspEventSmartEmptied)}, value...)},
+		)
+		return []byte{respOk}
+	}
+	this.steps = append(this.steps,
+		step{events: []byte{byte(itlssp.SspEventEmptying)}},
+		step{events: []byte{byte(itlssp.SspEventEmptied)}},
+	)
+	return []byte{respOk}
+}
+
+// plan selects stored notes for the amount, returns channel index to count
+func (this *Simulator) plan(amount uint32, currency string) (map[int]int, byte) {
+	if !this.enabled || !this.payoutOn {
+		return nil, byte(itlssp.PayoutDeviceDisabled)
+	}
+	if this.stored(currency) < amount {
+		return nil, byte(itlssp.PayoutNotEnoughValue)
+	}
+	var idx []int
+	for i, ch := range this.Channels {
+		if ch.Recycling && ch.Level > 0 && string(ch.Currency) == currency {
+			idx = append(idx, i)
+		}
+	}
+	sort.Slice(idx, func(a, b int) bool { return this.Channels[idx[a]].Value > this.Channels[idx[b]].Value })
+	plan := make(map[int]int)
+	rest := amount
+	for _, i := range idx {
+		ch := this.Channels[i]
+		n := int(rest / uint32(ch.Value))
+		if n > ch.Level {
+			n = ch.Level
+		}
+		if n > 0 {
+			plan[i] = n
+			rest -= uint32(n * ch.Value)
+		}
+	}
+	if rest != 0 {
+		return nil, byte(itlssp.PayoutCannotPayExact)
+	}
+	return plan, 0
+}
+
+// dispense takes the planned notes and reports the progress and the end events,
+// a payout fault keeps the last note and reports the fault instead
+func (this *Simulator) dispense(plan map[int]int, amount uint32, currency string, progress, done itlssp.SspEvent) {
+	fault := this.fault
+	this.fault = FaultNone
+	paid := amount
+	if fault != FaultNone {
+		// the note of the lowest planned channel stays in the device
+		idx := make([]int, 0, len(plan))
+		for i := range plan {
+			idx = append(idx, i)
+		}
+		sort.Ints(idx)
+		plan[idx[0]]--
+		paid -= uint32(this.Channels[idx[0]].Value)
+	}
+	for i, n := range plan {
+		this.Channels[i].Level -= n
+		this.counters.Dispensed += uint32(n)
+	}
+	value := valueData(paid, currency)
+	this.steps = append(this.steps, step{events: append([]byte{byte(progress)}, value...)})
+	switch fault {
+	case FaultJam:
+		this.steps = append(this.steps, step{events: append([]byte{byte(itlssp.SspEventJammed)}, value...)})
+	case FaultIncomplete, FaultPowerLoss:
+		ev := []byte{byte(itlssp.SspEventIncompletePayout), 0x01}
+		if progress == itlssp.SspEventFloating {
+			ev[0] = byte(itlssp.SspEventIncompleteFloat)
+		}
+		ev = append(append(append(ev, le32(paid)...), le32(amount)...), pad(currency, 3)...)
+		if fault == FaultPowerLoss {
+			this.interrupted = ev
+			break
+		}
+		this.steps = append(this.steps, step{events: ev})
+	default:
+		this.steps = append(this.steps, step{events: append([]byte{byte(done)}, value...)})
+	}
+}
+
+// stored returns the total payable value in the currency
+func (this *Simulator) stored(currency string) uint32 {
+	var total uint32
+	for _, ch := range this.Channels {
+		if ch.Recycling && string(ch.Currency) == currency {
+			total += uint32(ch.Value * ch.Level)
+		}
+	}
+	return total
+}
+
+// valueData encodes event value data of one currency
+func valueData(value uint32, currency string) []byte {
+	return append(append([]byte{0x01}, le32(value)...), pad(currency, 3)...)
+}
@@ -0,0 +1,506 @@
+// Package simulator is the slave side of SSP for tests without hardware.
+package simulator
+
+import (
+	"encoding/binary"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/charoit/itlssp"
+	"github.com/pkg/errors"
+	"github.com/tarm/serial"
+)
+
+const (
+	respOk            = 0xF0
+	respUnknown       = 0xF2
+	respWrongParams   = 0xF3
+	respOutOfRange    = 0xF4
+	respCannotProcess = 0xF5
+	respFail          = 0xF8
+	respKeyNotSet     = 0xFA
+
+	seqUnknown = 0xFF
+)
+
+// Simulator is the SSP device. Channels are the channel table, Level
+// and Recycling of a channel are the payout stock and route.
+type Simulator struct {
+	Addr     byte
+	Type     itlssp.UnitType
+	Firmware string
+	Dataset  string
+	Currency string
+	Serial   uint32
+	Protocol byte
+	Channels []itlssp.Channel
+
+	mu          sync.Mutex
+	protocol    byte
+	enabled     bool
+	payoutOn    bool
+	inhibits    uint16
+	seq         byte
+	last        []byte
+	enc         *itlssp.Encryption
+	fixedKey    uint64
+	gen         *big.Int
+	mod         *big.Int
+	steps       []step
+	escrow      byte
+	lastReject  byte
+	fault       Fault
+	interrupted []byte // incomplete payout event reported after reset
+	counters    itlssp.Counters
+	received    []Command
+	polls       int
+	script      *script                  // scenario played by Play
+	exec        func(data []byte) []byte // replaces execute, used by replay
+}
+
+// Command is a command received from the host, Poll is the number of
+// polls received up to the command
+type Command struct {
+	Time time.Time
+	Poll int
+	Data []byte
+}
+
+// New returns the simulator of the unit type with the channel values in the currency
+func New(t itlssp.UnitType, currency string, values ...int) *Simulator {
+	s := &Simulator{
+		Type:     t,
+		Firmware: "0400",
+		Dataset:  currency + "01610",
+		Currency: currency,
+		Serial:   1000001,
+		Protocol: 7,
+		fixedKey: itlssp.DefaultFixedKey,
+		seq:      seqUnknown,
+	}
+	if t == itlssp.SMARTHopper {
+		s.Addr = itlssp.AddrHopper
+	}
+	for i, v := range values {
+		s.Channels = append(s.Channels, itlssp.Channel{
+			Value:    v,
+			Channel:  byte(i + 1),
+			Currency: []byte(currency),
+		})
+	}
+	return s
+}
+
+// SetFixedKey sets the eSSP fixed key of the device
+func (this *Simulator) SetFixedKey(key uint64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.fixedKey = key
+}
+
+// Listen registers the port name, every open of the port connects
+// a new in-memory line served by the simulator
+func (this *Simulator) Listen(name string) {
+	itlssp.RegisterPort(name, func(cfg *serial.Config) (io.ReadWriteCloser, error) {
+		timeout := cfg.ReadTimeout
+		if timeout < 100*time.Millisecond {
+			timeout = 100 * time.Millisecond // serial port rounds up to deciseconds
+		}
+		host, slave := itlssp.Pipe(timeout)
+		go this.Serve(slave)
+		return host, nil
+	})
+}
+
+// Serve answers frames of the connection until it is closed
+func (this *Simulator) Serve(conn io.ReadWriter) error {
+	for {
+		frame, err := itlssp.ReadFrame(conn)
+		if err == io.EOF {
+			continue // read timeout
+		}
+		if err != nil {
+			if err == io.ErrClosedPipe {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		if reply := this.Handle(frame); reply != nil {
+			if _, err = conn.Write(reply); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+}
+
+// Received returns commands received from the host, decrypted
+func (this *Simulator) Received() [][]byte {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	res := make([][]byte, len(this.received))
+	for i, cmd := range this.received {
+		res[i] = cmd.Data
+	}
+	return res
+}
+
+// Commands returns commands received from the host with their time
+func (this *Simulator) Commands() []Command {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	res := make([]Command, len(this.received))
+	copy(res, this.received)
+	return res
+}
+
+// Counters returns the note counters of the device
+func (this *Simulator) Counters() itlssp.Counters {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.counters
+}
+
+// Levels returns a copy of the channel table with stored levels
+func (this *Simulator) Levels() []itlssp.Channel {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	res := make([]itlssp.Channel, len(this.Channels))
+	copy(res, this.Channels)
+	return res
+}
+
+// Handle answers the unstuffed frame, nil if the device stays silent
+func (this *Simulator) Handle(frame []byte) []byte {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	id, data, err := itlssp.DecodeFrame(frame)
+	if err != nil || id&0x7F != this.Addr {
+		return nil
+	}
+	seq := id & 0x80
+	if data[0] == byte(itlssp.SspCmdSync) {
+		this.seq = seqUnknown
+	}
+	if seq == this.seq && this.last != nil {
+		return this.last // host lost the reply, repeat it
+	}
+
+	var reply []byte
+	if data[0] == itlssp.STEX {
+		enc := this.enc // a reset clears the key, the reply still uses it
+		if enc == nil {
+			reply = []byte{respKeyNotSet}
+		} else if cmd, err := enc.Decrypt(data); err != nil {
+			return nil
+		} else if reply = this.run(cmd); reply == nil {
+			return nil
+		} else {
+			reply = enc.Encrypt(reply)
+		}
+	} else if reply = this.run(data); reply == nil {
+		return nil
+	}
+	this.seq = seq
+	this.last = itlssp.EncodeFrame(id, reply)
+	return this.last
+}
+
+// run executes the command with the replacement if it is set
+func (this *Simulator) run(data []byte) []byte {
+	if this.exec != nil {
+		return this.exec(data)
+	}
+	return this.execute(data)
+}
+
+// execute runs the command and returns the reply data
+func (this *Simulator) execute(data []byte) []byte {
+	if itlssp.SspCommand(data[0]) == itlssp.SspCmdPoll {
+		this.polls++
+		this.advance()
+	}
+	this.received = append(this.received, Command{Time: time.Now(), Poll: this.polls, Data: append([]byte(nil), data...)})
+	ok := []byte{respOk}
+	switch cmd := itlssp.SspCommand(data[0]); cmd {
+	case itlssp.SspCmdSync, itlssp.SspCmdDisplayOn, itlssp.SspCmdDisplayOff, itlssp.SspCmdConfigureBezel,
+		itlssp.SspCmdSetValueReportingType, itlssp.SspCmdHaltPayout:
+		return ok
+	case itlssp.SspCmdReset:
+		this.steps = nil
+		this.reset()
+		return ok
+	case itlssp.SspCmdHostProtocolVersion:
+		if len(data) < 2 || data[1] > this.Protocol {
+			return []byte{respFail}
+		}
+		this.protocol = data[1]
+		return ok
+	case itlssp.SspCmdPoll:
+		return this.poll()
+	case itlssp.SspCmdSetupRequest:
+		return this.setup()
+	case itlssp.SspCmdEnable:
+		this.enabled = true
+		return ok
+	case itlssp.SspCmdDisable:
+		this.enabled = false
+		return ok
+	case itlssp.SspCmdEnablePayout:
+		this.payoutOn = true
+		return ok
+	case itlssp.SspCmdDisablePayout:
+		this.payoutOn = false
+		return ok
+	case itlssp.SspCmdSetInhibits:
+		if len(data) < 3 {
+			return []byte{respWrongParams}
+		}
+		this.inhibits = binary.LittleEndian.Uint16(data[1:3])
+		return ok
+	case itlssp.SspCmdGetSerialNumber:
+		buf := make([]byte, 5)
+		buf[0] = respOk
+		binary.BigEndian.PutUint32(buf[1:], this.Serial)
+		return buf
+	case itlssp.SspCmdFirmwareVersion:
+		return append(ok, this.firmware()...)
+	case itlssp.SspCmdGetDatasetVersion:
+		return append(ok, this.Dataset...)
+	case itlssp.SspCmdGetBuildRevision:
+		return []byte{respOk, byte(this.Type), 0x01, 0x00}
+	case itlssp.SspCmdLastRejectCode:
+		return []byte{respOk, this.lastReject}
+	case itlssp.SspCmdHold:
+		if this.escrow == 0 {
+			return []byte{respCannotProcess, 0x00}
+		}
+		return ok
+	case itlssp.SspCmdRejectNote:
+		if this.escrow == 0 {
+			return []byte{respCannotProcess, 0x00}
+		}
+		this.rejectEscrow()
+		return ok
+	case itlssp.SspCmdSetGenerator, itlssp.SspCmdSetModulus, itlssp.SspCmdRequestKeyExchange:
+		return this.keyExchange(cmd, data)
+	case itlssp.SspCmdGetCounter:
+		buf := []byte{respOk, 5}
+		for _, v := range []uint32{this.counters.Stacked, this.counters.Stored, this.counters.Dispensed,
+			this.counters.Transferred, this.counters.Rejected} {
+			buf = append(buf, le32(v)...)
+		}
+		return buf
+	case itlssp.SspCmdResetCounter:
+		this.counters = itlssp.Counters{}
+		return ok
+	case itlssp.SspCmdGetAllLevels:
+		buf := []byte{respOk, byte(len(this.Channels))}
+		for _, ch := range this.Channels {
+			buf = append(buf, le16(uint16(ch.Level))...)
+			buf = append(buf, le32(uint32(ch.Value))...)
+			buf = append(buf, ch.Currency...)
+		}
+		return buf
+	case itlssp.SspCmdSetDenominationRoute:
+		if len(data) < 9 {
+			return []byte{respWrongParams}
+		}
+		ch := this.channel(binary.LittleEndian.Uint32(data[2:6]), string(data[6:9]))
+		if ch == nil {
+			return []byte{respOutOfRange}
+		}
+		ch.Recycling = data[1] == byte(itlssp.RoutePayout)
+		return ok
+	case itlssp.SspCmdGetDenominationRoute:
+		if len(data) < 8 {
+			return []byte{respWrongParams}
+		}
+		ch := this.channel(binary.LittleEndian.Uint32(data[1:5]), string(data[5:8]))
+		if ch == nil {
+			return []byte{respOutOfRange}
+		}
+		if ch.Recycling {
+			return []byte{respOk, byte(itlssp.RoutePayout)}
+		}
+		return []byte{respOk, byte(itlssp.RouteCashbox)}
+	case itlssp.SspCmdPayoutAmount:
+		if len(data) < 9 {
+			return []byte{respWrongParams}
+		}
+		return this.payoutAmount(binary.LittleEndian.Uint32(data[1:5]), string(data[5:8]), data[8])
+	case itlssp.SspCmdPayoutByDenomination:
+		return this.payoutByDenomination(data)
+	case itlssp.SspCmdFloatAmount:
+		if len(data) < 11 {
+			return []byte{respWrongParams}
+		}
+		return this.floatAmount(binary.LittleEndian.Uint32(data[3:7]), string(data[7:10]), data[10])
+	case itlssp.SspCmdEmptyAll, itlssp.SspCmdSmartEmpty:
+		return this.empty(cmd)
+	default:
+		return []byte{respUnknown}
+	}
+}
+
+// reset clears the session state as the device power cycle does
+func (this *Simulator) reset() {
+	this.protocol = 0
+	this.enabled = false
+	this.payoutOn = false
+	this.inhibits = 0
+	this.enc = nil
+	this.escrow = 0
+	this.seq = seqUnknown
+	this.last = nil
+	this.steps = append(this.steps, step{events: []byte{byte(itlssp.SspEventSlaveReset)}})
+	if this.interrupted != nil {
+		this.steps = append(this.steps, step{events: this.interrupted})
+		this.interrupted = nil
+	}
+}
+
+// poll returns the next scripted events
+func (this *Simulator) poll() []byte {
+	buf := []byte{respOk}
+	if len(this.steps) > 0 {
+		s := this.steps[0]
+		this.steps = this.steps[1:]
+		buf = append(buf, s.events...)
+		if s.apply != nil {
+			buf = append(buf, s.apply(this)...)
+		}
+	}
+	if !this.enabled {
+		buf = append(buf, byte(itlssp.SspEventDisabled))
+	}
+	return buf
+}
+
+// setup returns the setup request data of the unit type
+func (this *Simulator) setup() []byte {
+	buf := []byte{respOk, byte(this.Type)}
+	buf = append(buf, pad(this.Firmware, 4)...)
+	buf = append(buf, pad(this.Currency, 3)...)
+	if this.Type == itlssp.SMARTHopper {
+		buf = append(buf, this.Protocol, byte(len(this.Channels)))
+		for _, ch := range this.Channels {
+			buf = append(buf, le16(uint16(ch.Value))...)
+		}
+		for _, ch := range this.Channels {
+			buf = append(buf, ch.Currency...)
+		}
+		return buf
+	}
+
+	multiplier := 1
+	for multiplier < 1000 {
+		var rest int
+		for _, ch := range this.Channels {
+			rest += ch.Value % (multiplier * 10)
+		}
+		if rest != 0 {
+			break
+		}
+		multiplier *= 10
+	}
+	buf = append(buf, 0x00, 0x00, 0x01, byte(len(this.Channels)))
+	for _, ch := range this.Channels {
+		v := ch.Value / multiplier
+		if v > 0xFF {
+			v = 0xFF
+		}
+		buf = append(buf, byte(v))
+	}
+	for range this.Channels {
+		buf = append(buf, 0x02) // security level
+	}
+	buf = append(buf, byte(multiplier>>16), byte(multiplier>>8), byte(multiplier), this.Protocol)
+	for _, ch := range this.Channels {
+		buf = append(buf, ch.Currency...)
+	}
+	for _, ch := range this.Channels {
+		buf = append(buf, le32(uint32(ch.Value/multiplier))...)
+	}
+	return buf
+}
+
+// keyExchange answers the eSSP key negotiation commands
+func (this *Simulator) keyExchange(cmd itlssp.SspCommand, data []byte) []byte {
+	if len(data) < 9 {
+		return []byte{respWrongParams}
+	}
+	v := new(big.Int).SetUint64(binary.LittleEndian.Uint64(data[1:9]))
+	switch cmd {
+	case itlssp.SspCmdSetGenerator:
+		if !v.ProbablyPrime(20) {
+			return []byte{respCannotProcess, 0x01}
+		}
+		this.gen = v
+	case itlssp.SspCmdSetModulus:
+		if !v.ProbablyPrime(20) {
+			return []byte{respCannotProcess, 0x02}
+		}
+		this.mod = v
+	case itlssp.SspCmdRequestKeyExchange:
+		if this.gen == nil || this.mod == nil {
+			return []byte{respCannotProcess, 0x03}
+		}
+		secret := big.NewInt(time.Now().UnixNano() & 0x3FFFFFFF)
+		inter := new(big.Int).Exp(this.gen, secret, this.mod)
+		key := new(big.Int).Exp(v, secret, this.mod)
+		enc, err := itlssp.NewEncryption(append(le64(this.fixedKey), le64(key.Uint64())...))
+		if err != nil {
+			return []byte{respFail}
+		}
+		this.enc = enc
+		return append([]byte{respOk}, le64(inter.Uint64())...)
+	}
+	return []byte{respOk}
+}
+
+// channel returns the channel of the value in the currency
+func (this *Simulator) channel(value uint32, currency string) *itlssp.Channel {
+	for i := range this.Channels {
+		if uint32(this.Channels[i].Value) == value && string(this.Channels[i].Currency) == currency {
+			return &this.Channels[i]
+		}
+	}
+	return nil
+}
+
+// firmware returns the full firmware version string
+func (this *Simulator) firmware() string {
+	prefix := "NV0"
+	if this.Type == itlssp.SMARTHopper {
+		prefix = "SH0"
+	}
+	return prefix + pad(this.Firmware, 4) + "41414980" + "0"
+}
+
+func pad(s string, n int) string {
+	for len(s) < n {
+		s += " "
+	}
+	return s[:n]
+}
+
+func le16(v uint16) []byte {
+	buf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(buf, v)
+	return buf
+}
+
+func le32(v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, v)
+	return buf
+}
+
+func le64(v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	return buf
+}
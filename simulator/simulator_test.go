@@ -0,0 +1,246 @@
+package simulator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/charoit/itlssp"
+)
+
+func TestSimulatorValidator(t *testing.T) {
+	sim := New(itlssp.Validator, "EUR", 500, 1000, 2000)
+	sim.Listen("sim-validator")
+	defer itlssp.UnregisterPort("sim-validator")
+
+	dev := itlssp.NewValidator(itlssp.PortConfig("sim-validator", 9600))
+	if err := dev.Open(itlssp.PortConfig("sim-validator", 9600)); err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	if err := dev.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.HostProtocolVersion(7); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.NegotiateKeys(itlssp.DefaultFixedKey); err != nil {
+		t.Fatal(err)
+	}
+	setup, err := dev.SetupRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(setup.Channels) != 3 || setup.Channels[2].Value != 2000 || setup.Currency != "EUR" {
+		t.Fatalf("SetupRequest failed, expected 3 EUR channels, got %s", setup)
+	}
+	if err = dev.SetInhibits(0x0007); err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.Enable(); err != nil {
+		t.Fatal(err)
+	}
+
+	sim.InsertNote(2)
+	var credit byte
+	for sim.Pending() > 0 {
+		events, err := dev.Poll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range events {
+			if ev.Code == itlssp.SspEventCredit {
+				credit = ev.Channel
+			}
+		}
+	}
+	if credit != 2 {
+		t.Errorf("Poll failed, expected credit of channel %d, got %d", 2, credit)
+	}
+
+	counters, err := dev.GetCounters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters.Stacked != 1 {
+		t.Errorf("GetCounters failed, expected %d stacked, got %d", 1, counters.Stacked)
+	}
+}
+
+func TestSimulatorReject(t *testing.T) {
+	sim := New(itlssp.Validator, "EUR", 500, 1000)
+	sim.enabled = true
+	sim.inhibits = 0x0003
+	sim.InsertNote(1)
+
+	poll := []byte{byte(itlssp.SspCmdPoll)}
+	sim.execute(poll)
+	sim.execute(poll) // note in escrow
+	if res := sim.execute([]byte{byte(itlssp.SspCmdRejectNote)}); res[0] != respOk {
+		t.Fatalf("RejectNote failed, expected %X, got %X", respOk, res)
+	}
+	var events []byte
+	for sim.Pending() > 0 {
+		events = append(events, sim.execute(poll)[1:]...)
+	}
+	exp := []byte{byte(itlssp.SspEventRejecting), byte(itlssp.SspEventRejected)}
+	if string(events) != string(exp) {
+		t.Errorf("Poll failed, expected %X, got %X", exp, events)
+	}
+}
+
+func TestSimulatorPayout(t *testing.T) {
+	var table = []struct {
+		amount uint32
+		opt    itlssp.PayoutOption
+		status itlssp.PayoutStatus
+		ok     bool
+		levels []int
+	}{
+		{amount: 3000, opt: itlssp.PayoutReal, ok: true, levels: []int{1, 1}},
+		{amount: 3000, opt: itlssp.PayoutTest, ok: true, levels: []int{2, 2}},
+		{amount: 700, opt: itlssp.PayoutReal, status: itlssp.PayoutCannotPayExact, levels: []int{2, 2}},
+		{amount: 9000, opt: itlssp.PayoutReal, status: itlssp.PayoutNotEnoughValue, levels: []int{2, 2}},
+	}
+	for i, v := range table {
+		name := "sim-payout"
+		sim := New(itlssp.SMARTPayout, "EUR", 1000, 2000)
+		sim.SetLevel(1, 2, true)
+		sim.SetLevel(2, 2, true)
+		sim.Listen(name)
+
+		dev := itlssp.NewPayout(itlssp.PortConfig(name, 9600))
+		if err := dev.Open(itlssp.PortConfig(name, 9600)); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.Enable(); err != nil {
+			t.Fatal(err)
+		}
+		if err := dev.EnablePayout(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := dev.PayoutAmount(v.amount, "EUR", v.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Ok != v.ok || res.Status != v.status {
+			t.Errorf("%d: PayoutAmount failed, expected %v %s, got %s", i, v.ok, v.status, res)
+		}
+		for j, level := range v.levels {
+			if sim.Channels[j].Level != level {
+				t.Errorf("%d: PayoutAmount failed, expected channel %d level %d, got %d", i, j+1, level, sim.Channels[j].Level)
+			}
+		}
+		dev.Close()
+		itlssp.UnregisterPort(name)
+	}
+}
+
+func TestSimulatorPowerLoss(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	j, err := itlssp.OpenJournal(filepath.Join(dir, "journal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	sim := New(itlssp.SMARTPayout, "EUR", 1000, 2000)
+	sim.SetLevel(1, 2, true)
+	sim.SetLevel(2, 2, true)
+	sim.Listen("sim-power")
+	defer itlssp.UnregisterPort("sim-power")
+	dev := itlssp.NewPayout(itlssp.PortConfig("sim-power", 9600))
+	if err = dev.Open(itlssp.PortConfig("sim-power", 9600)); err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	if _, err = j.Begin(sim.Serial, itlssp.EntryPayout, 3000, "EUR"); err != nil {
+		t.Fatal(err)
+	}
+	sim.PayoutFault(FaultPowerLoss)
+	if err = dev.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.EnablePayout(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dev.PayoutAmount(3000, "EUR", itlssp.PayoutReal); err != nil {
+		t.Fatal(err)
+	}
+	sim.PowerReset()
+
+	if err = dev.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := dev.RecoverPayouts(context.Background(), j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dispensed uint32
+	for _, ch := range sim.Levels() {
+		dispensed += uint32((2 - ch.Level) * ch.Value)
+	}
+	if len(res.Settled) != 1 || len(res.Unresolved) != 0 {
+		t.Fatalf("RecoverPayouts failed, expected one settled payout, got %s", res)
+	}
+	if e := res.Settled[0]; e.Status != itlssp.EntryIncomplete || e.Amount != dispensed || dispensed >= 3000 {
+		t.Fatalf("RecoverPayouts failed, expected incomplete payout of %d, got %s", dispensed, &e)
+	}
+}
+
+func TestSimulatorSession(t *testing.T) {
+	sim := New(itlssp.SMARTPayout, "EUR", 500, 1000, 2000)
+	sim.SetLevel(1, 2, true)
+	sim.Listen("sim-session")
+	defer itlssp.UnregisterPort("sim-session")
+	dev := itlssp.NewPayout(itlssp.PortConfig("sim-session", 9600))
+	if err := dev.Open(itlssp.PortConfig("sim-session", 9600)); err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if err := dev.HostProtocolVersion(7); err != nil {
+		t.Fatal(err)
+	}
+
+	s := itlssp.NewSession(dev, dev, "EUR")
+	type result struct {
+		r   *itlssp.Receipt
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		r, err := s.Collect(context.Background(), 1500)
+		done <- result{r, err}
+	}()
+	// the note is inserted once the session set the inhibits
+	for inserted := false; !inserted; time.Sleep(10 * time.Millisecond) {
+		for _, cmd := range sim.Received() {
+			if itlssp.SspCommand(cmd[0]) == itlssp.SspCmdSetInhibits && cmd[1] != 0 {
+				sim.InsertNote(3)
+				inserted = true
+				break
+			}
+		}
+	}
+	res := <-done
+	if res.err != nil || res.r.State != itlssp.SessionPaid || res.r.Paid != 2000 {
+		t.Fatalf("Collect failed, expected paid 2000, got %s (%v)", res.r, res.err)
+	}
+
+	r, err := s.GiveChange()
+	if err != nil || r.Change != 500 || r.Owed != 0 {
+		t.Fatalf("GiveChange failed, expected change 500, got %s (%v)", r, err)
+	}
+	if levels := sim.Levels(); levels[0].Level != 1 {
+		t.Errorf("GiveChange failed, expected channel 1 level 1, got %v", levels)
+	}
+}
@@ -0,0 +1,246 @@
+package itlssp
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// DeviceState is the state of the device derived from poll events
+type DeviceState byte
+
+const (
+	StateUnknown DeviceState = iota
+	StateInitialising
+	StateDisabled
+	StateIdle
+	StateReading
+	StateEscrow
+	StateStacking
+	StateRejecting
+	StateDispensing
+	StateFloating
+	StateEmptying
+	StateSafeJam
+	StateUnsafeJam
+	StateCashboxRemoved
+	StateStackerFull
+	StateFraud
+)
+
+// MarshalText encodes the state by name
+func (s DeviceState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s DeviceState) String() string {
+	switch s {
+	case StateInitialising:
+		return "Initialising"
+	case StateDisabled:
+		return "Disabled"
+	case StateIdle:
+		return "Idle"
+	case StateReading:
+		return "Reading"
+	case StateEscrow:
+		return "Escrow"
+	case StateStacking:
+		return "Stacking"
+	case StateRejecting:
+		return "Rejecting"
+	case StateDispensing:
+		return "Dispensing"
+	case StateFloating:
+		return "Floating"
+	case StateEmptying:
+		return "Emptying"
+	case StateSafeJam:
+		return "SafeJam"
+	case StateUnsafeJam:
+		return "UnsafeJam"
+	case StateCashboxRemoved:
+		return "CashboxRemoved"
+	case StateStackerFull:
+		return "StackerFull"
+	case StateFraud:
+		return "Fraud"
+	default:
+		return "Unknown"
+	}
+}
+
+// Jammed reports whether the device needs the jam cleared
+func (s DeviceState) Jammed() bool {
+	return s == StateSafeJam || s == StateUnsafeJam
+}
+
+// Transition is the state change caused by the event, nil Event is a poll
+// without state events. Valid is false for changes the device should not
+// make, the tracker follows the device anyway.
+type Transition struct {
+	From  DeviceState
+	To    DeviceState
+	Event *Event
+	Valid bool
+}
+
+func (this *Transition) String() string {
+	data, _ := json.Marshal(this)
+	return string(data)
+}
+
+// eventState returns the state the device reports with the event,
+// false if the event does not tell the state
+func eventState(e *Event) (DeviceState, bool) {
+	switch e.Code {
+	case SspEventSlaveReset, SspEventInitialising:
+		return StateInitialising, true
+	case SspEventDisabled:
+		return StateDisabled, true
+	case SspEventRead:
+		if e.Channel == 0 {
+			return StateReading, true
+		}
+		return StateEscrow, true
+	case SspEventCredit, SspEventStacking:
+		return StateStacking, true
+	case SspEventRejecting:
+		return StateRejecting, true
+	case SspEventDispensing:
+		return StateDispensing, true
+	case SspEventFloating:
+		return StateFloating, true
+	case SspEventEmptying, SspEventSmartEmptying:
+		return StateEmptying, true
+	case SspEventSafeJam:
+		return StateSafeJam, true
+	case SspEventUnsafeJam, SspEventJammed, SspEventCoinMechJammed:
+		return StateUnsafeJam, true
+	case SspEventCashboxRemoved:
+		return StateCashboxRemoved, true
+	case SspEventStackerFull, SspEventDeviceFull:
+		return StateStackerFull, true
+	case SspEventFraudAttempt:
+		return StateFraud, true
+	case SspEventStacked, SspEventRejected, SspEventNoteClearedFront, SspEventNoteClearedCashbox,
+		SspEventCashboxReplaced, SspEventDispensed, SspEventFloated, SspEventEmptied, SspEventSmartEmptied,
+		SspEventIncompletePayout, SspEventIncompleteFloat, SspEventHalted, SspEventTimeout, SspEventNoteStored,
+		SspEventNoteTransferred, SspEventJamRecovery:
+		return StateIdle, true
+	}
+	return StateUnknown, false
+}
+
+// anyState are states the device may enter from every state
+var anyState = map[DeviceState]bool{
+	StateInitialising:   true,
+	StateDisabled:       true,
+	StateSafeJam:        true,
+	StateUnsafeJam:      true,
+	StateCashboxRemoved: true,
+	StateStackerFull:    true,
+	StateFraud:          true,
+}
+
+// transitions are the other valid state changes
+var transitions = map[DeviceState][]DeviceState{
+	StateInitialising:   {StateIdle},
+	StateDisabled:       {StateIdle},
+	StateIdle:           {StateReading, StateEscrow, StateStacking, StateRejecting, StateDispensing, StateFloating, StateEmptying},
+	StateReading:        {StateEscrow, StateStacking, StateRejecting, StateIdle},
+	StateEscrow:         {StateStacking, StateRejecting},
+	StateStacking:       {StateIdle},
+	StateRejecting:      {StateIdle},
+	StateDispensing:     {StateIdle},
+	StateFloating:       {StateIdle},
+	StateEmptying:       {StateIdle},
+	StateSafeJam:        {StateIdle},
+	StateUnsafeJam:      {StateIdle},
+	StateCashboxRemoved: {StateIdle},
+	StateStackerFull:    {StateIdle},
+	StateFraud:          {StateIdle},
+}
+
+// ValidTransition reports whether the device may change the state from to
+func ValidTransition(from, to DeviceState) bool {
+	if from == StateUnknown || from == to || anyState[to] {
+		return true
+	}
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Tracker keeps the device state from poll events. Devices repeat the events
+// of lasting states on every poll, so a poll without state events means the
+// device is idle. Feed it every poll or attach it with SetTracker.
+type Tracker struct {
+	mu       sync.Mutex
+	state    DeviceState
+	handlers []func(Transition)
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{}
+}
+
+// State returns the current state
+func (this *Tracker) State() DeviceState {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.state
+}
+
+// OnChange calls fn on every state change, in the order of the changes
+func (this *Tracker) OnChange(fn func(Transition)) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.handlers = append(this.handlers, fn)
+}
+
+// Reset forgets the state, for example after the connection is lost
+func (this *Tracker) Reset() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.state = StateUnknown
+}
+
+// Update applies the events of one poll and returns the state changes
+func (this *Tracker) Update(events []Event) []Transition {
+	this.mu.Lock()
+	var changes []Transition
+	move := func(to DeviceState, e *Event) {
+		if to != this.state {
+			changes = append(changes, Transition{From: this.state, To: to, Event: e, Valid: ValidTransition(this.state, to)})
+			this.state = to
+		}
+	}
+	found := false
+	for i := range events {
+		if s, ok := eventState(&events[i]); ok {
+			e := events[i]
+			move(s, &e)
+			found = true
+		}
+	}
+	if !found {
+		move(StateIdle, nil)
+	}
+	handlers := this.handlers
+	this.mu.Unlock()
+
+	for _, t := range changes {
+		for _, fn := range handlers {
+			fn(t)
+		}
+	}
+	return changes
+}
+
+// SetTracker updates the tracker with the events of every poll
+func (this *generic) SetTracker(t *Tracker) {
+	this.tracker = t
+}
@@ -0,0 +1,131 @@
+package itlssp
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTrackerUpdate(t *testing.T) {
+	var table = []struct {
+		events []Event
+		state  DeviceState
+		valid  bool
+	}{
+		{[]Event{{Code: SspEventDisabled}}, StateDisabled, true},
+		{nil, StateIdle, true},
+		{[]Event{{Code: SspEventRead}}, StateReading, true},
+		{[]Event{{Code: SspEventRead, Channel: 2}}, StateEscrow, true},
+		{[]Event{{Code: SspEventRead, Channel: 2}}, StateEscrow, true},
+		{[]Event{{Code: SspEventCredit, Channel: 2}, {Code: SspEventStacking}}, StateStacking, true},
+		{[]Event{{Code: SspEventStacked}}, StateIdle, true},
+		{[]Event{{Code: SspEventDispensing}}, StateDispensing, true},
+		{[]Event{{Code: SspEventDispensing}, {Code: SspEventCashboxPaid}}, StateDispensing, true},
+		{[]Event{{Code: SspEventRead}}, StateReading, false},
+		{[]Event{{Code: SspEventUnsafeJam}}, StateUnsafeJam, true},
+		{[]Event{{Code: SspEventSafeJam}}, StateSafeJam, true},
+		{[]Event{{Code: SspEventNoteClearedFront}}, StateIdle, true},
+		{[]Event{{Code: SspEventCashboxRemoved}}, StateCashboxRemoved, true},
+		{[]Event{{Code: SspEventCashboxReplaced}}, StateIdle, true},
+		{[]Event{{Code: SspEventEmptying}}, StateEmptying, true},
+		{[]Event{{Code: SspEventEmptied}, {Code: SspEventDisabled}}, StateDisabled, true},
+		{[]Event{{Code: SspEventStacking}}, StateStacking, false},
+		{[]Event{{Code: SspEventSlaveReset}}, StateInitialising, true},
+	}
+
+	tr := NewTracker()
+	for i, v := range table {
+		changes := tr.Update(v.events)
+		if tr.State() != v.state {
+			t.Fatalf("%d: Update failed, expected state %s, got %s", i, v.state, tr.State())
+		}
+		for _, c := range changes {
+			if c.To == v.state && c.Valid != v.valid {
+				t.Errorf("%d: Update failed, expected valid %t, got %s", i, v.valid, &c)
+			}
+		}
+	}
+}
+
+func TestTrackerOnChange(t *testing.T) {
+	tr := NewTracker()
+	var got []Transition
+	tr.OnChange(func(c Transition) { got = append(got, c) })
+
+	tr.Update([]Event{{Code: SspEventDisabled}})
+	tr.Update([]Event{{Code: SspEventDisabled}})
+	tr.Update([]Event{{Code: SspEventRead, Channel: 1}, {Code: SspEventCredit, Channel: 1}, {Code: SspEventStacked}})
+	if len(got) != 4 {
+		t.Fatalf("OnChange failed, expected 4 changes, got %v", got)
+	}
+	if got[0].From != StateUnknown || got[0].To != StateDisabled || got[1].To != StateEscrow || got[3].To != StateIdle {
+		t.Fatalf("OnChange failed, expected Unknown to Disabled, Escrow and Idle, got %v", got)
+	}
+	if got[1].Valid || got[1].Event.Channel != 1 {
+		t.Fatalf("OnChange failed, expected invalid Disabled to Escrow on channel 1, got %s", &got[1])
+	}
+
+	tr.Reset()
+	if tr.State() != StateUnknown {
+		t.Fatalf("Reset failed, expected %s, got %s", StateUnknown, tr.State())
+	}
+}
+
+func TestTransitionString(t *testing.T) {
+	var table = []struct {
+		tr  Transition
+		exp string
+	}{
+		{Transition{From: StateUnknown, To: StateIdle, Valid: true},
+			`{"From":"Unknown","To":"Idle","Event":null,"Valid":true}`},
+		{Transition{From: StateIdle, To: StateEscrow, Event: &Event{Code: SspEventRead, Channel: 2}},
+			`{"From":"Idle","To":"Escrow","Event":{"Code":"READ NOTE","Channel":2,"Amounts":null,"Ticket":null,"Data":""},"Valid":false}`},
+	}
+
+	for i, v := range table {
+		s := v.tr.String()
+		if !json.Valid([]byte(s)) || s != v.exp {
+			t.Errorf("%d: String failed, expected %s, got %s", i, v.exp, s)
+		}
+	}
+}
+
+func TestValidTransition(t *testing.T) {
+	var table = []struct {
+		from, to DeviceState
+		valid    bool
+	}{
+		{StateUnknown, StateDispensing, true},
+		{StateIdle, StateIdle, true},
+		{StateIdle, StateReading, true},
+		{StateEscrow, StateIdle, false},
+		{StateDispensing, StateFraud, true},
+		{StateDisabled, StateDispensing, false},
+		{StateStacking, StateStackerFull, true},
+		{StateUnsafeJam, StateIdle, true},
+	}
+
+	for _, v := range table {
+		if ValidTransition(v.from, v.to) != v.valid {
+			t.Errorf("ValidTransition failed, expected %s to %s valid %t, got %t", v.from, v.to, v.valid, !v.valid)
+		}
+	}
+}
+
+func TestGenericTracker(t *testing.T) {
+	u := &fakeUnit{reply: [][]byte{{0xF0, 0xE8}, {0xF0}}}
+	g := &generic{unit: u}
+	tr := NewTracker()
+	g.SetTracker(tr)
+	if _, err := g.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if tr.State() != StateDisabled {
+		t.Fatalf("Poll failed, expected state %s, got %s", StateDisabled, tr.State())
+	}
+	if _, err := g.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if tr.State() != StateIdle {
+		t.Fatalf("Poll failed, expected state %s, got %s", StateIdle, tr.State())
+	}
+}
@@ -0,0 +1,250 @@
+package itlssp
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/tarm/serial"
+)
+
+// ErrReplyLost is returned when the reply of a command moving cash was lost
+// and the session had to be restored: the device may have run the command,
+// the caller settles it from the journal or with RecoverPayouts
+var ErrReplyLost = errors.New("Reply lost, the device may have run the command")
+
+// Recovery configures the supervised connection. Protocol is the host protocol
+// version set after reconnect when the application has not set one.
+// Retransmits is the number of times a command with a lost reply is sent
+// again unchanged before reconnecting. MaxAttempts limits reconnect attempts
+// of a failed command, zero is unlimited.
+type Recovery struct {
+	Protocol    byte
+	Retransmits int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	MaxAttempts int
+}
+
+// DefaultRecovery retransmits twice and reconnects without limit with
+// backoff from 100ms to 10s
+var DefaultRecovery = Recovery{
+	Retransmits: 2,
+	MinBackoff:  100 * time.Millisecond,
+	MaxBackoff:  10 * time.Second,
+}
+
+// keys of saved commands replayed last
+const (
+	savedEnable = "enable"
+	savedPayout = "payout"
+)
+
+// supervisor wraps the unit, saves configuration commands and restores
+// the session after port failures and device resets
+type supervisor struct {
+	unit
+	opt   Recovery
+	conf  *serial.Config
+	fixed *uint64
+	saved map[string][]byte
+	order []string
+	sleep func(time.Duration)
+}
+
+func newSupervisor(u unit, opt Recovery) *supervisor {
+	if opt.Retransmits <= 0 {
+		opt.Retransmits = DefaultRecovery.Retransmits
+	}
+	if opt.MinBackoff <= 0 {
+		opt.MinBackoff = DefaultRecovery.MinBackoff
+	}
+	if opt.MaxBackoff < opt.MinBackoff {
+		opt.MaxBackoff = opt.MinBackoff
+	}
+	s := &supervisor{
+		unit:  u,
+		opt:   opt,
+		saved: make(map[string][]byte),
+		sleep: time.Sleep,
+	}
+	if d, ok := u.(*device); ok {
+		s.conf = d.conf
+	}
+	return s
+}
+
+// Supervise makes the device reopen the port and restore the session
+// (sync, protocol version, eSSP keys and configuration) on failures
+func (this *generic) Supervise(opt Recovery) {
+	if _, ok := this.unit.(*supervisor); ok {
+		return
+	}
+	this.unit = newSupervisor(this.unit, opt)
+}
+
+// Open serial port
+func (this *supervisor) Open(cfg *serial.Config) error {
+	this.conf = cfg
+	return this.unit.Open(cfg)
+}
+
+// SetEncryption keeps the fixed key to renegotiate eSSP keys
+func (this *supervisor) SetEncryption(key []byte) error {
+	if err := this.unit.SetEncryption(key); err != nil {
+		return errors.WithStack(err)
+	}
+	this.fixed = nil
+	if len(key) >= 8 {
+		fixed := binary.LittleEndian.Uint64(key[:8])
+		this.fixed = &fixed
+	}
+	return nil
+}
+
+// SendCommand sends data, retransmits it unchanged when the reply was lost,
+// restores the session if the port failed or the device was reset and
+// repeats the command. Commands moving cash are not repeated after the
+// restore as the device may have run them, ErrReplyLost is returned instead.
+func (this *supervisor) SendCommand(data []byte) ([]byte, error) {
+	res, err := this.unit.SendCommand(data)
+	for i := 0; err != nil && !Refused(err) && i < this.opt.Retransmits; i++ {
+		log.Warn().Err(err).Msg("Reply lost, retransmitting")
+		res, err = this.unit.Retransmit()
+	}
+	if err == nil {
+		this.save(data)
+		if data[0] == byte(SspCmdPoll) && resetEvent(res[1:]) {
+			log.Warn().Msg("Device reset, restoring session")
+			if err = this.restore(); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		return res, nil
+	}
+
+	lost := err
+	if resp, ok := errors.Cause(err).(*ResponseError); ok {
+		// the device refused the command, it is safe to repeat
+		if resp.Code != SspResponseKeyNotSet || this.fixed == nil {
+			return nil, errors.WithStack(err)
+		}
+		log.Warn().Msg("Device lost eSSP keys, restoring session")
+		err = this.restore()
+	} else {
+		log.Warn().Err(err).Msg("Port failed, reconnecting")
+		if err = this.reconnect(); err == nil && movesCash(data) {
+			return nil, errors.Wrapf(ErrReplyLost, "%s: %v", SspCommand(data[0]), lost)
+		}
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if res, err = this.unit.SendCommand(data); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	this.save(data)
+	return res, nil
+}
+
+// movesCash reports whether the command pays out or moves stored cash
+func movesCash(data []byte) bool {
+	switch SspCommand(data[0]) {
+	case SspCmdPayoutAmount, SspCmdPayoutByDenomination, SspCmdFloatAmount, SspCmdFloatByDenomination,
+		SspCmdEmptyAll, SspCmdSmartEmpty, SspCmdPayoutLastNote, SspCmdStackLastNote:
+		return true
+	}
+	return false
+}
+
+// reconnect reopens the port with backoff and restores the session
+func (this *supervisor) reconnect() error {
+	backoff := this.opt.MinBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		this.unit.Close()
+		if err = this.unit.Open(this.conf); err == nil {
+			if err = this.restore(); err == nil {
+				return nil
+			}
+		}
+		log.Warn().Err(err).Int("attempt", attempt).Msg("Reconnect failed")
+		if this.opt.MaxAttempts > 0 && attempt >= this.opt.MaxAttempts {
+			return errors.WithStack(err)
+		}
+		this.sleep(backoff)
+		if backoff *= 2; backoff > this.opt.MaxBackoff {
+			backoff = this.opt.MaxBackoff
+		}
+	}
+}
+
+// restore synchronizes with the device, sets protocol version and keys
+// and replays saved configuration
+func (this *supervisor) restore() error {
+	if err := this.unit.SetEncryption(nil); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := this.unit.SendCommand([]byte{byte(SspCmdSync)}); err != nil {
+		return errors.WithStack(err)
+	}
+	if cmd, ok := this.saved[SspCmdHostProtocolVersion.String()]; ok {
+		if _, err := this.unit.SendCommand(cmd); err != nil {
+			return errors.WithStack(err)
+		}
+	} else if this.opt.Protocol != 0 {
+		if _, err := this.unit.SendCommand([]byte{byte(SspCmdHostProtocolVersion), this.opt.Protocol}); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if this.fixed != nil {
+		if err := negotiateKeys(this.unit, *this.fixed); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for _, last := range []bool{false, true} {
+		for _, key := range this.order {
+			if key == SspCmdHostProtocolVersion.String() || last != (key == savedEnable || key == savedPayout) {
+				continue
+			}
+			if _, err := this.unit.SendCommand(this.saved[key]); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+// save keeps a copy of the configuration command to replay after restore
+func (this *supervisor) save(data []byte) {
+	var key string
+	switch cmd := SspCommand(data[0]); cmd {
+	case SspCmdHostProtocolVersion, SspCmdSetInhibits, SspCmdSetValueReportingType, SspCmdSetBarcodeConfig,
+		SspCmdSetBarcodeInhibit, SspCmdConfigureBezel:
+		key = cmd.String()
+	case SspCmdSetDenominationRoute:
+		key = cmd.String() + string(data[2:])
+	case SspCmdEnable, SspCmdDisable:
+		key = savedEnable
+	case SspCmdEnablePayout, SspCmdDisablePayout:
+		key = savedPayout
+	default:
+		return
+	}
+	if _, ok := this.saved[key]; !ok {
+		this.order = append(this.order, key)
+	}
+	this.saved[key] = append([]byte(nil), data...)
+}
+
+// resetEvent reports whether poll data has the slave reset event
+func resetEvent(data []byte) bool {
+	events, _ := DecodeEvents(data)
+	for _, ev := range events {
+		if ev.Code == SspEventSlaveReset {
+			return true
+		}
+	}
+	return false
+}
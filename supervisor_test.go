@@ -0,0 +1,152 @@
+package itlssp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tarm/serial"
+)
+
+// flakyUnit fails commands with a port error while broken
+type flakyUnit struct {
+	fakeUnit
+	broken int
+	opens  int
+}
+
+func (this *flakyUnit) Open(*serial.Config) error {
+	this.opens++
+	return nil
+}
+
+func (this *flakyUnit) SendCommand(data []byte) ([]byte, error) {
+	if this.broken > 0 {
+		this.broken--
+		return nil, errors.New("Invalid data packet size (0)")
+	}
+	return this.fakeUnit.SendCommand(data)
+}
+
+func (this *flakyUnit) Retransmit() ([]byte, error) {
+	if this.broken > 0 {
+		this.broken--
+		return nil, errors.New("Invalid data packet size (0)")
+	}
+	return this.fakeUnit.Retransmit()
+}
+
+func TestSupervisorReconnect(t *testing.T) {
+	u := &flakyUnit{}
+	v := &validator{generic{unit: u}}
+	v.Supervise(Recovery{Protocol: 6, MaxAttempts: 5})
+	var slept []time.Duration
+	v.unit.(*supervisor).sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	if err := v.SetInhibits(0x0003); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetInhibits(0x0007); err != nil {
+		t.Fatal(err)
+	}
+
+	// port fails on poll, its retransmits and on the first reconnect sync
+	u.sent = nil
+	u.broken = 4
+	if _, err := v.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	exp := [][]byte{
+		{byte(SspCmdSync)},
+		{byte(SspCmdHostProtocolVersion), 6},
+		{byte(SspCmdSetInhibits), 0x07, 0x00},
+		{byte(SspCmdEnable)},
+		{byte(SspCmdPoll)},
+	}
+	if !reflect.DeepEqual(u.sent, exp) {
+		t.Errorf("reconnect failed, expected %X, got %X", exp, u.sent)
+	}
+	if u.opens != 2 || len(slept) != 1 || slept[0] != DefaultRecovery.MinBackoff {
+		t.Errorf("reconnect failed, opens %d, backoff %v", u.opens, slept)
+	}
+
+	u.broken = 100
+	if _, err := v.Poll(); err == nil {
+		t.Error("reconnect failed, expected error after max attempts")
+	}
+}
+
+func TestSupervisorDeviceReset(t *testing.T) {
+	u := &flakyUnit{}
+	p := &payout{generic{unit: u}}
+	p.Supervise(DefaultRecovery)
+	if err := p.HostProtocolVersion(7); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetDenominationRoute(RoutePayout, 1000, "EUR"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetDenominationRoute(RouteCashbox, 2000, "EUR"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetDenominationRoute(RouteCashbox, 1000, "EUR"); err != nil {
+		t.Fatal(err)
+	}
+
+	u.sent = nil
+	u.reply = [][]byte{{0xF0, byte(SspEventSlaveReset), byte(SspEventDisabled)}}
+	ev, err := p.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ev) != 2 || ev[0].Code != SspEventSlaveReset {
+		t.Errorf("Poll failed, expected reset event, got %v", ev)
+	}
+	exp := [][]byte{
+		{byte(SspCmdPoll)},
+		{byte(SspCmdSync)},
+		{byte(SspCmdHostProtocolVersion), 7},
+		{byte(SspCmdSetDenominationRoute), 0x01, 0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R'},
+		{byte(SspCmdSetDenominationRoute), 0x01, 0xD0, 0x07, 0x00, 0x00, 'E', 'U', 'R'},
+	}
+	if !reflect.DeepEqual(u.sent, exp) {
+		t.Errorf("restore failed, expected %X, got %X", exp, u.sent)
+	}
+}
+
+func TestSupervisorRetransmit(t *testing.T) {
+	u := &flakyUnit{}
+	p := &payout{generic{unit: u}}
+	p.Supervise(DefaultRecovery)
+	p.unit.(*supervisor).sleep = func(time.Duration) {}
+
+	// the reply of the poll is lost once, the retransmit gets it
+	u.broken = 1
+	u.reply = [][]byte{{0xF0, byte(SspEventCredit), 0x01}}
+	ev, err := p.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ev) != 1 || ev[0].Code != SspEventCredit || u.resent != 1 || u.opens != 0 {
+		t.Errorf("retransmit failed, expected credit, got %v, resent %d, opens %d", ev, u.resent, u.opens)
+	}
+
+	// the payout is not sent again after the reconnect
+	u.sent = nil
+	u.broken = 1 + DefaultRecovery.Retransmits
+	if _, err = p.PayoutAmount(1000, "EUR", PayoutReal); errors.Cause(err) != ErrReplyLost {
+		t.Fatalf("payout failed, expected %v, got %v", ErrReplyLost, err)
+	}
+	for _, cmd := range u.sent {
+		if SspCommand(cmd[0]) == SspCmdPayoutAmount {
+			t.Errorf("payout failed, expected no resend, got %X", u.sent)
+		}
+	}
+	if u.opens != 1 || len(u.sent) == 0 || SspCommand(u.sent[0][0]) != SspCmdSync {
+		t.Errorf("payout failed, expected reconnect, got opens %d, sent %X", u.opens, u.sent)
+	}
+}
@@ -0,0 +1,475 @@
+package itlssp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrTraceFormat = errors.New("Invalid trace format")
+)
+
+// Direction of the frame on the line
+type Direction byte
+
+const (
+	HostToDevice Direction = 0x00
+	DeviceToHost Direction = 0x01
+)
+
+func (d Direction) String() string {
+	if d == DeviceToHost {
+		return "D>H"
+	}
+	return "H>D"
+}
+
+// Record is a frame on the line. Time is the monotonic time since the
+// recording started, Data is the payload decrypted when the key is known
+// and Name is the command name or the response with poll events.
+type Record struct {
+	Time      time.Duration
+	Direction Direction
+	Addr      byte
+	Seq       bool
+	Frame     []byte
+	Data      []byte
+	Encrypted bool
+	Name      string
+}
+
+func (this *Record) String() string {
+	return fmt.Sprintf("%12s %s %02X/%d %-40s %X", this.Time, this.Direction, this.Addr, this.SeqBit(),
+		this.Name, this.Data)
+}
+
+// SeqBit returns the sequence flag as 1 or 0
+func (this *Record) SeqBit() int {
+	if this.Seq {
+		return 1
+	}
+	return 0
+}
+
+// jsonRecord is the JSON Lines form of the record
+type jsonRecord struct {
+	Time      int64  `json:"Time"` // nanoseconds
+	Direction string `json:"Direction"`
+	Addr      byte   `json:"Addr"`
+	Seq       bool   `json:"Seq"`
+	Frame     string `json:"Frame"`
+	Data      string `json:"Data"`
+	Encrypted bool   `json:"Encrypted,omitempty"`
+	Name      string `json:"Name"`
+}
+
+func (this Record) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonRecord{
+		Time:      int64(this.Time),
+		Direction: this.Direction.String(),
+		Addr:      this.Addr,
+		Seq:       this.Seq,
+		Frame:     hex.EncodeToString(this.Frame),
+		Data:      hex.EncodeToString(this.Data),
+		Encrypted: this.Encrypted,
+		Name:      this.Name,
+	})
+}
+
+func (this *Record) UnmarshalJSON(data []byte) error {
+	var r jsonRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return errors.WithStack(err)
+	}
+	frame, err := hex.DecodeString(r.Frame)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	payload, err := hex.DecodeString(r.Data)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	*this = Record{
+		Time:      time.Duration(r.Time),
+		Direction: HostToDevice,
+		Addr:      r.Addr,
+		Seq:       r.Seq,
+		Frame:     frame,
+		Data:      payload,
+		Encrypted: r.Encrypted,
+		Name:      r.Name,
+	}
+	if r.Direction == DeviceToHost.String() {
+		this.Direction = DeviceToHost
+	}
+	return nil
+}
+
+// Decoder decodes frames of one line, it follows commands of each
+// address to name the replies and decrypts eSSP when the key is set
+type Decoder struct {
+	enc  *Encryption
+	last map[byte]SspCommand
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{last: make(map[byte]SspCommand)}
+}
+
+// SetKey sets the eSSP key of the line, nil key stops decryption
+func (this *Decoder) SetKey(key []byte) error {
+	if key == nil {
+		this.enc = nil
+		return nil
+	}
+	enc, err := NewEncryption(key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	this.enc = enc
+	return nil
+}
+
+// Decode returns the record of the unstuffed frame, the record of
+// an invalid frame is returned with the error
+func (this *Decoder) Decode(dir Direction, frame []byte) (*Record, error) {
+	rec := &Record{Direction: dir, Frame: append([]byte(nil), frame...)}
+	id, data, err := DecodeFrame(frame)
+	if err != nil {
+		rec.Name = "INVALID FRAME"
+		return rec, errors.WithStack(err)
+	}
+	rec.Addr = id & 0x7F
+	rec.Seq = id&0x80 != 0
+	rec.Data = data
+	if len(data) == 0 {
+		rec.Name = "EMPTY"
+		return rec, nil
+	}
+	if data[0] == xSTEX {
+		rec.Encrypted = true
+		if this.enc == nil {
+			rec.Name = "ENCRYPTED"
+			return rec, nil
+		}
+		if rec.Data, _, err = this.enc.Unseal(data); err != nil {
+			rec.Name = "ENCRYPTED"
+			rec.Data = data
+			return rec, errors.WithStack(err)
+		}
+		if len(rec.Data) == 0 {
+			rec.Name = "EMPTY"
+			return rec, nil
+		}
+	}
+
+	return rec, this.describe(rec)
+}
+
+// describe names the command or the response of the record payload
+func (this *Decoder) describe(rec *Record) error {
+	if rec.Direction == HostToDevice {
+		cmd := SspCommand(rec.Data[0])
+		this.last[rec.Addr] = cmd
+		rec.Name = cmd.String()
+		return nil
+	}
+	code := SSPResponse(rec.Data[0])
+	rec.Name = code.String()
+	if code == SspResponseOk && this.last[rec.Addr] == SspCmdPoll && len(rec.Data) > 1 {
+		events, err := DecodeEvents(rec.Data[1:])
+		names := make([]string, 0, len(events))
+		for _, ev := range events {
+			names = append(names, eventName(&ev))
+		}
+		rec.Name += ": " + strings.Join(names, ", ")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// eventName returns the event name with its channel or amounts
+func eventName(ev *Event) string {
+	switch {
+	case ev.Channel != 0:
+		return fmt.Sprintf("%s(%d)", ev.Code, ev.Channel)
+	case len(ev.Amounts) > 0:
+		var s []string
+		for _, a := range ev.Amounts {
+			s = append(s, fmt.Sprintf("%d %s", a.Value, a.Currency))
+		}
+		return fmt.Sprintf("%s(%s)", ev.Code, strings.Join(s, ", "))
+	}
+	return ev.Code.String()
+}
+
+// TraceWriter writes records of the line
+type TraceWriter interface {
+	WriteRecord(rec *Record) error
+}
+
+// TraceReader reads records, io.EOF at the end of the trace
+type TraceReader interface {
+	ReadRecord() (*Record, error)
+}
+
+type jsonTraceWriter struct {
+	enc *json.Encoder
+}
+
+// NewJSONTraceWriter writes records as JSON Lines
+func NewJSONTraceWriter(w io.Writer) TraceWriter {
+	return &jsonTraceWriter{enc: json.NewEncoder(w)}
+}
+
+func (this *jsonTraceWriter) WriteRecord(rec *Record) error {
+	return errors.WithStack(this.enc.Encode(rec))
+}
+
+type jsonTraceReader struct {
+	dec *json.Decoder
+}
+
+// NewJSONTraceReader reads records of JSON Lines
+func NewJSONTraceReader(r io.Reader) TraceReader {
+	return &jsonTraceReader{dec: json.NewDecoder(r)}
+}
+
+func (this *jsonTraceReader) ReadRecord() (*Record, error) {
+	rec := &Record{}
+	if err := this.dec.Decode(rec); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errors.WithStack(err)
+	}
+	return rec, nil
+}
+
+// binary trace starts with the magic and the version, each record is
+// uvarint time in nanoseconds, direction, flags (seq, encrypted, decrypted),
+// uvarint frame size, frame, and the decrypted payload size and payload
+// when the decrypted flag is set. Names are decoded again on read.
+const (
+	traceMagic   = "SSPT"
+	traceVersion = 1
+
+	flagSeq       = 0x01
+	flagEncrypted = 0x02
+	flagDecrypted = 0x04
+)
+
+type binaryTraceWriter struct {
+	w      io.Writer
+	header bool
+}
+
+// NewBinaryTraceWriter writes records in the compact binary format
+func NewBinaryTraceWriter(w io.Writer) TraceWriter {
+	return &binaryTraceWriter{w: w}
+}
+
+func (this *binaryTraceWriter) WriteRecord(rec *Record) error {
+	buf := make([]byte, 0, 16+len(rec.Frame)+len(rec.Data))
+	if !this.header {
+		buf = append(buf, traceMagic...)
+		buf = append(buf, traceVersion)
+		this.header = true
+	}
+	var flags byte
+	if rec.Seq {
+		flags |= flagSeq
+	}
+	if rec.Encrypted {
+		flags |= flagEncrypted
+		if len(rec.Data) == 0 || rec.Data[0] != xSTEX {
+			flags |= flagDecrypted
+		}
+	}
+	var n [binary.MaxVarintLen64]byte
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(rec.Time))]...)
+	buf = append(buf, byte(rec.Direction), flags)
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(rec.Frame)))]...)
+	buf = append(buf, rec.Frame...)
+	if flags&flagDecrypted != 0 {
+		buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(rec.Data)))]...)
+		buf = append(buf, rec.Data...)
+	}
+	_, err := this.w.Write(buf)
+	return errors.WithStack(err)
+}
+
+type binaryTraceReader struct {
+	r      *bufio.Reader
+	header bool
+	dec    *Decoder
+}
+
+// NewBinaryTraceReader reads records of the binary format
+func NewBinaryTraceReader(r io.Reader) TraceReader {
+	return &binaryTraceReader{r: bufio.NewReader(r), dec: NewDecoder()}
+}
+
+func (this *binaryTraceReader) ReadRecord() (*Record, error) {
+	if !this.header {
+		head := make([]byte, len(traceMagic)+1)
+		if _, err := io.ReadFull(this.r, head); err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, errors.WithStack(err)
+		}
+		if string(head[:len(traceMagic)]) != traceMagic || head[len(traceMagic)] != traceVersion {
+			return nil, errors.WithStack(ErrTraceFormat)
+		}
+		this.header = true
+	}
+	t, err := binary.ReadUvarint(this.r)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errors.WithStack(err)
+	}
+	var head [2]byte
+	if _, err = io.ReadFull(this.r, head[:]); err != nil {
+		return nil, errors.Wrap(ErrTraceFormat, err.Error())
+	}
+	frame, err := this.readBytes()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	dir, flags := Direction(head[0]), head[1]
+	rec, _ := this.dec.Decode(dir, frame)
+	if flags&flagDecrypted != 0 {
+		if rec.Data, err = this.readBytes(); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(rec.Data) > 0 {
+			this.dec.describe(rec)
+		}
+	}
+	rec.Time = time.Duration(t)
+	rec.Seq = flags&flagSeq != 0
+	rec.Encrypted = flags&flagEncrypted != 0
+	return rec, nil
+}
+
+// readBytes reads uvarint size and the bytes
+func (this *binaryTraceReader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(this.r)
+	if err != nil {
+		return nil, errors.Wrap(ErrTraceFormat, err.Error())
+	}
+	if n > 0x10000 {
+		return nil, errors.WithStack(ErrTraceFormat)
+	}
+	buf := make([]byte, n)
+	if _, err = io.ReadFull(this.r, buf); err != nil {
+		return nil, errors.Wrap(ErrTraceFormat, err.Error())
+	}
+	return buf, nil
+}
+
+// Recorder records frames of the line in both directions
+type Recorder struct {
+	mu    sync.Mutex
+	out   TraceWriter
+	start time.Time
+	dec   *Decoder
+	err   error
+}
+
+// NewRecorder starts the recording to the trace writer
+func NewRecorder(out TraceWriter) *Recorder {
+	return &Recorder{out: out, start: time.Now(), dec: NewDecoder()}
+}
+
+// SetKey sets the eSSP key to record decrypted payloads
+func (this *Recorder) SetKey(key []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.dec.SetKey(key)
+}
+
+// Err returns the first error of the trace writer
+func (this *Recorder) Err() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.err
+}
+
+// Record decodes and writes the unstuffed frame
+func (this *Recorder) Record(dir Direction, frame []byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	rec, _ := this.dec.Decode(dir, frame)
+	rec.Time = time.Since(this.start)
+	if err := this.out.WriteRecord(rec); err != nil && this.err == nil {
+		this.err = err
+	}
+}
+
+// Wrap returns the port recording written bytes as host frames
+// and read bytes as device frames
+func (this *Recorder) Wrap(port io.ReadWriteCloser) io.ReadWriteCloser {
+	return &recordedPort{port: port, rec: this}
+}
+
+type recordedPort struct {
+	port   io.ReadWriteCloser
+	rec    *Recorder
+	tx, rx frameScanner
+}
+
+func (this *recordedPort) Read(p []byte) (int, error) {
+	n, err := this.port.Read(p)
+	for _, b := range p[:n] {
+		if frame := this.rx.feed(b); frame != nil {
+			this.rec.Record(DeviceToHost, frame)
+		}
+	}
+	return n, err
+}
+
+func (this *recordedPort) Write(p []byte) (int, error) {
+	n, err := this.port.Write(p)
+	for _, b := range p[:n] {
+		if frame := this.tx.feed(b); frame != nil {
+			this.rec.Record(HostToDevice, frame)
+		}
+	}
+	return n, err
+}
+
+func (this *recordedPort) Close() error {
+	return this.port.Close()
+}
+
+// SetRecorder records the traffic of the device, set it before
+// the eSSP key negotiation to record decrypted payloads
+func (this *generic) SetRecorder(rec *Recorder) {
+	u := this.unit
+	if s, ok := u.(*supervisor); ok {
+		u = s.unit
+	}
+	d, ok := u.(*device)
+	if !ok {
+		return
+	}
+	d.rec = rec
+	if d.port != nil {
+		d.port = rec.Wrap(d.port)
+	}
+}
@@ -0,0 +1,141 @@
+package itlssp
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// memTrace keeps written records
+type memTrace struct {
+	records []*Record
+}
+
+func (this *memTrace) WriteRecord(rec *Record) error {
+	this.records = append(this.records, rec)
+	return nil
+}
+
+func TestRecorderWrap(t *testing.T) {
+	host, slave := Pipe(100 * time.Millisecond)
+	defer host.Close()
+	go func() {
+		for {
+			frame, err := ReadFrame(slave)
+			if err == io.EOF {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			id, _, _ := DecodeFrame(frame)
+			slave.Write(EncodeFrame(id, []byte{0xF0, byte(SspEventCredit), 0x02, byte(SspEventStacking)}))
+		}
+	}()
+
+	trace := &memTrace{}
+	rec := NewRecorder(trace)
+	d := &device{seq: 0x80, port: host}
+	gen := &generic{unit: d}
+	gen.SetRecorder(rec)
+	if _, err := gen.Poll(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(trace.records) != 2 {
+		t.Fatalf("Record failed, expected 2 records, got %v", trace.records)
+	}
+	var table = []struct {
+		dir  Direction
+		name string
+	}{
+		{HostToDevice, "POLL COMMAND"},
+		{DeviceToHost, "Success: CREDIT NOTE(2), NOTE STACKING"},
+	}
+	for i, v := range table {
+		r := trace.records[i]
+		if r.Direction != v.dir || r.Name != v.name || r.Seq != trace.records[0].Seq {
+			t.Errorf("%d: Record failed, expected %s %s, got %s", i, v.dir, v.name, r)
+		}
+	}
+	if trace.records[1].Time < trace.records[0].Time {
+		t.Errorf("record times are not monotonic: %s", trace.records)
+	}
+}
+
+func TestTraceFormats(t *testing.T) {
+	key := make([]byte, 16)
+	enc, _ := NewEncryption(key)
+	frames := []struct {
+		dir   Direction
+		frame []byte
+	}{
+		{HostToDevice, EncodeFrame(0x80, []byte{byte(SspCmdSync)})},
+		{DeviceToHost, EncodeFrame(0x80, []byte{0xF0})},
+		{HostToDevice, EncodeFrame(0x00, enc.Encrypt([]byte{byte(SspCmdPoll)}))},
+		{DeviceToHost, EncodeFrame(0x00, enc.Encrypt([]byte{0xF0, byte(SspEventRead), 0x01}))},
+	}
+
+	for _, format := range []string{"json", "binary"} {
+		var buf bytes.Buffer
+		var w TraceWriter
+		if format == "json" {
+			w = NewJSONTraceWriter(&buf)
+		} else {
+			w = NewBinaryTraceWriter(&buf)
+		}
+		rec := NewRecorder(w)
+		rec.SetKey(key)
+		for _, f := range frames {
+			frame, err := ReadFrame(bytes.NewReader(f.frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec.Record(f.dir, frame)
+		}
+
+		var r TraceReader
+		if format == "json" {
+			r = NewJSONTraceReader(&buf)
+		} else {
+			r = NewBinaryTraceReader(&buf)
+		}
+		var names []string
+		for {
+			record, err := r.ReadRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(format, err)
+			}
+			names = append(names, record.Name)
+		}
+		exp := []string{"SYNC COMMAND", "Success", "POLL COMMAND", "Success: READ NOTE(1)"}
+		if !reflect.DeepEqual(names, exp) {
+			t.Errorf("%s: ReadRecord failed, expected %q, got %q", format, exp, names)
+		}
+	}
+}
+
+func TestDecoderEncrypted(t *testing.T) {
+	enc, _ := NewEncryption(make([]byte, 16))
+	frame, _ := ReadFrame(bytes.NewReader(EncodeFrame(0x00, enc.Encrypt([]byte{byte(SspCmdEnable)}))))
+
+	dec := NewDecoder()
+	rec, err := dec.Decode(HostToDevice, frame)
+	if err != nil || rec.Name != "ENCRYPTED" || !rec.Encrypted {
+		t.Errorf("without key: %s, %v", rec, err)
+	}
+	dec.SetKey(make([]byte, 16))
+	rec, err = dec.Decode(HostToDevice, frame)
+	if err != nil || rec.Name != SspCmdEnable.String() || !reflect.DeepEqual(rec.Data, []byte{byte(SspCmdEnable)}) {
+		t.Errorf("with key: %s, %v", rec, err)
+	}
+	frame[len(frame)-1] ^= 0xFF
+	if rec, err = dec.Decode(HostToDevice, frame); err == nil {
+		t.Errorf("corrupted frame decoded: %s", rec)
+	}
+}
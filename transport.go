@@ -0,0 +1,117 @@
+package itlssp
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// OpenFunc opens the connection of the port
+type OpenFunc func(cfg *serial.Config) (io.ReadWriteCloser, error)
+
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[string]OpenFunc)
+)
+
+// RegisterPort makes devices open the port name with the function
+// instead of the serial port, used by in-memory transports
+func RegisterPort(name string, open OpenFunc) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[name] = open
+}
+
+// UnregisterPort removes the registered port
+func UnregisterPort(name string) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	delete(transports, name)
+}
+
+// openPort opens the registered port or the serial port
+func openPort(cfg *serial.Config) (io.ReadWriteCloser, error) {
+	transportsMu.Lock()
+	open, ok := transports[cfg.Name]
+	transportsMu.Unlock()
+	if ok {
+		return open(cfg)
+	}
+	return serial.OpenPort(cfg)
+}
+
+// Pipe returns both ends of an in-memory serial line. As the serial port,
+// a read returns io.EOF when no data comes within the timeout, zero timeout
+// waits forever. Closing either end closes the line.
+func Pipe(timeout time.Duration) (io.ReadWriteCloser, io.ReadWriteCloser) {
+	a := &line{signal: make(chan struct{}, 1), done: make(chan struct{})}
+	b := &line{signal: make(chan struct{}, 1), done: a.done}
+	closer := &sync.Once{}
+	return &pipeEnd{in: a, out: b, timeout: timeout, once: closer},
+		&pipeEnd{in: b, out: a, timeout: timeout, once: closer}
+}
+
+// line is one direction of the pipe
+type line struct {
+	mu     sync.Mutex
+	buf    []byte
+	signal chan struct{}
+	done   chan struct{}
+}
+
+type pipeEnd struct {
+	in      *line
+	out     *line
+	timeout time.Duration
+	once    *sync.Once
+}
+
+func (this *pipeEnd) Read(p []byte) (int, error) {
+	var timer <-chan time.Time
+	if this.timeout > 0 {
+		t := time.NewTimer(this.timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	for {
+		this.in.mu.Lock()
+		if len(this.in.buf) > 0 {
+			n := copy(p, this.in.buf)
+			this.in.buf = this.in.buf[n:]
+			this.in.mu.Unlock()
+			return n, nil
+		}
+		this.in.mu.Unlock()
+
+		select {
+		case <-this.in.signal:
+		case <-this.in.done:
+			return 0, io.ErrClosedPipe
+		case <-timer:
+			return 0, io.EOF
+		}
+	}
+}
+
+func (this *pipeEnd) Write(p []byte) (int, error) {
+	select {
+	case <-this.out.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	this.out.mu.Lock()
+	this.out.buf = append(this.out.buf, p...)
+	this.out.mu.Unlock()
+	select {
+	case this.out.signal <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+func (this *pipeEnd) Close() error {
+	this.once.Do(func() { close(this.in.done) })
+	return nil
+}
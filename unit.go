@@ -1,12 +1,12 @@
 package itlssp
 
 import (
-	"bufio"
+	"fmt"
+	"io"
+
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/tarm/serial"
-	"io"
-	reflect "reflect"
 )
 
 var (
@@ -17,39 +17,100 @@ type unit interface {
 	Open(*serial.Config) error
 	Close() error
 	SendCommand(data []byte) ([]byte, error)
+	Retransmit() ([]byte, error)
+	SetEncryption(key []byte) error
 }
 
 type device struct {
 	seq  byte
+	addr byte
 	conf *serial.Config
-	port *serial.Port
+	port io.ReadWriteCloser
+	enc  *Encryption
+	rec  *Recorder
+	last []byte // frame of the last command, sent again by Retransmit
 }
 
 // Open serial port
 func (this *device) Open(cfg *serial.Config) error {
 	var err error
-	if this.port, err = serial.OpenPort(cfg); err != nil {
+	if this.port, err = openPort(cfg); err != nil {
 		return errors.WithStack(err)
 	}
+	if this.rec != nil {
+		this.port = this.rec.Wrap(this.port)
+	}
 	return nil
 }
 
 // Close serial port
 func (this *device) Close() error {
+	if this.port == nil {
+		return nil
+	}
 	return this.port.Close()
 }
 
+// SetEncryption enables eSSP with the 16 bytes key, nil key disables it
+func (this *device) SetEncryption(key []byte) error {
+	if this.rec != nil {
+		if err := this.rec.SetKey(key); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if key == nil {
+		this.enc = nil
+		return nil
+	}
+	enc, err := NewEncryption(key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	this.enc = enc
+	return nil
+}
+
 // SendCommand sends data and checks error response
 func (this *device) SendCommand(data []byte) ([]byte, error) {
-	var err error
-	var pkg []byte
-	var buf []byte
-	if pkg, err = this.send(this.pack(data)); err != nil {
+	if len(data) == 0 {
+		return nil, errors.WithStack(ErrSspWriteCommand)
+	}
+	if data[0] == byte(SspCmdSync) {
+		this.seq = 1 // sync is always sent with the sequence flag set
+	}
+	payload := data
+	if this.enc != nil && !PlainCommand(data) {
+		payload = this.enc.Encrypt(data)
+	}
+	this.last = this.pack(payload)
+	return this.exchange(this.last)
+}
+
+// Retransmit sends the last command frame again with the same sequence flag
+// and eSSP count. The device does not run the command again but repeats its
+// last reply, so a lost reply is recovered without side effects.
+func (this *device) Retransmit() ([]byte, error) {
+	if this.last == nil {
+		return nil, errors.WithStack(ErrSspWriteCommand)
+	}
+	return this.exchange(this.last)
+}
+
+// exchange writes the frame, reads the reply and checks error response
+func (this *device) exchange(frame []byte) ([]byte, error) {
+	pkg, err := this.send(frame)
+	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	if buf, err = this.unpack(pkg); err != nil {
+	buf, err := this.unpack(pkg)
+	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	if this.enc != nil && len(buf) > 0 && buf[0] == xSTEX {
+		if buf, err = this.enc.Decrypt(buf); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
 	if err = this.checkResponse(buf); err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -68,55 +129,56 @@ func (this *device) send(buff []byte) ([]byte, error) {
 	return this.read(this.port)
 }
 
+// Refused reports whether the device replied with an error response,
+// so it did not run the command
+func Refused(err error) bool {
+	_, ok := errors.Cause(err).(*ResponseError)
+	return ok
+}
+
+// ResponseError is a non OK response of the device
+type ResponseError struct {
+	Code SSPResponse
+	Data []byte
+}
+
+func (this *ResponseError) Error() string {
+	if this.Code == SspResponseCannotProcess && len(this.Data) > 0 {
+		if this.Data[0] == 0x03 {
+			return "Validator has responded with \"Busy\", command cannot be processed at this time"
+		}
+		return fmt.Sprintf("Command response is CANNOT PROCESS COMMAND, error code - 0x%02X", this.Data[0])
+	}
+	return this.Code.String()
+}
+
 // checkResponse check the answer for errors
 func (this *device) checkResponse(data []byte) error {
-	code := SSPResponse(data[0])
-	if code != SspResponseOk {
-		if code == SspResponseCannotProcess {
-			if data[1] == 0x03 {
-				return errors.New("Validator has responded with \"Busy\", command cannot be processed at this time")
-			} else {
-				return errors.Errorf("Command response is CANNOT PROCESS COMMAND, error code - 0x%02X", data[1])
-			}
-		}
-		return errors.New(code.String())
+	if len(data) == 0 {
+		return errors.New("Empty response data")
+	}
+	if code := SSPResponse(data[0]); code != SspResponseOk {
+		return &ResponseError{Code: code, Data: data[1:]}
 	}
 	return nil
 }
 
 // read bytes from serial port
 func (this *device) read(r io.Reader) ([]byte, error) {
-
-	var buff []byte
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		buff = append(buff, scanner.Bytes()...)
-	}
-	log.Debug().Msgf("read: %X - %X", buff, scanner.Bytes())
-	return buff, errors.WithStack(scanner.Err())
+	buff, err := readPort(r)
+	log.Debug().Msgf("read: %X", buff)
+	return buff, err
 }
 
 // unpack data from the received packet
 func (this *device) unpack(data []byte) ([]byte, error) {
-	if len(data) < 6 {
-		return nil, errors.Errorf("Invalid data packet size (%d): %X", len(data), data)
-	}
-	if data[0] != xSTX {
-		return nil, errors.Errorf("Invalid data packet format: %X", data)
-	}
-
-	crc := data[len(data)-2:] // crc16
-	if !reflect.DeepEqual(crc, crc16Bytes(data[1:len(data)-2])) {
-		return nil, errors.Errorf("Invalid packet checksum 0x%04X", crc)
-	}
-
-	return data[3 : len(data)-2], nil
+	_, buf, err := DecodeFrame(data)
+	return buf, err
 }
 
 // pack data into a package for sending
 func (this *device) pack(data []byte) []byte {
-	res := append([]byte{xSTX, this.getSEQ(), byte(len(data))}, data...)
-	return append(res, crc16Bytes(res[1:])...)
+	return EncodeFrame(this.getSEQ()|this.addr, data)
 }
 
 // checkSTX checks the buffer for an entry value
@@ -125,19 +187,7 @@ func (this *device) pack(data []byte) []byte {
 // Byte stuffing is done after the CRC is calculated, the CRC its self can be byte stuffed. The maximum length of
 // data is 0xFF bytes.
 func (this *device) checkSTX(data []byte) []byte {
-	idx := 0
-	var res []byte
-	for i := 0; i < len(data); i++ {
-		if data[i] == xSTX {
-			res = append(res, data[idx:i+1]...)
-			res = append(res, xSTX)
-			idx = i + 1
-		}
-	}
-	if idx <= len(data) {
-		res = append(res, data[idx:]...)
-	}
-	return res
+	return stuffSTX(data)
 }
 
 // getSEQ receive next value SEQ
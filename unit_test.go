@@ -6,6 +6,26 @@ import (
 	"testing"
 )
 
+// echoPort records written frames and replies OK with their sequence flag
+type echoPort struct {
+	written [][]byte
+	in      bytes.Buffer
+}
+
+func (this *echoPort) Write(p []byte) (int, error) {
+	this.written = append(this.written, append([]byte(nil), p...))
+	this.in.Write(EncodeFrame(p[1], []byte{byte(SspResponseOk)}))
+	return len(p), nil
+}
+
+func (this *echoPort) Read(p []byte) (int, error) {
+	return this.in.Read(p)
+}
+
+func (this *echoPort) Close() error {
+	return nil
+}
+
 var tablePack = []struct {
 	buf []byte
 	exp []byte
@@ -27,6 +47,15 @@ func TestUnitPack(t *testing.T) {
 	}
 }
 
+func TestUnitPackAddr(t *testing.T) {
+	u := &device{seq: 0x80, addr: AddrHopper}
+	exp := []byte{xSTX, 0x10, 0x01, 0x11}
+	exp = append(exp, crc16Bytes(exp[1:])...)
+	if r := u.pack([]byte{0x11}); !reflect.DeepEqual(r, exp) {
+		t.Errorf("pack failed, expected %X, got %X", exp, r)
+	}
+}
+
 func TestUnitUnpack(t *testing.T) {
 	u := &device{seq: 0x80}
 	for _, v := range tablePack {
@@ -59,6 +88,21 @@ func TestUnitRead(t *testing.T) {
 	}
 }
 
+func TestUnitReadFrame(t *testing.T) {
+	u := &device{seq: 0x80}
+	for _, v := range tablePack {
+		src := append(append([]byte{0x00, 0xAA}, v.exp...), 0x00)
+		b, e := u.read(bytes.NewBuffer(src))
+		if e != nil || !reflect.DeepEqual(b, v.exp) {
+			t.Errorf("read failed, expected %X, got %X", v.exp, b)
+		}
+	}
+	partial := []byte{xSTX, 0x80, 0x02, 0xF0}
+	if b, e := u.read(bytes.NewBuffer(partial)); e != nil || !reflect.DeepEqual(b, partial) {
+		t.Errorf("read failed, expected %X, got %X", partial, b)
+	}
+}
+
 func TestUnitCheckSTX(t *testing.T) {
 	var table = []struct {
 		buf []byte
@@ -108,3 +152,26 @@ func TestUnitCheckResponse(t *testing.T) {
 	//	}
 	//}
 }
+
+func TestUnitRetransmit(t *testing.T) {
+	port := &echoPort{}
+	u := &device{port: port}
+	if _, err := u.Retransmit(); err == nil {
+		t.Error("retransmit failed, expected error before any command")
+	}
+	for _, send := range []func() ([]byte, error){
+		func() ([]byte, error) { return u.SendCommand([]byte{byte(SspCmdPoll)}) },
+		u.Retransmit,
+		func() ([]byte, error) { return u.SendCommand([]byte{byte(SspCmdPoll)}) },
+	} {
+		if _, err := send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(port.written[0], port.written[1]) {
+		t.Errorf("retransmit failed, expected %X, got %X", port.written[0], port.written[1])
+	}
+	if port.written[2][1] == port.written[1][1] {
+		t.Errorf("retransmit failed, expected new sequence flag, got %X", port.written[2])
+	}
+}
@@ -0,0 +1,232 @@
+package itlssp
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/tarm/serial"
+)
+
+// BarcodeReaders is a set of barcode readers of the validator
+type BarcodeReaders byte
+
+const (
+	BarcodeReaderNone   BarcodeReaders = 0x00
+	BarcodeReaderTop    BarcodeReaders = 0x01
+	BarcodeReaderBottom BarcodeReaders = 0x02
+	BarcodeReaderBoth   BarcodeReaders = 0x03
+)
+
+func (r BarcodeReaders) String() string {
+	switch r {
+	case BarcodeReaderNone:
+		return "None"
+	case BarcodeReaderTop:
+		return "Top"
+	case BarcodeReaderBottom:
+		return "Bottom"
+	case BarcodeReaderBoth:
+		return "Both"
+	default:
+		return "Unknown readers"
+	}
+}
+
+// BarcodeFormatInterleaved2of5 is the only barcode format supported by devices
+const BarcodeFormatInterleaved2of5 byte = 0x01
+
+// BarcodeConfig is the barcode reader configuration, Hardware is read only
+type BarcodeConfig struct {
+	Hardware BarcodeReaders
+	Enabled  BarcodeReaders
+	Format   byte
+	Length   byte
+}
+
+func (this *BarcodeConfig) String() string {
+	return fmt.Sprintf(`{"Hardware":"%s","Enabled":"%s","Format":%d,"Length":%d}`,
+		this.Hardware, this.Enabled, this.Format, this.Length)
+}
+
+// BarcodeInhibit disables reading of currency or barcode tickets
+type BarcodeInhibit struct {
+	Currency bool
+	Ticket   bool
+}
+
+func (this *BarcodeInhibit) String() string {
+	return fmt.Sprintf(`{"Currency":%v,"Ticket":%v}`, this.Currency, this.Ticket)
+}
+
+// TicketStatus is the state of the last read barcode ticket
+type TicketStatus byte
+
+const (
+	TicketNone     TicketStatus = 0x00
+	TicketEscrow   TicketStatus = 0x01
+	TicketStacked  TicketStatus = 0x02
+	TicketRejected TicketStatus = 0x03
+)
+
+// MarshalText encodes the status by name
+func (s TicketStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s TicketStatus) String() string {
+	switch s {
+	case TicketNone:
+		return "None"
+	case TicketEscrow:
+		return "Escrow"
+	case TicketStacked:
+		return "Stacked"
+	case TicketRejected:
+		return "Rejected"
+	default:
+		return "Unknown ticket status"
+	}
+}
+
+// Ticket is a barcode ticket read by the validator
+type Ticket struct {
+	Status  TicketStatus
+	Barcode string
+}
+
+func (this *Ticket) String() string {
+	if this == nil {
+		return "null"
+	}
+	return fmt.Sprintf(`{"Status":"%s","Barcode":"%s"}`, this.Status, this.Barcode)
+}
+
+type validator struct {
+	generic
+}
+
+func NewValidator(c *serial.Config) *validator {
+	return &validator{
+		generic: *NewGeneric(c),
+	}
+}
+
+// SetInhibits enables channels by the mask, bit 0 is channel 1
+func (this *validator) SetInhibits(mask uint16) error {
+	buf := append([]byte{byte(SspCmdSetInhibits)}, uint16Bytes(mask)...)
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// Poll returns events of the device, ticket in escrow events carry the barcode
+func (this *validator) Poll() ([]Event, error) {
+	events, err := this.generic.Poll()
+	if err != nil {
+		return events, errors.WithStack(err)
+	}
+	for i := range events {
+		if events[i].Code == SspEventTicketInEscrow {
+			if events[i].Ticket, err = this.GetBarcodeData(); err != nil {
+				return events, errors.WithStack(err)
+			}
+		}
+	}
+	return events, nil
+}
+
+// Hold keeps the note or ticket in escrow, must be repeated while held
+func (this *validator) Hold() error {
+	buf := []byte{byte(SspCmdHold)}
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// Accept stacks the note or ticket held in escrow
+func (this *validator) Accept() ([]Event, error) {
+	return this.Poll()
+}
+
+// Reject returns the note or ticket held in escrow to the customer
+func (this *validator) Reject() error {
+	buf := []byte{byte(SspCmdRejectNote)}
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// GetBarcodeConfig returns the barcode reader configuration
+func (this *validator) GetBarcodeConfig() (*BarcodeConfig, error) {
+	buf := []byte{byte(SspCmdGetBarcodeConfig)}
+	res, err := this.unit.SendCommand(buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(res) < 5 {
+		return nil, errors.Errorf("Invalid barcode config data: %X", res)
+	}
+	return &BarcodeConfig{
+		Hardware: BarcodeReaders(res[1]),
+		Enabled:  BarcodeReaders(res[2]),
+		Format:   res[3],
+		Length:   res[4],
+	}, nil
+}
+
+// SetBarcodeConfig enables barcode readers, length is 6 to 24 characters
+func (this *validator) SetBarcodeConfig(cfg *BarcodeConfig) error {
+	if cfg.Length < 6 || cfg.Length > 24 {
+		return errors.Errorf("Invalid barcode length %d", cfg.Length)
+	}
+	format := cfg.Format
+	if format == 0 {
+		format = BarcodeFormatInterleaved2of5
+	}
+	buf := []byte{byte(SspCmdSetBarcodeConfig), byte(cfg.Enabled), format, cfg.Length}
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// GetBarcodeInhibit returns the currency and ticket inhibit state
+func (this *validator) GetBarcodeInhibit() (*BarcodeInhibit, error) {
+	buf := []byte{byte(SspCmdGetBarcodeInhibit)}
+	res, err := this.unit.SendCommand(buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(res) < 2 {
+		return nil, errors.Errorf("Invalid barcode inhibit data: %X", res)
+	}
+	return &BarcodeInhibit{
+		Currency: res[1]&0x01 != 0,
+		Ticket:   res[1]&0x02 != 0,
+	}, nil
+}
+
+// SetBarcodeInhibit inhibits reading of currency or tickets
+func (this *validator) SetBarcodeInhibit(inh *BarcodeInhibit) error {
+	var mask byte = 0xFC
+	if inh.Currency {
+		mask |= 0x01
+	}
+	if inh.Ticket {
+		mask |= 0x02
+	}
+	buf := []byte{byte(SspCmdSetBarcodeInhibit), mask}
+	_, err := this.unit.SendCommand(buf)
+	return errors.WithStack(err)
+}
+
+// GetBarcodeData returns the last read barcode ticket
+func (this *validator) GetBarcodeData() (*Ticket, error) {
+	buf := []byte{byte(SspCmdGetBarcodeData)}
+	res, err := this.unit.SendCommand(buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(res) < 3 || len(res) < 3+int(res[2]) {
+		return nil, errors.Errorf("Invalid barcode data: %X", res)
+	}
+	return &Ticket{
+		Status:  TicketStatus(res[1]),
+		Barcode: string(res[3 : 3+int(res[2])]),
+	}, nil
+}
@@ -0,0 +1,83 @@
+package itlssp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidatorTicketEvent(t *testing.T) {
+	u := &fakeUnit{reply: [][]byte{
+		{0xF0, 0xE5},
+		{0xF0, 0x01, 0x06, '1', '2', '3', '4', '5', '6'},
+	}}
+	v := &validator{generic{unit: u}}
+	ev, err := v.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &Ticket{Status: TicketEscrow, Barcode: "123456"}
+	if len(ev) != 1 || !reflect.DeepEqual(ev[0].Ticket, exp) {
+		t.Errorf("Poll failed, expected ticket %s, got %v", exp, ev)
+	}
+	if !reflect.DeepEqual(u.sent[1], []byte{byte(SspCmdGetBarcodeData)}) {
+		t.Errorf("Poll failed, expected barcode data request, got %X", u.sent[1])
+	}
+}
+
+func TestValidatorEscrow(t *testing.T) {
+	u := &fakeUnit{}
+	v := &validator{generic{unit: u}}
+	if err := v.Hold(); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Reject(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	exp := [][]byte{{byte(SspCmdHold)}, {byte(SspCmdRejectNote)}, {byte(SspCmdPoll)}}
+	if !reflect.DeepEqual(u.sent, exp) {
+		t.Errorf("escrow failed, expected %X, got %X", exp, u.sent)
+	}
+}
+
+func TestValidatorBarcodeConfig(t *testing.T) {
+	u := &fakeUnit{reply: [][]byte{{0xF0, 0x03, 0x01, 0x01, 0x12}, {0xF0}}}
+	v := &validator{generic{unit: u}}
+	cfg, err := v.GetBarcodeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &BarcodeConfig{Hardware: BarcodeReaderBoth, Enabled: BarcodeReaderTop, Format: 1, Length: 18}
+	if !reflect.DeepEqual(cfg, exp) {
+		t.Errorf("GetBarcodeConfig failed, expected %s, got %s", exp, cfg)
+	}
+	if err = v.SetBarcodeConfig(&BarcodeConfig{Enabled: BarcodeReaderBoth, Length: 18}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u.sent[1], []byte{0x23, 0x03, 0x01, 0x12}) {
+		t.Errorf("SetBarcodeConfig failed, got %X", u.sent[1])
+	}
+	if err = v.SetBarcodeConfig(&BarcodeConfig{Length: 30}); err == nil {
+		t.Error("SetBarcodeConfig failed, expected length error")
+	}
+}
+
+func TestValidatorBarcodeInhibit(t *testing.T) {
+	u := &fakeUnit{reply: [][]byte{{0xF0}, {0xF0, 0xFE}}}
+	v := &validator{generic{unit: u}}
+	if err := v.SetBarcodeInhibit(&BarcodeInhibit{Currency: false, Ticket: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u.sent[0], []byte{0x26, 0xFE}) {
+		t.Errorf("SetBarcodeInhibit failed, got %X", u.sent[0])
+	}
+	inh, err := v.GetBarcodeInhibit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inh.Currency || !inh.Ticket {
+		t.Errorf("GetBarcodeInhibit failed, got %s", inh)
+	}
+}
@@ -0,0 +1,220 @@
+package itlssp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PortEventType is the kind of port event
+type PortEventType byte
+
+const (
+	DeviceAttached PortEventType = iota
+	DeviceDetached
+)
+
+func (t PortEventType) String() string {
+	switch t {
+	case DeviceAttached:
+		return "Attached"
+	case DeviceDetached:
+		return "Detached"
+	default:
+		return "Unknown port event"
+	}
+}
+
+// PortEvent reports the device appeared on or disappeared from the port.
+// Previous is the last port of the attached device with the same serial number.
+type PortEvent struct {
+	Type     PortEventType
+	Device   *SSPDevice
+	Previous *SSPConnection
+}
+
+func (this *PortEvent) String() string {
+	prev := "null"
+	if this.Previous != nil {
+		prev = this.Previous.String()
+	}
+	return fmt.Sprintf(`{"Type":"%s","Serial":%d,"Port":%s,"Previous":%s}`,
+		this.Type, this.Device.Serial, this.Device.Port, prev)
+}
+
+// Watcher watches available ports and identifies devices on new ports.
+// A port without devices is probed at every scan Retries times, then with
+// doubling intervals up to MaxBackoff while it stays present, so a slow
+// booting device is found.
+type Watcher struct {
+	Config     DiscoverConfig
+	Interval   time.Duration
+	Retries    int
+	MaxBackoff time.Duration
+
+	mu      sync.Mutex
+	ports   map[string][]*SSPDevice // identified ports
+	pending map[string]*retry       // ports failed identification
+	known   map[uint32]*SSPConnection
+	list    func() []string
+	probe   func(ctx context.Context, cfg *DiscoverConfig) []*PortResult
+	now     func() time.Time
+}
+
+// retry is the identification state of the port without devices
+type retry struct {
+	attempts int
+	next     time.Time // probe not before
+}
+
+// NewWatcher returns watcher probing ports with the addresses and baud rates
+// of the cfg, Ports of the cfg are ignored
+func NewWatcher(cfg *DiscoverConfig, interval time.Duration) *Watcher {
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	w := &Watcher{
+		Interval:   interval,
+		Retries:    3,
+		MaxBackoff: time.Minute,
+		ports:      make(map[string][]*SSPDevice),
+		pending:    make(map[string]*retry),
+		known:      make(map[uint32]*SSPConnection),
+		list: func() (names []string) {
+			for _, p := range AvailablePorts() {
+				names = append(names, p.Name)
+			}
+			return names
+		},
+		probe: Discover,
+		now:   time.Now,
+	}
+	if cfg != nil {
+		w.Config = *cfg
+	}
+	return w
+}
+
+// Run scans ports every interval and sends events until ctx is done
+func (this *Watcher) Run(ctx context.Context, events chan<- PortEvent) error {
+	ticker := time.NewTicker(this.Interval)
+	defer ticker.Stop()
+	for {
+		for _, ev := range this.scan(ctx) {
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Lookup returns the current port of the device with the serial number
+func (this *Watcher) Lookup(serial uint32) *SSPConnection {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, devices := range this.ports {
+		for _, d := range devices {
+			if d.Serial == serial {
+				return d.Port
+			}
+		}
+	}
+	return nil
+}
+
+// scan compares available ports with the last scan and identifies new ports
+func (this *Watcher) scan(ctx context.Context) []PortEvent {
+	events, fresh := this.detach(this.list())
+	if len(fresh) == 0 {
+		return events
+	}
+	cfg := this.Config
+	cfg.Ports = fresh
+	return append(events, this.attach(this.probe(ctx, &cfg))...)
+}
+
+// detach forgets ports gone since the last scan and returns the ports to probe
+func (this *Watcher) detach(names []string) (events []PortEvent, fresh []string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	now := this.now()
+	present := make(map[string]bool)
+	for _, name := range names {
+		present[name] = true
+		if _, ok := this.ports[name]; ok {
+			continue
+		}
+		if r := this.pending[name]; r == nil || !now.Before(r.next) {
+			fresh = append(fresh, name)
+		}
+	}
+
+	for name, devices := range this.ports {
+		if present[name] {
+			continue
+		}
+		for _, d := range devices {
+			events = append(events, PortEvent{Type: DeviceDetached, Device: d})
+		}
+		delete(this.ports, name)
+	}
+	for name := range this.pending {
+		if !present[name] {
+			delete(this.pending, name)
+		}
+	}
+	return events, fresh
+}
+
+// attach keeps identified ports and schedules the next probe of the others
+func (this *Watcher) attach(results []*PortResult) (events []PortEvent) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, res := range results {
+		if len(res.Devices) == 0 {
+			r := this.pending[res.Port]
+			if r == nil {
+				r = &retry{}
+				this.pending[res.Port] = r
+			}
+			r.attempts++
+			r.next = this.now().Add(this.backoff(r.attempts))
+			continue
+		}
+		delete(this.pending, res.Port)
+		this.ports[res.Port] = res.Devices
+		for _, d := range res.Devices {
+			ev := PortEvent{Type: DeviceAttached, Device: d}
+			if prev, ok := this.known[d.Serial]; ok && *prev != *d.Port {
+				ev.Previous = prev
+			}
+			this.known[d.Serial] = d.Port
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// backoff is the delay of the next probe after failed attempts, none for
+// the first Retries attempts, then doubling from the interval
+func (this *Watcher) backoff(attempts int) time.Duration {
+	if attempts < this.Retries {
+		return 0
+	}
+	d := this.Interval
+	for i := this.Retries; i < attempts && d < this.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > this.MaxBackoff {
+		d = this.MaxBackoff
+	}
+	return d
+}
@@ -0,0 +1,156 @@
+package itlssp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatcherScan(t *testing.T) {
+	ports := []string{"/dev/ttyACM0"}
+	probes := 0
+	w := NewWatcher(nil, 0)
+	w.list = func() []string { return ports }
+	w.probe = func(ctx context.Context, cfg *DiscoverConfig) (res []*PortResult) {
+		probes++
+		for _, name := range cfg.Ports {
+			r := &PortResult{Port: name, Err: ErrNoDeviceFound}
+			if name != "/dev/ttyS0" {
+				r.Devices = []*SSPDevice{{Port: &SSPConnection{Name: name}, Unit: &Unit{}, Serial: 1234}}
+				r.Err = nil
+			}
+			res = append(res, r)
+		}
+		return res
+	}
+	ctx := context.Background()
+
+	ev := w.scan(ctx)
+	if len(ev) != 1 || ev[0].Type != DeviceAttached || ev[0].Previous != nil {
+		t.Fatalf("scan failed, expected attach, got %v", ev)
+	}
+	if ev = w.scan(ctx); len(ev) != 0 || probes != 1 {
+		t.Fatalf("scan failed, expected no events and probes, got %v", ev)
+	}
+
+	// power blip, device comes back on another port
+	ports = []string{"/dev/ttyS0"}
+	ev = w.scan(ctx)
+	if len(ev) != 1 || ev[0].Type != DeviceDetached || ev[0].Device.Port.Name != "/dev/ttyACM0" {
+		t.Fatalf("scan failed, expected detach, got %v", ev)
+	}
+	if w.Lookup(1234) != nil {
+		t.Error("Lookup failed, expected detached device")
+	}
+	ports = []string{"/dev/ttyS0", "/dev/ttyACM1"}
+	ev = w.scan(ctx)
+	if len(ev) != 1 || ev[0].Type != DeviceAttached || ev[0].Previous == nil || ev[0].Previous.Name != "/dev/ttyACM0" {
+		t.Fatalf("scan failed, expected attach from previous port, got %v", ev)
+	}
+	if p := w.Lookup(1234); p == nil || p.Name != "/dev/ttyACM1" {
+		t.Errorf("Lookup failed, expected /dev/ttyACM1, got %v", p)
+	}
+
+	// port without devices is probed Retries times, then with backoff
+	for i := 0; i < 5; i++ {
+		w.scan(ctx)
+	}
+	if n := w.pending["/dev/ttyS0"].attempts; n != w.Retries {
+		t.Errorf("scan failed, expected %d attempts, got %d", w.Retries, n)
+	}
+}
+
+func TestWatcherBackoff(t *testing.T) {
+	now := time.Unix(0, 0)
+	booted := false
+	probes := 0
+	w := NewWatcher(nil, time.Second)
+	w.MaxBackoff = 4 * time.Second
+	w.now = func() time.Time { return now }
+	w.list = func() []string { return []string{"/dev/ttyUSB0"} }
+	w.probe = func(ctx context.Context, cfg *DiscoverConfig) (res []*PortResult) {
+		probes++
+		r := &PortResult{Port: cfg.Ports[0], Err: ErrNoDeviceFound}
+		if booted {
+			r.Devices = []*SSPDevice{{Port: &SSPConnection{Name: cfg.Ports[0]}, Unit: &Unit{}, Serial: 1234}}
+			r.Err = nil
+		}
+		return append(res, r)
+	}
+	var table = []struct {
+		wait   time.Duration
+		probes int
+	}{
+		{0, 1},
+		{0, 2},
+		{0, 3},
+		{0, 3},
+		{time.Second, 4},
+		{time.Second, 4},
+		{time.Second, 5},
+		{3 * time.Second, 5},
+		{time.Second, 6},
+		{4 * time.Second, 7},
+		{4 * time.Second, 8},
+	}
+
+	for i, v := range table {
+		now = now.Add(v.wait)
+		w.scan(context.Background())
+		if probes != v.probes {
+			t.Errorf("%d: scan failed, expected %d probes, got %d", i, v.probes, probes)
+		}
+	}
+
+	// the device finished booting
+	booted = true
+	now = now.Add(4 * time.Second)
+	if ev := w.scan(context.Background()); len(ev) != 1 || ev[0].Type != DeviceAttached {
+		t.Fatalf("scan failed, expected attach, got %v", ev)
+	}
+	if _, ok := w.pending["/dev/ttyUSB0"]; ok {
+		t.Error("scan failed, expected no pending port")
+	}
+}
+
+func TestWatcherLookup(t *testing.T) {
+	ports := []string{"/dev/ttyACM0"}
+	var mu sync.Mutex
+	w := NewWatcher(nil, 0)
+	w.list = func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return ports
+	}
+	w.probe = func(ctx context.Context, cfg *DiscoverConfig) (res []*PortResult) {
+		for _, name := range cfg.Ports {
+			res = append(res, &PortResult{Port: name,
+				Devices: []*SSPDevice{{Port: &SSPConnection{Name: name}, Unit: &Unit{}, Serial: 1234}}})
+		}
+		return res
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			mu.Lock()
+			ports = []string{fmt.Sprintf("/dev/ttyACM%d", i%2)}
+			mu.Unlock()
+			w.scan(context.Background())
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if p := w.Lookup(1234); p == nil || p.Name != "/dev/ttyACM1" {
+				t.Errorf("Lookup failed, expected /dev/ttyACM1, got %v", p)
+			}
+			return
+		default:
+			w.Lookup(1234)
+		}
+	}
+}